@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	ringFrameSize = 1 << 11
+	ringRetireMs  = 100
+)
+
+//ring AF_PACKET + TPACKET_V3 的收包环 收发两个方向的数据都能看到
+type ring struct {
+	fd     int
+	mmap   []byte
+	size   int
+	num    int
+	cursor int
+	closed int32
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func newRing(name string, promisc bool, size, num int) (*ring, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	//协议为0的socket在bind之前不收包
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("afpacket socket %v", err)
+	}
+
+	r := &ring{fd: fd, size: size, num: num}
+	if err = r.setup(iface, promisc); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+//setup 先挂上丢弃所有报文的过滤器再bind到网卡 最后开启收包环 环里不会有其他网卡或者未过滤的报文
+//端口过滤由attach替换 之后调用drain丢弃替换之前的block
+func (r *ring) setup(iface *net.Interface, promisc bool) error {
+	if err := unix.SetsockoptInt(r.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return fmt.Errorf("afpacket set tpacket v3 %v", err)
+	}
+
+	if err := r.attach(bpfDropAll); err != nil {
+		return fmt.Errorf("afpacket attach drop filter %v", err)
+	}
+
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index}
+	if err := unix.Bind(r.fd, sa); err != nil {
+		return fmt.Errorf("afpacket bind %s %v", iface.Name, err)
+	}
+
+	if promisc {
+		mreq := &unix.PacketMreq{Ifindex: int32(iface.Index), Type: unix.PACKET_MR_PROMISC}
+		if err := unix.SetsockoptPacketMreq(r.fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+			return fmt.Errorf("afpacket promisc %s %v", iface.Name, err)
+		}
+	}
+
+	req := &unix.TpacketReq3{
+		Block_size:     uint32(r.size),
+		Block_nr:       uint32(r.num),
+		Frame_size:     ringFrameSize,
+		Frame_nr:       uint32(r.size / ringFrameSize * r.num),
+		Retire_blk_tov: ringRetireMs,
+	}
+
+	if err := unix.SetsockoptTpacketReq3(r.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, req); err != nil {
+		return fmt.Errorf("afpacket set rx ring %v", err)
+	}
+
+	data, err := unix.Mmap(r.fd, 0, r.size*r.num, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("afpacket mmap %v", err)
+	}
+	r.mmap = data
+	return nil
+}
+
+//drain 丢弃已经交给用户态的block 替换过滤器之前收到的报文不处理
+func (r *ring) drain() {
+	for i := 0; i < r.num; i++ {
+		hdr := r.block()
+		if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+			return
+		}
+
+		atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+		r.cursor = (r.cursor + 1) % r.num
+	}
+}
+
+func (r *ring) block() *unix.TpacketHdrV1 {
+	desc := (*unix.TpacketBlockDesc)(unsafe.Pointer(&r.mmap[r.cursor*r.size]))
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&desc.Hdr[0]))
+}
+
+//wait 等待下一个可读的block 超时返回nil
+func (r *ring) wait(timeout time.Duration) *unix.TpacketHdrV1 {
+	hdr := r.block()
+	if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER != 0 {
+		return hdr
+	}
+
+	fds := []unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN | unix.POLLERR}}
+	if _, err := unix.Poll(fds, int(timeout/time.Millisecond)); err != nil {
+		return nil
+	}
+
+	if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER != 0 {
+		return hdr
+	}
+	return nil
+}
+
+//walk 遍历block中的数据包 数据只在回调期间有效
+func (r *ring) walk(hdr *unix.TpacketHdrV1, fn func(ts time.Time, data []byte)) {
+	base := r.cursor * r.size
+	offset := int(hdr.Offset_to_first_pkt)
+
+	for i := uint32(0); i < hdr.Num_pkts; i++ {
+		if offset <= 0 || offset >= r.size {
+			break
+		}
+
+		pkt := (*unix.Tpacket3Hdr)(unsafe.Pointer(&r.mmap[base+offset]))
+		begin := base + offset + int(pkt.Net)
+		end := base + offset + int(pkt.Mac) + int(pkt.Snaplen)
+		if begin < end && end <= base+r.size {
+			fn(time.Unix(int64(pkt.Sec), int64(pkt.Nsec)), r.mmap[begin:end])
+		}
+
+		if pkt.Next_offset == 0 {
+			break
+		}
+		offset += int(pkt.Next_offset)
+	}
+
+	atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+	r.cursor = (r.cursor + 1) % r.num
+}
+
+func (r *ring) close() error {
+	if !atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		return nil
+	}
+
+	unix.Munmap(r.mmap)
+	return unix.Close(r.fd)
+}
+
+func (m *monitor) acceptRing() {
+	for {
+		select {
+
+		case <-m.tom.Dying():
+			xEnv.Errorf("%s accept %v", m.Name(), m.tom.Err())
+			return
+
+		default:
+			hdr := m.ring.wait(time.Second)
+			m.tick(time.Now())
+			if hdr == nil {
+				continue
+			}
+
+			m.ring.walk(hdr, func(ts time.Time, data []byte) {
+				f, err := decodeIP(data)
+				if err != nil {
+					return
+				}
+
+				f.ts = ts
+				m.decode(f)
+			})
+		}
+	}
+}
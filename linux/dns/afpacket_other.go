@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package dns
+
+import "fmt"
+
+type ring struct{}
+
+func newRing(name string, promisc bool, size, num int) (*ring, error) {
+	return nil, fmt.Errorf("afpacket only support linux")
+}
+
+func (r *ring) drain() {}
+
+func (r *ring) close() error {
+	return nil
+}
+
+func (m *monitor) acceptRing() {}
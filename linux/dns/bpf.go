@@ -0,0 +1,228 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/rock-go/rock/lua"
+	"strconv"
+	"strings"
+)
+
+const (
+	bpfLdB   = 0x30 //ldb [k]
+	bpfLdH   = 0x28 //ldh [k]
+	bpfLdHX  = 0x48 //ldh [x+k]
+	bpfLdxB  = 0xb1 //ldx 4*([k]&0xf)
+	bpfRsh   = 0x74 //rsh #k
+	bpfJeq   = 0x15 //jeq #k
+	bpfJset  = 0x45 //jset #k
+	bpfRet   = 0x06 //ret #k
+	bpfNetOf = 0xfff00000
+
+	bpfAccept = 0x40000
+)
+
+type bpfInsn struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+//bpfDropAll 丢弃所有报文 afpacket在设置好端口过滤之前使用
+var bpfDropAll = []bpfInsn{{code: bpfRet, k: 0}}
+
+//bpfAsm 简单的bpf汇编 跳转目标使用label 最后统一计算偏移
+type bpfAsm struct {
+	insn  []bpfInsn
+	jumps map[int][2]string
+	label map[string]int
+}
+
+func newBpfAsm() *bpfAsm {
+	return &bpfAsm{jumps: make(map[int][2]string), label: make(map[string]int)}
+}
+
+func (a *bpfAsm) op(code uint16, k uint32) {
+	a.insn = append(a.insn, bpfInsn{code: code, k: k})
+}
+
+func (a *bpfAsm) jmp(code uint16, k uint32, jt, jf string) {
+	a.jumps[len(a.insn)] = [2]string{jt, jf}
+	a.insn = append(a.insn, bpfInsn{code: code, k: k})
+}
+
+func (a *bpfAsm) mark(name string) {
+	a.label[name] = len(a.insn)
+}
+
+func (a *bpfAsm) offset(pc int, name string) (uint8, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	at, ok := a.label[name]
+	if !ok {
+		return 0, fmt.Errorf("bpf label %s not found", name)
+	}
+
+	n := at - pc - 1
+	if n < 0 || n > 255 {
+		return 0, fmt.Errorf("bpf jump to %s out of range", name)
+	}
+	return uint8(n), nil
+}
+
+func (a *bpfAsm) assemble() ([]bpfInsn, error) {
+	for pc, j := range a.jumps {
+		jt, err := a.offset(pc, j[0])
+		if err != nil {
+			return nil, err
+		}
+
+		jf, err := a.offset(pc, j[1])
+		if err != nil {
+			return nil, err
+		}
+
+		a.insn[pc].jt = jt
+		a.insn[pc].jf = jf
+	}
+	return a.insn, nil
+}
+
+//portFilter 只放行源端口或者目的端口命中的udp/tcp报文
+//使用SKF_NET_OFF 相对网络层取值 raw socket 和 AF_PACKET 都适用
+func portFilter(ports []int) ([]bpfInsn, error) {
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("bpf port list is empty")
+	}
+
+	a := newBpfAsm()
+	a.op(bpfLdB, bpfNetOf)
+	a.op(bpfRsh, 4)
+	a.jmp(bpfJeq, 4, "v4", "")
+	a.jmp(bpfJeq, 6, "v6", "drop")
+
+	a.mark("v4")
+	a.op(bpfLdB, bpfNetOf+9)
+	a.jmp(bpfJeq, protoUDP, "v4_frag", "")
+	a.jmp(bpfJeq, protoTCP, "v4_frag", "drop")
+	a.mark("v4_frag")
+	a.op(bpfLdH, bpfNetOf+6)
+	a.jmp(bpfJset, 0x1fff, "drop", "")
+	a.op(bpfLdxB, bpfNetOf)
+	a.op(bpfLdHX, bpfNetOf)
+	a.ports(ports, "v4_dst")
+	a.mark("v4_dst")
+	a.op(bpfLdHX, bpfNetOf+2)
+	a.ports(ports, "drop")
+
+	a.mark("v6")
+	a.op(bpfLdB, bpfNetOf+6)
+	a.jmp(bpfJeq, protoUDP, "v6_port", "")
+	a.jmp(bpfJeq, protoTCP, "v6_port", "drop")
+	a.mark("v6_port")
+	a.op(bpfLdH, bpfNetOf+40)
+	a.ports(ports, "v6_dst")
+	a.mark("v6_dst")
+	a.op(bpfLdH, bpfNetOf+42)
+	a.ports(ports, "drop")
+
+	a.mark("accept")
+	a.op(bpfRet, bpfAccept)
+	a.mark("drop")
+	a.op(bpfRet, 0)
+
+	return a.assemble()
+}
+
+func (a *bpfAsm) ports(ports []int, miss string) {
+	n := len(ports)
+	for i, p := range ports {
+		if i == n-1 {
+			a.jmp(bpfJeq, uint32(p), "accept", miss)
+			return
+		}
+		a.jmp(bpfJeq, uint32(p), "accept", "")
+	}
+}
+
+//parseBpf 解析 tcpdump -ddd 的输出 第一行是指令条数 后面每行 code jt jf k
+func parseBpf(text string) ([]bpfInsn, error) {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ';'
+	})
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("bpf program is empty")
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return nil, fmt.Errorf("bpf program count %v", err)
+	}
+
+	if n != len(fields)-1 {
+		return nil, fmt.Errorf("bpf program want %d instructions got %d", n, len(fields)-1)
+	}
+
+	insn := make([]bpfInsn, 0, n)
+	for _, line := range fields[1:] {
+		var v [4]uint64
+		items := strings.Fields(line)
+		if len(items) != 4 {
+			return nil, fmt.Errorf("invalid bpf instruction %s", line)
+		}
+
+		for i, item := range items {
+			v[i], err = strconv.ParseUint(item, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bpf instruction %s", line)
+			}
+		}
+		insn = append(insn, bpfInsn{code: uint16(v[0]), jt: uint8(v[1]), jf: uint8(v[2]), k: uint32(v[3])})
+	}
+
+	return insn, nil
+}
+
+//checkBpf 支持tcpdump -ddd的字符串 或者 {{code,jt,jf,k},...} 的table
+func checkBpf(L *lua.LState, val lua.LValue) []bpfInsn {
+	switch val.Type() {
+	case lua.LTString:
+		insn, err := parseBpf(val.String())
+		if err != nil {
+			L.RaiseError("%v", err)
+			return nil
+		}
+		return insn
+
+	case lua.LTTable:
+		tab := val.(*lua.LTable)
+		n := tab.Len()
+		insn := make([]bpfInsn, 0, n)
+		for i := 1; i <= n; i++ {
+			item, ok := tab.RawGetInt(i).(*lua.LTable)
+			if !ok || item.Len() != 4 {
+				L.RaiseError("invalid bpf instruction #%d , must be {code , jt , jf , k}", i)
+				return nil
+			}
+
+			var v [4]uint32
+			for j := 0; j < 4; j++ {
+				num, ok := item.RawGetInt(j + 1).(lua.LNumber)
+				if !ok {
+					L.RaiseError("invalid bpf instruction #%d", i)
+					return nil
+				}
+				v[j] = uint32(num)
+			}
+			insn = append(insn, bpfInsn{code: uint16(v[0]), jt: uint8(v[1]), jf: uint8(v[2]), k: v[3]})
+		}
+		return insn
+
+	default:
+		L.RaiseError("invalid bpf type , must be string or table , got %s", val.Type().String())
+		return nil
+	}
+}
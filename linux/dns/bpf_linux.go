@@ -0,0 +1,43 @@
+package dns
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+	"unsafe"
+)
+
+func attachBpf(fd int, insn []bpfInsn) error {
+	filter := make([]unix.SockFilter, len(insn))
+	for i, in := range insn {
+		filter[i] = unix.SockFilter{Code: in.code, Jt: in.jt, Jf: in.jf, K: in.k}
+	}
+
+	prog := &unix.SockFprog{Len: uint16(len(filter)), Filter: (*unix.SockFilter)(unsafe.Pointer(&filter[0]))}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog)
+}
+
+func attachConn(conn syscall.Conn, insn []bpfInsn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var e error
+	err = raw.Control(func(fd uintptr) {
+		e = attachBpf(int(fd), insn)
+	})
+
+	if err != nil {
+		return err
+	}
+	return e
+}
+
+func (r *ring) attach(insn []bpfInsn) error {
+	return attachBpf(r.fd, insn)
+}
+
+//detach 端口过滤设置失败时去掉丢弃所有报文的过滤器 使用用户态的acl
+func (r *ring) detach() error {
+	return unix.SetsockoptInt(r.fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0)
+}
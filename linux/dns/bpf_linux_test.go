@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//bpfRecv 向conn发送一个报文 返回是否收到
+func bpfRecv(t *testing.T, conn net.PacketConn) bool {
+	t.Helper()
+
+	c, err := net.Dial("udp4", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = conn.ReadFrom(buf)
+	return err == nil
+}
+
+//TestBpfKernel 内核接受portFilter生成的程序 并且按端口过滤 普通的udp套接字就可以挂载
+func TestBpfKernel(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sc := conn.(syscall.Conn)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	insn, _ := portFilter([]int{53, port})
+	if err = attachConn(sc, insn); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bpfRecv(t, conn) {
+		t.Fatal("matched port dropped")
+	}
+
+	insn, _ = portFilter([]int{53})
+	if err = attachConn(sc, insn); err != nil {
+		t.Fatal(err)
+	}
+
+	if bpfRecv(t, conn) {
+		t.Fatal("other port accepted")
+	}
+
+	//内核拒绝的程序 跳转越界和没有ret结尾
+	for _, bad := range [][]bpfInsn{
+		{{code: bpfJeq, jt: 5, k: 1}, {code: bpfRet}},
+		{{code: bpfLdB, k: 0}},
+		{{code: 0xffff}, {code: bpfRet}},
+	} {
+		if err = attachConn(sc, bad); err == nil {
+			t.Fatalf("%v attached", bad)
+		}
+	}
+
+	if err = attachConn(sc, bpfDropAll); err != nil {
+		t.Fatal(err)
+	}
+}
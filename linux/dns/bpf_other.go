@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package dns
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func attachConn(conn syscall.Conn, insn []bpfInsn) error {
+	return fmt.Errorf("bpf filter only support linux")
+}
+
+func (r *ring) attach(insn []bpfInsn) error {
+	return fmt.Errorf("bpf filter only support linux")
+}
+
+func (r *ring) detach() error {
+	return nil
+}
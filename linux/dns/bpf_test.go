@@ -0,0 +1,194 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+//bpfRun 按内核的语义执行portFilter用到的指令 pkt从网络层开始 越界读取时丢弃
+func bpfRun(t *testing.T, insn []bpfInsn, pkt []byte) uint32 {
+	t.Helper()
+
+	var a, x uint32
+	load := func(off uint32, size int) (uint32, bool) {
+		if off >= bpfNetOf {
+			off -= bpfNetOf
+		}
+
+		if int(off)+size > len(pkt) {
+			return 0, false
+		}
+
+		if size == 1 {
+			return uint32(pkt[off]), true
+		}
+		return uint32(binary.BigEndian.Uint16(pkt[off:])), true
+	}
+
+	for pc := 0; pc < len(insn); pc++ {
+		in := insn[pc]
+		var ok bool
+
+		switch in.code {
+		case bpfLdB:
+			if a, ok = load(in.k, 1); !ok {
+				return 0
+			}
+		case bpfLdH:
+			if a, ok = load(in.k, 2); !ok {
+				return 0
+			}
+		case bpfLdHX:
+			if a, ok = load(in.k+x, 2); !ok {
+				return 0
+			}
+		case bpfLdxB:
+			v, ok := load(in.k, 1)
+			if !ok {
+				return 0
+			}
+			x = 4 * (v & 0xf)
+		case bpfRsh:
+			a >>= in.k
+		case bpfJeq:
+			if a == in.k {
+				pc += int(in.jt)
+			} else {
+				pc += int(in.jf)
+			}
+		case bpfJset:
+			if a&in.k != 0 {
+				pc += int(in.jt)
+			} else {
+				pc += int(in.jf)
+			}
+		case bpfRet:
+			return in.k
+		default:
+			t.Fatalf("pc %d unknown code %#x", pc, in.code)
+		}
+	}
+
+	t.Fatal("program without ret")
+	return 0
+}
+
+func bpfPacket(t *testing.T, proto uint8, src, dst string, sport, dport uint16) []byte {
+	t.Helper()
+	pkt, err := rawPacket(pcapTx(false, proto, net.ParseIP(src), net.ParseIP(dst), sport, dport), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func TestPortFilter(t *testing.T) {
+	insn, err := portFilter([]int{53, 5353, 5355})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//第一片带MF标志 后续分片没有端口
+	first := bpfPacket(t, protoUDP, "10.0.0.1", "8.8.8.8", 40000, 53)
+	binary.BigEndian.PutUint16(first[6:8], 0x2000)
+	frag := bpfPacket(t, protoUDP, "10.0.0.1", "8.8.8.8", 40000, 53)
+	binary.BigEndian.PutUint16(frag[6:8], 0x2000|100)
+
+	//带ip选项的报文 端口按ihl计算
+	plain := bpfPacket(t, protoUDP, "10.0.0.1", "8.8.8.8", 40000, 53)
+	opts := append(append(append([]byte(nil), plain[:20]...), 1, 1, 1, 0), plain[20:]...)
+	opts[0] = 0x46
+
+	icmp := bpfPacket(t, protoUDP, "10.0.0.1", "8.8.8.8", 40000, 53)
+	icmp[9] = 1
+	hop := bpfPacket(t, protoUDP, "2001:db8::1", "2001:db8::53", 40000, 53)
+	hop[6] = 0
+
+	for name, c := range map[string]struct {
+		pkt    []byte
+		accept bool
+	}{
+		"v4 udp query":      {bpfPacket(t, protoUDP, "10.0.0.1", "8.8.8.8", 40000, 53), true},
+		"v4 udp response":   {bpfPacket(t, protoUDP, "8.8.8.8", "10.0.0.1", 53, 40000), true},
+		"v4 tcp query":      {bpfPacket(t, protoTCP, "10.0.0.1", "8.8.8.8", 40000, 53), true},
+		"v4 mdns":           {bpfPacket(t, protoUDP, "10.0.0.1", "224.0.0.251", 5353, 5353), true},
+		"v4 llmnr":          {bpfPacket(t, protoUDP, "10.0.0.1", "224.0.0.252", 40000, 5355), true},
+		"v6 udp query":      {bpfPacket(t, protoUDP, "2001:db8::1", "2001:db8::53", 40000, 53), true},
+		"v6 tcp response":   {bpfPacket(t, protoTCP, "2001:db8::53", "2001:db8::1", 53, 40000), true},
+		"v4 first fragment": {first, true},
+		"v4 ip options":     {opts, true},
+		"v4 other port":     {bpfPacket(t, protoUDP, "10.0.0.1", "8.8.8.8", 40000, 9999), false},
+		"v6 other port":     {bpfPacket(t, protoTCP, "2001:db8::1", "2001:db8::53", 40000, 443), false},
+		"v4 later fragment": {frag, false},
+		"v4 icmp":           {icmp, false},
+		"v6 extension":      {hop, false},
+		"v4 header only":    {plain[:20], false},
+		"not ip":            {[]byte{0x00, 0x01, 0x08, 0x00}, false},
+		"v4 port 40053":     {bpfPacket(t, protoUDP, "10.0.0.53", "8.8.8.53", 40000, 40053), false},
+	} {
+		got := bpfRun(t, insn, c.pkt)
+		if (got != 0) != c.accept {
+			t.Fatalf("%s got ret %d want accept %v", name, got, c.accept)
+		}
+
+		if c.accept && got != bpfAccept {
+			t.Fatalf("%s got snap length %d", name, got)
+		}
+	}
+
+	if _, err = portFilter(nil); err == nil {
+		t.Fatal("empty ports compiled")
+	}
+}
+
+func TestBpfAsmRange(t *testing.T) {
+	a := newBpfAsm()
+	a.jmp(bpfJeq, 1, "far", "")
+	for i := 0; i < 300; i++ {
+		a.op(bpfRsh, 0)
+	}
+	a.mark("far")
+	a.op(bpfRet, 0)
+	if _, err := a.assemble(); err == nil {
+		t.Fatal("jump out of range assembled")
+	}
+
+	a = newBpfAsm()
+	a.jmp(bpfJeq, 1, "missing", "")
+	if _, err := a.assemble(); err == nil {
+		t.Fatal("missing label assembled")
+	}
+}
+
+func TestParseBpf(t *testing.T) {
+	//tcpdump -ddd udp port 53 的输出 换行 逗号和分号都可以分隔
+	for _, text := range []string{
+		"3\n48 0 0 0\n21 0 1 53\n6 0 0 262144\n",
+		"3,48 0 0 0,21 0 1 53,6 0 0 262144",
+		"3;48 0 0 0;21 0 1 0x35;6 0 0 262144\r\n",
+	} {
+		insn, err := parseBpf(text)
+		if err != nil {
+			t.Fatalf("%q %v", text, err)
+		}
+
+		if len(insn) != 3 || insn[1] != (bpfInsn{code: 21, jt: 0, jf: 1, k: 53}) || insn[2].k != 262144 {
+			t.Fatalf("%q got %v", text, insn)
+		}
+	}
+
+	for _, text := range []string{
+		"",
+		"x\n6 0 0 0",
+		"2\n6 0 0 0",
+		"1\n6 0 0",
+		"1\n6 0 0 -1",
+		"1\n6 0 0 0x100000000",
+		"1\n6 0 zero 0",
+	} {
+		if _, err := parseBpf(text); err == nil {
+			t.Fatalf("%q accepted", text)
+		}
+	}
+}
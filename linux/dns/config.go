@@ -6,20 +6,103 @@ import (
 	"github.com/rock-go/rock/lua"
 	"github.com/rock-go/rock/pipe"
 	"github.com/rock-go/rock/region"
+	"os"
+)
+
+const (
+	ringBlockSize = 1 << 20
+	ringBlockNum  = 32
 )
 
 //udp://0.0.0.0/?port=53,5353
+//tcp://0.0.0.0/?port=53
+//pcap:///tmp/dns.pcap?port=53
+//afpacket://eth0/?port=53
+//linux.dnstap unix:///run/dnstap.sock tcp://0.0.0.0/?port=6000
 type config struct {
 	name   string
 	region *region.Region
 	bind   auxlib.URL
 	pipe   []pipe.Pipe
 	co     *lua.LState
+
+	//pcap_writer dnstap_writer 在关联之前写入 每个报文都会写入
+	sink []txWriter
+
+	//dnstap 输入 bind 是 Frame Streams 的监听地址
+	dnstap bool
+
+	correlate        bool
+	correlateTimeout int
+	correlateMax     int
+
+	//pcap 回放
+	speed float64
+	loop  bool
+
+	//afpacket 抓包
+	promisc   bool
+	blockSize int
+	blockNum  int
+
+	//自定义的bpf指令 为空时按照端口生成
+	bpf []bpfInsn
+
+	//ip信息 支持ipv6
+	mmdb     []string
+	geoCache int
+
+	//处理协程数量和每个协程的队列长度
+	worker int
+	queue  int
+
+	//进程关联
+	process    bool
+	procfs     string
+	processTTL int
+
+	//名单 file://路径 文件变化后自动加载
+	deny       []string
+	allow      []string
+	listReload int
+
+	//加入mDNS LLMNR组播组 端口自动加上 5353 5355 137
+	multicast bool
+
+	//检测模块 为空时不开启
+	tunnel *tunnelConfig
+	dga    *dgaConfig
+	poison *poisonConfig
+	rebind *rebindConfig
+	flux   *fluxConfig
+	spoof  *spoofConfig
+	prof   *profileConfig
+	homo   *homographConfig
+
+	//汇总输出
+	summary *summaryConfig
+
+	//被动dns和新出现的域名
+	pdns *pdnsConfig
+	nod  *nodConfig
 }
 
 func newConfig(L *lua.LState) *config {
 	val := L.Get(1)
-	cfg := &config{co: xEnv.Clone(L)}
+	cfg := &config{
+		co:               xEnv.Clone(L),
+		correlateTimeout: 5,
+		correlateMax:     65535,
+		speed:            1,
+		blockSize:        ringBlockSize,
+		blockNum:         ringBlockNum,
+		geoCache:         4096,
+		worker:           1,
+		queue:            4096,
+		procfs:           "/proc",
+		processTTL:       2,
+		listReload:       5,
+	}
 
 	switch val.Type() {
 	case lua.LTString:
@@ -36,6 +119,99 @@ func newConfig(L *lua.LState) *config {
 
 			case "region":
 				cfg.region = region.CheckRegionSdk(L, val)
+
+			case "correlate":
+				cfg.correlate = lua.CheckBool(L, val)
+
+			case "correlate_timeout":
+				cfg.correlateTimeout = checkInt(L, key, val)
+
+			case "correlate_max":
+				cfg.correlateMax = checkInt(L, key, val)
+
+			case "speed":
+				cfg.speed = float64(checkNumber(L, key, val))
+
+			case "loop":
+				cfg.loop = lua.CheckBool(L, val)
+
+			case "promisc":
+				cfg.promisc = lua.CheckBool(L, val)
+
+			case "block_size":
+				cfg.blockSize = checkInt(L, key, val)
+
+			case "block_num":
+				cfg.blockNum = checkInt(L, key, val)
+
+			case "bpf":
+				cfg.bpf = checkBpf(L, val)
+
+			case "mmdb":
+				cfg.mmdb = checkStrings(L, key, val)
+
+			case "geo_cache":
+				cfg.geoCache = checkInt(L, key, val)
+
+			case "worker":
+				cfg.worker = checkInt(L, key, val)
+
+			case "queue":
+				cfg.queue = checkInt(L, key, val)
+
+			case "process":
+				cfg.process = lua.CheckBool(L, val)
+
+			case "procfs":
+				cfg.procfs = val.String()
+
+			case "process_ttl":
+				cfg.processTTL = checkInt(L, key, val)
+
+			case "deny":
+				cfg.deny = checkStrings(L, key, val)
+
+			case "allow":
+				cfg.allow = checkStrings(L, key, val)
+
+			case "list_reload":
+				cfg.listReload = checkInt(L, key, val)
+
+			case "multicast":
+				cfg.multicast = lua.CheckBool(L, val)
+
+			case "poison":
+				cfg.poison = newPoisonConfig(L, val)
+
+			case "tunnel":
+				cfg.tunnel = newTunnelConfig(L, val)
+
+			case "rebinding":
+				cfg.rebind = newRebindConfig(L, val)
+
+			case "fast_flux":
+				cfg.flux = newFluxConfig(L, val)
+
+			case "spoof":
+				cfg.spoof = newSpoofConfig(L, val)
+
+			case "profile":
+				cfg.prof = newProfileConfig(L, val)
+
+			case "homograph":
+				cfg.homo = newHomographConfig(L, val)
+
+			case "summary":
+				cfg.summary = newSummaryConfig(L, val)
+
+			case "dga":
+				cfg.dga = newDgaConfig(L, val)
+
+			case "pdns":
+				cfg.pdns = newPdnsConfig(L, val)
+
+			case "nod":
+				cfg.nod = newNodConfig(L, val)
 			}
 		})
 
@@ -46,12 +222,45 @@ func newConfig(L *lua.LState) *config {
 	return cfg
 }
 
+func checkNumber(L *lua.LState, key string, val lua.LValue) lua.LNumber {
+	n, ok := val.(lua.LNumber)
+	if !ok {
+		L.RaiseError("%s must be number , got %s", key, val.Type().String())
+		return 0
+	}
+
+	return n
+}
+
+func checkInt(L *lua.LState, key string, val lua.LValue) int {
+	return int(checkNumber(L, key, val))
+}
+
+func checkStrings(L *lua.LState, key string, val lua.LValue) []string {
+	switch val.Type() {
+	case lua.LTString:
+		return []string{val.String()}
+
+	case lua.LTTable:
+		return auxlib.LTab2SS(val.(*lua.LTable))
+
+	default:
+		L.RaiseError("%s must be string or table , got %s", key, val.Type().String())
+		return nil
+	}
+}
+
 func (cfg *config) net() string {
+	proto := "udp"
+	if cfg.bind.Scheme() == "tcp" {
+		proto = "tcp"
+	}
+
 	if cfg.bind.V6() {
-		return "ip6:udp"
+		return "ip6:" + proto
 	}
 
-	return "ip4:udp"
+	return "ip4:" + proto
 }
 
 func (cfg *config) valid() error {
@@ -63,19 +272,164 @@ func (cfg *config) valid() error {
 		return fmt.Errorf("not found bind")
 	}
 
-	if !cfg.bind.V4() && !cfg.bind.V6() {
-		return fmt.Errorf("not found hostname must ipv4 or ipv6")
+	if cfg.dnstap {
+		return cfg.validTap()
+	}
+
+	switch cfg.bind.Scheme() {
+	case "pcap":
+		if cfg.bind.Path() == "" {
+			return fmt.Errorf("not found pcap file path")
+		}
+
+	case "afpacket":
+		if cfg.bind.Hostname() == "" {
+			return fmt.Errorf("not found afpacket interface")
+		}
+
+		if cfg.blockSize <= 0 || cfg.blockSize%os.Getpagesize() != 0 || cfg.blockNum <= 0 {
+			return fmt.Errorf("invalid afpacket block_size or block_num")
+		}
+
+	case "udp", "tcp":
+		if !cfg.bind.V4() && !cfg.bind.V6() {
+			return fmt.Errorf("not found hostname must ipv4 or ipv6")
+		}
+
+	default:
+		return fmt.Errorf("not found listen %s", cfg.bind.Scheme())
 	}
 
-	if cfg.bind.Port() == 0 && len(cfg.bind.Ports()) == 0 {
+	if cfg.bind.Port() == 0 && len(cfg.bind.Ports()) == 0 && !cfg.multicast {
 		return fmt.Errorf("not found listen port")
 	}
 
+	return cfg.validCommon()
+}
+
+func (cfg *config) validTap() error {
 	switch cfg.bind.Scheme() {
-	case "udp", "tcp":
-		//todo
+	case "unix":
+		if cfg.bind.Path() == "" {
+			return fmt.Errorf("not found dnstap unix socket path")
+		}
+
+	case "tcp":
+		if cfg.bind.Port() == 0 {
+			return fmt.Errorf("not found dnstap listen port")
+		}
+
 	default:
-		return fmt.Errorf("not found listen %s", cfg.bind.Scheme())
+		return fmt.Errorf("dnstap not support listen %s", cfg.bind.Scheme())
+	}
+
+	return cfg.validCommon()
+}
+
+//bidirectional 原始socket只能收到发给本机的报文 应答的客户端地址未知
+func (cfg *config) bidirectional() bool {
+	if cfg.dnstap {
+		return true
+	}
+
+	switch cfg.bind.Scheme() {
+	case "afpacket", "pcap":
+		return true
+	default:
+		return false
+	}
+}
+
+//validCommon 和输入方式无关的配置
+func (cfg *config) validCommon() error {
+	if cfg.correlate && !cfg.bidirectional() {
+		return fmt.Errorf("correlate only support afpacket pcap or dnstap")
+	}
+
+	if cfg.spoof != nil && !cfg.bidirectional() {
+		return fmt.Errorf("spoof only support afpacket pcap or dnstap")
+	}
+
+	if cfg.correlate && (cfg.correlateTimeout <= 0 || cfg.correlateMax <= 0) {
+		return fmt.Errorf("invalid correlate timeout or max")
+	}
+
+	if cfg.geoCache <= 0 {
+		return fmt.Errorf("invalid geo_cache %d", cfg.geoCache)
+	}
+
+	if cfg.worker <= 0 || cfg.queue <= 0 {
+		return fmt.Errorf("invalid worker %d or queue %d", cfg.worker, cfg.queue)
+	}
+
+	if len(cfg.deny)+len(cfg.allow) > 0 && cfg.listReload <= 0 {
+		return fmt.Errorf("invalid list_reload %d", cfg.listReload)
+	}
+
+	if cfg.tunnel != nil {
+		if e := cfg.tunnel.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.dga != nil {
+		if e := cfg.dga.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.poison != nil {
+		if e := cfg.poison.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.rebind != nil {
+		if e := cfg.rebind.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.flux != nil {
+		if e := cfg.flux.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.spoof != nil {
+		if e := cfg.spoof.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.prof != nil {
+		if e := cfg.prof.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.homo != nil {
+		if e := cfg.homo.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.summary != nil {
+		if e := cfg.summary.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.pdns != nil {
+		if e := cfg.pdns.valid(); e != nil {
+			return e
+		}
+	}
+
+	if cfg.nod != nil {
+		if e := cfg.nod.valid(); e != nil {
+			return e
+		}
 	}
 
 	return nil
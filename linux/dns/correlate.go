@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//关联表 query 和 response 按照 client,client port,server port,dns_id,qname 配对
+type correlator struct {
+	mu      sync.Mutex
+	max     int
+	timeout time.Duration
+	table   map[string]*list.Element
+	queue   *list.List
+}
+
+type pending struct {
+	key string
+	tx  *Tx
+}
+
+func newCorrelator(max int, timeout time.Duration) *correlator {
+	return &correlator{
+		max:     max,
+		timeout: timeout,
+		table:   make(map[string]*list.Element, max),
+		queue:   list.New(),
+	}
+}
+
+func pairKey(client string, cport, sport uint16, tx *Tx) string {
+	var qname string
+	if len(tx.msg.Question) > 0 {
+		qname = strings.ToLower(tx.msg.Question[0].Name)
+	}
+
+	return client + "|" + strconv.Itoa(int(cport)) + "|" + strconv.Itoa(int(sport)) +
+		"|" + strconv.Itoa(int(tx.msg.Id)) + "|" + qname
+}
+
+//query 来源是客户端 response 的目的地址是客户端
+func (c *correlator) key(tx *Tx) string {
+	if tx.msg.Response {
+		return pairKey(tx.Client(), tx.dst, tx.src, tx)
+	}
+
+	return pairKey(tx.Client(), tx.src, tx.dst, tx)
+}
+
+//query 保存等待应答 表满了淘汰最老的记录
+func (c *correlator) query(tx *Tx) {
+	key := c.key(tx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.table[key]; ok {
+		c.queue.Remove(elem)
+	}
+
+	if c.queue.Len() >= c.max {
+		front := c.queue.Front()
+		c.queue.Remove(front)
+		delete(c.table, front.Value.(*pending).key)
+	}
+
+	c.table[key] = c.queue.PushBack(&pending{key: key, tx: tx})
+}
+
+//answer 查找对应的query 命中后把时延写入response
+func (c *correlator) answer(tx *Tx) bool {
+	key := c.key(tx)
+
+	c.mu.Lock()
+	elem, ok := c.table[key]
+	if ok {
+		c.queue.Remove(elem)
+		delete(c.table, key)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	q := elem.Value.(*pending).tx
+	tx.paired = true
+	tx.rtt = tx.time.Sub(q.time)
+	return true
+}
+
+//expire 返回超时未应答的query
+func (c *correlator) expire(now time.Time) []*Tx {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var txs []*Tx
+	for {
+		front := c.queue.Front()
+		if front == nil {
+			break
+		}
+
+		p := front.Value.(*pending)
+		if now.Sub(p.tx.time) < c.timeout {
+			break
+		}
+
+		c.queue.Remove(front)
+		delete(c.table, p.key)
+		p.tx.timeout = true
+		txs = append(txs, p.tx)
+	}
+
+	return txs
+}
@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+var corEpoch = time.Unix(1700000000, 0)
+
+func corQ(client, name string, id, cport uint16, at time.Duration) *Tx {
+	tx := &Tx{addr: &net.IPAddr{IP: net.ParseIP(client)}, daddr: net.ParseIP("192.0.2.53"), src: cport, dst: 53, time: corEpoch.Add(at)}
+	tx.msg.SetQuestion(name, dns.TypeA)
+	tx.msg.Id = id
+	return tx
+}
+
+func corR(client, name string, id, cport uint16, at time.Duration) *Tx {
+	tx := &Tx{addr: &net.IPAddr{IP: net.ParseIP("192.0.2.53")}, daddr: net.ParseIP(client), src: 53, dst: cport, time: corEpoch.Add(at)}
+	tx.msg.SetQuestion(name, dns.TypeA)
+	tx.msg.Id = id
+	tx.msg.Response = true
+	return tx
+}
+
+func TestCorrelatePair(t *testing.T) {
+	c := newCorrelator(16, time.Second)
+	c.query(corQ("10.0.0.1", "A.example.com.", 7, 5000, 0))
+
+	//客户端 端口 dns_id qname任何一个不同都不配对 qname不区分大小写
+	for _, r := range []*Tx{
+		corR("10.0.0.2", "a.example.com.", 7, 5000, 0),
+		corR("10.0.0.1", "a.example.com.", 7, 5001, 0),
+		corR("10.0.0.1", "a.example.com.", 8, 5000, 0),
+		corR("10.0.0.1", "b.example.com.", 7, 5000, 0),
+	} {
+		if c.answer(r) || r.paired {
+			t.Fatalf("%s %s:%d id %d paired", r.Qname(), r.Client(), r.dst, r.msg.Id)
+		}
+	}
+
+	r := corR("10.0.0.1", "a.example.com.", 7, 5000, 20*time.Millisecond)
+	if !c.answer(r) || !r.paired || r.rtt != 20*time.Millisecond {
+		t.Fatalf("got paired %v rtt %v", r.paired, r.rtt)
+	}
+
+	//重复的应答不再配对
+	if c.answer(corR("10.0.0.1", "a.example.com.", 7, 5000, 30*time.Millisecond)) {
+		t.Fatal("duplicate response paired")
+	}
+
+	if len(c.table) != 0 || c.queue.Len() != 0 {
+		t.Fatalf("got %d pending", c.queue.Len())
+	}
+}
+
+func TestCorrelateTimeout(t *testing.T) {
+	c := newCorrelator(16, time.Second)
+	q1 := corQ("10.0.0.1", "a.example.com.", 1, 5000, 0)
+	q2 := corQ("10.0.0.1", "b.example.com.", 2, 5000, 500*time.Millisecond)
+	c.query(q1)
+	c.query(q2)
+
+	if txs := c.expire(corEpoch.Add(999 * time.Millisecond)); len(txs) != 0 {
+		t.Fatalf("got %d expired before timeout", len(txs))
+	}
+
+	txs := c.expire(corEpoch.Add(time.Second))
+	if len(txs) != 1 || txs[0] != q1 || !q1.timeout || q2.timeout {
+		t.Fatalf("got %d expired", len(txs))
+	}
+
+	//超时之后到达的应答不配对
+	if c.answer(corR("10.0.0.1", "a.example.com.", 1, 5000, 1100*time.Millisecond)) {
+		t.Fatal("response paired after timeout")
+	}
+
+	if !c.answer(corR("10.0.0.1", "b.example.com.", 2, 5000, 1100*time.Millisecond)) {
+		t.Fatal("response not paired")
+	}
+}
+
+func TestCorrelateEvict(t *testing.T) {
+	c := newCorrelator(2, time.Second)
+	c.query(corQ("10.0.0.1", "a.example.com.", 1, 5000, 0))
+	c.query(corQ("10.0.0.1", "b.example.com.", 2, 5000, 0))
+
+	//重传的query替换原来的记录 不占用新的位置
+	retry := corQ("10.0.0.1", "b.example.com.", 2, 5000, 100*time.Millisecond)
+	c.query(retry)
+	if c.queue.Len() != 2 {
+		t.Fatalf("got %d pending after retransmit", c.queue.Len())
+	}
+
+	//表满后淘汰最老的query
+	c.query(corQ("10.0.0.1", "c.example.com.", 3, 5000, 200*time.Millisecond))
+	if c.answer(corR("10.0.0.1", "a.example.com.", 1, 5000, 300*time.Millisecond)) {
+		t.Fatal("evicted query paired")
+	}
+
+	r := corR("10.0.0.1", "b.example.com.", 2, 5000, 300*time.Millisecond)
+	if !c.answer(r) || r.rtt != 200*time.Millisecond {
+		t.Fatalf("got paired %v rtt %v", r.paired, r.rtt)
+	}
+
+	if !c.answer(corR("10.0.0.1", "c.example.com.", 3, 5000, 300*time.Millisecond)) {
+		t.Fatal("newest query not paired")
+	}
+}
@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+
+	etherIPv4 = 0x0800
+	etherIPv6 = 0x86DD
+	etherVLAN = 0x8100
+	etherQinQ = 0x88A8
+)
+
+var errSkip = errors.New("skip")
+
+//frame 传输层的数据 addr 是来源地址 daddr 是目的地址(raw socket下未知)
+type frame struct {
+	addr  net.Addr
+	daddr net.IP
+	proto uint8
+	ts    time.Time
+	data  []byte
+
+	//抓包时完整的ip报文 data是它的后缀 只在读取协程内有效
+	pkt []byte
+}
+
+//decodeLink 按链路层类型解析出传输层数据
+func decodeLink(link int, b []byte) (*frame, error) {
+	switch link {
+	case linkEthernet:
+		return decodeEthernet(b)
+
+	case linkRaw, 12, 14, linkIPv4, linkIPv6:
+		return decodeIP(b)
+
+	case linkSLL:
+		if len(b) < 16 {
+			return nil, errSkip
+		}
+		return decodeEtherType(binary.BigEndian.Uint16(b[14:16]), b[16:])
+
+	case linkSLL2:
+		if len(b) < 20 {
+			return nil, errSkip
+		}
+		return decodeEtherType(binary.BigEndian.Uint16(b[0:2]), b[20:])
+
+	case linkNull:
+		if len(b) < 4 {
+			return nil, errSkip
+		}
+		return decodeIP(b[4:])
+
+	default:
+		return nil, errSkip
+	}
+}
+
+func decodeEthernet(b []byte) (*frame, error) {
+	if len(b) < 14 {
+		return nil, errSkip
+	}
+
+	typ := binary.BigEndian.Uint16(b[12:14])
+	b = b[14:]
+
+	for typ == etherVLAN || typ == etherQinQ {
+		if len(b) < 4 {
+			return nil, errSkip
+		}
+		typ = binary.BigEndian.Uint16(b[2:4])
+		b = b[4:]
+	}
+
+	return decodeEtherType(typ, b)
+}
+
+func decodeEtherType(typ uint16, b []byte) (*frame, error) {
+	switch typ {
+	case etherIPv4, etherIPv6:
+		return decodeIP(b)
+	default:
+		return nil, errSkip
+	}
+}
+
+func decodeIP(b []byte) (*frame, error) {
+	if len(b) < 1 {
+		return nil, errSkip
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		return decodeIPv4(b)
+	case 6:
+		return decodeIPv6(b)
+	default:
+		return nil, errSkip
+	}
+}
+
+func decodeIPv4(b []byte) (*frame, error) {
+	if len(b) < 20 {
+		return nil, errSkip
+	}
+
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	//网卡offload时total可能为0
+	if total == 0 || total > len(b) {
+		total = len(b)
+	}
+
+	if ihl < 20 || total < ihl {
+		return nil, errSkip
+	}
+
+	//分片只处理第一片
+	if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+		return nil, errSkip
+	}
+
+	return &frame{
+		addr:  &net.IPAddr{IP: net.IP(append([]byte(nil), b[12:16]...))},
+		daddr: net.IP(append([]byte(nil), b[16:20]...)),
+		proto: b[9],
+		data:  b[ihl:total],
+		pkt:   b[:total],
+	}, nil
+}
+
+func decodeIPv6(b []byte) (*frame, error) {
+	if len(b) < 40 {
+		return nil, errSkip
+	}
+
+	next := b[6]
+	end := 40 + int(binary.BigEndian.Uint16(b[4:6]))
+	if end > len(b) {
+		end = len(b)
+	}
+
+	f := &frame{
+		addr:  &net.IPAddr{IP: net.IP(append([]byte(nil), b[8:24]...))},
+		daddr: net.IP(append([]byte(nil), b[24:40]...)),
+	}
+
+	offset := 40
+	for {
+		switch next {
+		case 0, 43, 60:
+			if offset+8 > end {
+				return nil, errSkip
+			}
+			next = b[offset]
+			offset += (int(b[offset+1]) + 1) * 8
+
+		case 44:
+			if offset+8 > end {
+				return nil, errSkip
+			}
+			if binary.BigEndian.Uint16(b[offset+2:offset+4])&0xfff8 != 0 {
+				return nil, errSkip
+			}
+			next = b[offset]
+			offset += 8
+
+		default:
+			if offset > end {
+				return nil, errSkip
+			}
+			f.proto = next
+			f.data = b[offset:end]
+			f.pkt = b[:end]
+			return f, nil
+		}
+	}
+}
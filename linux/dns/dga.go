@@ -0,0 +1,293 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/lua"
+	"golang.org/x/net/publicsuffix"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+//bigram 英文和常见域名单词的字母二元组频率 按log10分成0-9级 0表示没有出现过
+//行是前一个字母 列是后一个字母 a-z
+const bigram = "" +
+	"57774674737878573878765675" +
+	"75447342652844640654753262" +
+	"74657438637764852768734152" +
+	"64578533854655842676644452" +
+	"76887765634788575898476863" +
+	"73457743802645830657734351" +
+	"64447457732646643665754324" +
+	"83349332723654742656513142" +
+	"76776774536889875788463646" +
+	"51245120423121531141612010" +
+	"63347543623445541464534141" +
+	"75479544823845862577855372" +
+	"86568443714575771564643254" +
+	"74788684735656851578764363" +
+	"67776765646888671878877444" +
+	"84457435722753771867645361" +
+	"32111411211403114221611100" +
+	"75868564716777852777756372" +
+	"74748457725656874878745363" +
+	"85879549835654864777746673" +
+	"66666765724778571788232443" +
+	"73427232811353520245323131" +
+	"73346437803446743663324211" +
+	"63546413601343362347333532" +
+	"54436342513556760466535433" +
+	"51236324522222522342422244"
+
+func bigramLevel(a, b byte) int {
+	return int(bigram[int(a-'a')*26+int(b-'a')] - '0')
+}
+
+//dgaLabel 取注册域名中去掉public suffix的部分 如 a.xkqzjw.co.uk -> xkqzjw
+func dgaLabel(name string) string {
+	parent := parentDomain(name)
+	if parent == "" {
+		return ""
+	}
+
+	suffix, _ := publicsuffix.PublicSuffix(parent)
+	if suffix == "" || len(suffix) >= len(parent) {
+		return parent
+	}
+
+	return strings.TrimSuffix(parent[:len(parent)-len(suffix)], ".")
+}
+
+//dgaScore 注册域名的随机性打分 0-1 同时返回命中的特征
+func dgaScore(name string) (float64, []string) {
+	label := dgaLabel(name)
+	if label == "" {
+		return 0, nil
+	}
+
+	var letters, vowels, digits, pairs, level int
+	var digitRun, maxDigitRun, consRun, maxConsRun int
+	var prev byte
+
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+
+		switch {
+		case c >= 'a' && c <= 'z':
+			letters++
+			digitRun = 0
+
+			switch c {
+			case 'a', 'e', 'i', 'o', 'u', 'y':
+				vowels++
+				consRun = 0
+			default:
+				consRun++
+				if consRun > maxConsRun {
+					maxConsRun = consRun
+				}
+			}
+
+			if prev >= 'a' && prev <= 'z' {
+				pairs++
+				level += bigramLevel(prev, c)
+			}
+
+		case c >= '0' && c <= '9':
+			digits++
+			consRun = 0
+			digitRun++
+			if digitRun > maxDigitRun {
+				maxDigitRun = digitRun
+			}
+
+		default:
+			consRun = 0
+			digitRun = 0
+		}
+
+		prev = c
+	}
+
+	//太短的名字看不出随机性
+	if len(label) < 6 {
+		return 0, nil
+	}
+
+	var reason []string
+	var score float64
+
+	//常见二元组的平均等级 英文单词一般在6以上
+	if pairs > 0 {
+		avg := float64(level) / float64(pairs)
+		v := clamp((6.5 - avg) / 3)
+		score += 0.4 * v
+		if v >= 0.5 {
+			reason = append(reason, "bigram")
+		}
+	} else {
+		score += 0.4
+		reason = append(reason, "bigram")
+	}
+
+	if letters > 0 {
+		ratio := float64(vowels) / float64(letters)
+		v := clamp(math.Abs(ratio-0.4) / 0.3)
+		score += 0.15 * v
+		if v >= 0.6 {
+			reason = append(reason, "vowel_ratio")
+		}
+	}
+
+	if maxConsRun >= 4 {
+		score += 0.15 * clamp(float64(maxConsRun-3)/3)
+		reason = append(reason, "consonant_run")
+	}
+
+	if digits > 0 && letters > 0 {
+		v := clamp(float64(maxDigitRun)/4 + float64(digits)/float64(len(label)))
+		score += 0.15 * v
+		if maxDigitRun >= 3 || v >= 0.5 {
+			reason = append(reason, "digit")
+		}
+	}
+
+	if len(label) >= 12 {
+		score += 0.15 * clamp(float64(len(label)-11)/13)
+		reason = append(reason, "length")
+	}
+
+	return clamp(score), reason
+}
+
+//dgaConfig nxdomain 比例高并且dga打分高的客户端告警
+type dgaConfig struct {
+	window   int     //统计窗口 秒
+	score    float64 //高分阈值
+	nxdomain int     //窗口内高分nxdomain数量
+	clients  int     //同时跟踪的客户端上限
+}
+
+func newDgaConfig(L *lua.LState, val lua.LValue) *dgaConfig {
+	cfg := &dgaConfig{window: 60, score: 0.5, nxdomain: 20, clients: 65536}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "window":
+				cfg.window = checkInt(L, key, v)
+			case "score":
+				cfg.score = float64(checkNumber(L, key, v))
+			case "nxdomain":
+				cfg.nxdomain = checkInt(L, key, v)
+			case "clients":
+				cfg.clients = checkInt(L, key, v)
+			default:
+				L.RaiseError("dga config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("dga must be bool or table , got %s", val.Type().String())
+	}
+
+	return cfg
+}
+
+func (cfg *dgaConfig) valid() error {
+	if cfg.window <= 0 || cfg.nxdomain <= 0 || cfg.clients <= 0 {
+		return fmt.Errorf("invalid dga config")
+	}
+
+	if cfg.score <= 0 || cfg.score > 1 {
+		return fmt.Errorf("invalid dga score %v must in (0,1]", cfg.score)
+	}
+
+	return nil
+}
+
+type dgaStat struct {
+	nxdomain int
+	domains  []string
+	alerted  bool
+}
+
+//dga 固定窗口内按客户端统计高分的nxdomain应答
+type dga struct {
+	mu     sync.Mutex
+	cfg    *dgaConfig
+	begin  time.Time
+	client map[string]*dgaStat
+}
+
+func newDga(cfg *dgaConfig) *dga {
+	return &dga{cfg: cfg, client: make(map[string]*dgaStat)}
+}
+
+func (d *dga) inspect(m *monitor, tx *Tx) *Event {
+	score, _ := tx.dga()
+	if !tx.msg.Response || tx.msg.Rcode != dns.RcodeNameError || score < d.cfg.score {
+		return nil
+	}
+
+	client := tx.Client()
+	if client == "" {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if tx.time.Sub(d.begin) >= time.Duration(d.cfg.window)*time.Second {
+		d.begin = tx.time
+		d.client = make(map[string]*dgaStat)
+	}
+
+	st, ok := d.client[client]
+	if !ok {
+		if len(d.client) >= d.cfg.clients {
+			return nil
+		}
+		st = &dgaStat{}
+		d.client[client] = st
+	}
+
+	st.nxdomain++
+	if len(st.domains) < 10 {
+		st.domains = append(st.domains, normalize(tx.Qname()))
+	}
+
+	if st.alerted || st.nxdomain < d.cfg.nxdomain {
+		return nil
+	}
+
+	st.alerted = true
+	return newEvent(m.Name(), "dga", tx.time).
+		Set("client", client).
+		Set("nxdomain", st.nxdomain).
+		Set("sample", append([]string(nil), st.domains...)).
+		Set("score", d.cfg.score).
+		Set("window", d.cfg.window)
+}
+
+//dgaL linux.dns.dga("name") 返回打分和特征
+func dgaL(L *lua.LState) int {
+	score, reason := dgaScore(L.CheckString(1))
+
+	tab := L.CreateTable(len(reason), 0)
+	for _, r := range reason {
+		tab.Append(lua.S2L(r))
+	}
+
+	L.Push(lua.LNumber(score))
+	L.Push(tab)
+	return 2
+}
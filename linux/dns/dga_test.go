@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+//dgaBenign 常见的正常域名 包括缩写 数字和长单词
+var dgaBenign = []string{
+	"www.google.com", "facebook.com", "github.com", "baidu.com", "taobao.com", "qq.com", "netflix.com",
+	"stackoverflow.com", "wikipedia.org", "linkedin.com", "office365.com", "yahoo.co.jp", "weibo.cn",
+	"mozilla.org", "ubuntu.com", "s3.amazonaws.com", "login.microsoftonline.com", "cdn.jsdelivr.net",
+	"akamaiedge.net", "cloudflare-dns.com", "googleusercontent.com", "sub.teamviewer.com", "bilibili.com",
+}
+
+//dgaSample 随机字符的dga域名 如cryptolocker necurs的输出
+var dgaSample = []string{
+	"kqlxtqptsmys.ru", "yxcbpfbcsdbf.com", "gfkbuvdwhrmc.net", "ptyxnfqrcbws.org", "xjvkwdqhmlrz.biz",
+	"vcxzqwrtplkj.info", "dfghjkwrtypz.com", "q8w7e6r5t4y3.net", "nxbvqzkdprt.com", "hjqwpxzrtvbn.ru",
+	"xkqzjwpvbr.com", "a8f3k2j9d0s1.info", "lkjhgfdsaqwe.co.uk", "mxnbvcxzlkjh.ru", "1x2c3v4b5n6m.biz",
+	"kdjfhgybnreuvk.org", "zz9182736455.com",
+}
+
+func TestBigram(t *testing.T) {
+	if len(bigram) != 26*26 {
+		t.Fatalf("bigram got %d levels", len(bigram))
+	}
+
+	for i := 0; i < len(bigram); i++ {
+		if bigram[i] < '0' || bigram[i] > '9' {
+			t.Fatalf("bigram %d got %c", i, bigram[i])
+		}
+	}
+
+	//英文中常见的组合等级高
+	for _, pair := range []string{"th", "he", "in", "er", "an"} {
+		if v := bigramLevel(pair[0], pair[1]); v < 7 {
+			t.Fatalf("%s got level %d", pair, v)
+		}
+	}
+
+	for _, pair := range []string{"qz", "jx", "zq", "vq"} {
+		if v := bigramLevel(pair[0], pair[1]); v > 2 {
+			t.Fatalf("%s got level %d", pair, v)
+		}
+	}
+}
+
+func TestDgaScore(t *testing.T) {
+	//默认阈值
+	score := 0.5
+
+	for _, name := range dgaBenign {
+		if v, reason := dgaScore(name); v >= score-0.2 {
+			t.Fatalf("benign %s got %.3f %v", name, v, reason)
+		}
+	}
+
+	for _, name := range dgaSample {
+		if v, reason := dgaScore(name); v < score {
+			t.Fatalf("dga %s got %.3f %v", name, v, reason)
+		}
+	}
+
+	//太短的名字不打分
+	for _, name := range []string{"xkqzj.com", "qq.com", ""} {
+		if v, _ := dgaScore(name); v != 0 {
+			t.Fatalf("%s got %.3f", name, v)
+		}
+	}
+}
+
+func dgaTx(client, name string, rcode int, ts time.Time) *Tx {
+	tx := &Tx{time: ts, addr: &net.IPAddr{IP: net.IPv4(192, 0, 2, 53)}, daddr: net.ParseIP(client)}
+	tx.msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	tx.msg.Response = true
+	tx.msg.Rcode = rcode
+	return tx
+}
+
+func TestDgaInspect(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	d := newDga(&dgaConfig{window: 60, score: 0.5, nxdomain: 3, clients: 10})
+	t0 := time.Unix(1600000000, 0)
+
+	var evs []*Event
+	inspect := func(tx *Tx) {
+		if ev := d.inspect(m, tx); ev != nil {
+			evs = append(evs, ev)
+		}
+	}
+
+	//正常域名的nxdomain 和dga域名的成功应答不计数
+	for i := 0; i < 5; i++ {
+		inspect(dgaTx("192.0.2.1", dgaBenign[i], dns.RcodeNameError, t0))
+		inspect(dgaTx("192.0.2.1", dgaSample[i], dns.RcodeSuccess, t0))
+	}
+
+	if len(evs) != 0 {
+		t.Fatalf("got %d events", len(evs))
+	}
+
+	//第3个高分nxdomain告警 之后同一个窗口不再告警
+	for i := 0; i < 5; i++ {
+		inspect(dgaTx("192.0.2.1", dgaSample[i], dns.RcodeNameError, t0.Add(time.Duration(i)*time.Second)))
+		inspect(dgaTx("192.0.2.2", dgaSample[i], dns.RcodeNameError, t0))
+	}
+
+	if len(evs) != 2 {
+		t.Fatalf("got %d events", len(evs))
+	}
+
+	if v, _ := evs[0].Get("client"); v != "192.0.2.1" {
+		t.Fatalf("client got %v", v)
+	}
+
+	if v, _ := evs[0].Get("nxdomain"); v != 3 {
+		t.Fatalf("nxdomain got %v", v)
+	}
+
+	if v, _ := evs[0].Get("sample"); len(v.([]string)) != 3 {
+		t.Fatalf("sample got %v", v)
+	}
+
+	//下一个窗口重新计数
+	evs = nil
+	for i := 0; i < 3; i++ {
+		inspect(dgaTx("192.0.2.1", dgaSample[i], dns.RcodeNameError, t0.Add(2*time.Minute)))
+	}
+
+	if len(evs) != 1 {
+		t.Fatalf("next window got %d events", len(evs))
+	}
+}
@@ -0,0 +1,528 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+//Frame Streams 控制帧 https://farsightsec.github.io/fstrm/
+const (
+	fstrmAccept = 0x01
+	fstrmStart  = 0x02
+	fstrmStop   = 0x03
+	fstrmReady  = 0x04
+	fstrmFinish = 0x05
+
+	fstrmContentType = 0x01
+	fstrmMaxControl  = 512
+	fstrmMaxFrame    = 1 << 20
+
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+)
+
+var dnstapType = map[uint64]string{
+	1:  "AUTH_QUERY",
+	2:  "AUTH_RESPONSE",
+	3:  "RESOLVER_QUERY",
+	4:  "RESOLVER_RESPONSE",
+	5:  "CLIENT_QUERY",
+	6:  "CLIENT_RESPONSE",
+	7:  "FORWARDER_QUERY",
+	8:  "FORWARDER_RESPONSE",
+	9:  "STUB_QUERY",
+	10: "STUB_RESPONSE",
+	11: "TOOL_QUERY",
+	12: "TOOL_RESPONSE",
+	13: "UPDATE_QUERY",
+	14: "UPDATE_RESPONSE",
+}
+
+var errFstrmStop = errors.New("fstrm stop")
+
+//tapInfo dnstap 消息自带的信息 补充到tx上
+type tapInfo struct {
+	identity string
+	version  string
+	kind     string
+}
+
+//tapMessage dnstap.Message 中用到的字段
+type tapMessage struct {
+	kind      uint64
+	family    uint64
+	protocol  uint64
+	qaddr     net.IP
+	raddr     net.IP
+	qport     uint16
+	rport     uint16
+	qsec      uint64
+	qnsec     uint32
+	rsec      uint64
+	rnsec     uint32
+	query     []byte
+	response  []byte
+	hasQuery  bool
+	hasAnswer bool
+}
+
+//pbReader 只实现dnstap需要的protobuf解码 varint bytes fixed32 fixed64
+type pbReader struct {
+	buf []byte
+}
+
+func (r *pbReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, fmt.Errorf("protobuf invalid varint")
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+//next 返回字段号 类型 和值 bytes类型的值放在data中
+func (r *pbReader) next() (field uint64, wire uint64, val uint64, data []byte, err error) {
+	key, err := r.varint()
+	if err != nil {
+		return
+	}
+
+	field, wire = key>>3, key&7
+	switch wire {
+	case 0:
+		val, err = r.varint()
+
+	case 1:
+		if len(r.buf) < 8 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		val = binary.LittleEndian.Uint64(r.buf)
+		r.buf = r.buf[8:]
+
+	case 2:
+		var n uint64
+		if n, err = r.varint(); err != nil {
+			return
+		}
+		if n > uint64(len(r.buf)) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		data = r.buf[:n]
+		r.buf = r.buf[n:]
+
+	case 5:
+		if len(r.buf) < 4 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		val = uint64(binary.LittleEndian.Uint32(r.buf))
+		r.buf = r.buf[4:]
+
+	default:
+		err = fmt.Errorf("protobuf unsupported wire type %d", wire)
+	}
+	return
+}
+
+//decodeDnstap 解析 dnstap.Dnstap 只处理 type=MESSAGE
+func decodeDnstap(b []byte) (*tapInfo, *tapMessage, error) {
+	info := &tapInfo{}
+	var msg *tapMessage
+
+	r := &pbReader{buf: b}
+	for len(r.buf) > 0 {
+		field, _, _, data, err := r.next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch field {
+		case 1:
+			info.identity = string(data)
+		case 2:
+			info.version = string(data)
+		case 14:
+			if msg, err = decodeTapMessage(data); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if msg == nil {
+		return nil, nil, fmt.Errorf("dnstap not found message")
+	}
+
+	info.kind = dnstapType[msg.kind]
+	return info, msg, nil
+}
+
+func decodeTapMessage(b []byte) (*tapMessage, error) {
+	m := &tapMessage{}
+
+	r := &pbReader{buf: b}
+	for len(r.buf) > 0 {
+		field, _, val, data, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch field {
+		case 1:
+			m.kind = val
+		case 2:
+			m.family = val
+		case 3:
+			m.protocol = val
+		case 4:
+			m.qaddr = net.IP(append([]byte(nil), data...))
+		case 5:
+			m.raddr = net.IP(append([]byte(nil), data...))
+		case 6:
+			m.qport = uint16(val)
+		case 7:
+			m.rport = uint16(val)
+		case 8:
+			m.qsec = val
+		case 9:
+			m.qnsec = uint32(val)
+		case 10:
+			m.query = append([]byte(nil), data...)
+			m.hasQuery = true
+		case 12:
+			m.rsec = val
+		case 13:
+			m.rnsec = uint32(val)
+		case 14:
+			m.response = append([]byte(nil), data...)
+			m.hasAnswer = true
+		}
+	}
+
+	return m, nil
+}
+
+//job 把dnstap消息转换成和抓包一样的任务 response 的来源是服务端
+func (m *tapMessage) job(info *tapInfo) *job {
+	proto := uint8(protoUDP)
+	if m.protocol == 2 {
+		proto = protoTCP
+	}
+
+	//只有query时才使用query 否则按response处理
+	if m.hasAnswer {
+		ts := time.Unix(int64(m.rsec), int64(m.rnsec))
+		if m.rsec == 0 {
+			ts = time.Now()
+		}
+
+		return &job{
+			f:   frame{addr: &net.IPAddr{IP: m.raddr}, daddr: m.qaddr, proto: proto, ts: ts},
+			src: m.rport,
+			dst: m.qport,
+			raw: m.response,
+			tap: info,
+		}
+	}
+
+	if !m.hasQuery {
+		return nil
+	}
+
+	ts := time.Unix(int64(m.qsec), int64(m.qnsec))
+	if m.qsec == 0 {
+		ts = time.Now()
+	}
+
+	return &job{
+		f:   frame{addr: &net.IPAddr{IP: m.qaddr}, daddr: m.raddr, proto: proto, ts: ts},
+		src: m.qport,
+		dst: m.rport,
+		raw: m.query,
+		tap: info,
+	}
+}
+
+//fstrmControl 读取控制帧 逃逸的0长度已经读过
+func fstrmControl(r io.Reader) (uint32, []string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size < 4 || size > fstrmMaxControl {
+		return 0, nil, fmt.Errorf("fstrm invalid control frame length %d", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+
+	typ := binary.BigEndian.Uint32(buf)
+	var types []string
+	for p := buf[4:]; len(p) >= 8; {
+		field := binary.BigEndian.Uint32(p)
+		n := binary.BigEndian.Uint32(p[4:])
+		p = p[8:]
+		if uint32(len(p)) < n {
+			return 0, nil, fmt.Errorf("fstrm invalid control field length %d", n)
+		}
+
+		if field == fstrmContentType {
+			types = append(types, string(p[:n]))
+		}
+		p = p[n:]
+	}
+
+	return typ, types, nil
+}
+
+func fstrmWrite(w io.Writer, typ uint32, types ...string) error {
+	size := 4
+	for _, t := range types {
+		size += 8 + len(t)
+	}
+
+	buf := make([]byte, 8, 8+size)
+	binary.BigEndian.PutUint32(buf[4:], uint32(size))
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[8:], typ)
+
+	for _, t := range types {
+		var field [8]byte
+		binary.BigEndian.PutUint32(field[:], fstrmContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(t)))
+		buf = append(buf, field[:]...)
+		buf = append(buf, t...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func hasContentType(types []string) bool {
+	//没有带content type时按照dnstap处理
+	if len(types) == 0 {
+		return true
+	}
+
+	for _, t := range types {
+		if t == dnstapContentType {
+			return true
+		}
+	}
+	return false
+}
+
+//fstrmHandshake 双向模式 READY -> ACCEPT -> START 单向模式直接 START
+func fstrmHandshake(r io.Reader, w io.Writer) error {
+	var esc [4]byte
+	if _, err := io.ReadFull(r, esc[:]); err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint32(esc[:]) != 0 {
+		return fmt.Errorf("fstrm expect control frame")
+	}
+
+	typ, types, err := fstrmControl(r)
+	if err != nil {
+		return err
+	}
+
+	if !hasContentType(types) {
+		return fmt.Errorf("fstrm unsupported content type %v", types)
+	}
+
+	switch typ {
+	case fstrmStart:
+		return nil
+
+	case fstrmReady:
+		if err = fstrmWrite(w, fstrmAccept, dnstapContentType); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("fstrm unexpected control frame %d", typ)
+	}
+
+	if _, err = io.ReadFull(r, esc[:]); err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint32(esc[:]) != 0 {
+		return fmt.Errorf("fstrm expect start frame")
+	}
+
+	typ, _, err = fstrmControl(r)
+	if err != nil {
+		return err
+	}
+
+	if typ != fstrmStart {
+		return fmt.Errorf("fstrm expect start frame got %d", typ)
+	}
+	return nil
+}
+
+//fstrmRead 读取一个数据帧 收到STOP时回复FINISH
+func fstrmRead(r io.Reader, w io.Writer, buf []byte) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size == 0 {
+		typ, _, err := fstrmControl(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if typ == fstrmStop {
+			fstrmWrite(w, fstrmFinish)
+			return nil, errFstrmStop
+		}
+		return nil, nil
+	}
+
+	if size > fstrmMaxFrame {
+		return nil, fmt.Errorf("fstrm frame too large %d", size)
+	}
+
+	if int(size) > cap(buf) {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (m *monitor) tapAddr() (string, string) {
+	if m.cfg.bind.Scheme() == "unix" {
+		return "unix", m.cfg.bind.Path()
+	}
+	return "tcp", net.JoinHostPort(m.cfg.bind.Hostname(), strconv.Itoa(m.cfg.bind.Port()))
+}
+
+//listenTap unix socket 启动前删除残留的文件
+func (m *monitor) listenTap() error {
+	network, addr := m.tapAddr()
+	if network == "unix" {
+		os.Remove(addr)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	m.ln = ln
+	return nil
+}
+
+func (m *monitor) acceptTap(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-m.tom.Dying():
+				return
+			default:
+			}
+
+			xEnv.Errorf("%s dnstap accept fail %v", m.Name(), err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		m.tom.Go(func() error {
+			m.serveTap(conn)
+			return nil
+		})
+	}
+}
+
+func (m *monitor) serveTap(conn net.Conn) {
+	defer conn.Close()
+
+	//退出时关闭连接 结束阻塞的读取
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-m.tom.Dying():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	r := bufio.NewReaderSize(conn, 64*1024)
+	if err := fstrmHandshake(r, conn); err != nil {
+		xEnv.Errorf("%s dnstap %s handshake fail %v", m.Name(), conn.RemoteAddr(), err)
+		return
+	}
+
+	var buf []byte
+	for {
+		frame, err := fstrmRead(r, conn, buf)
+		if err != nil {
+			if err != errFstrmStop && err != io.EOF {
+				select {
+				case <-m.tom.Dying():
+				default:
+					xEnv.Errorf("%s dnstap %s read fail %v", m.Name(), conn.RemoteAddr(), err)
+				}
+			}
+			return
+		}
+
+		if frame == nil {
+			continue
+		}
+		buf = frame
+
+		info, msg, err := decodeDnstap(frame)
+		if err != nil {
+			atomic.AddUint64(&m.stats.parseFailed, 1)
+			continue
+		}
+
+		j := msg.job(info)
+		if j == nil {
+			continue
+		}
+
+		atomic.AddUint64(&m.stats.received, 1)
+		m.dispatch(j)
+	}
+}
+
+//tickTap dnstap 没有读取超时 单独定时处理关联超时
+func (m *monitor) tickTap() {
+	tk := time.NewTicker(time.Second)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-m.tom.Dying():
+			return
+		case now := <-tk.C:
+			m.tick(now)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func pbUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func pbVarint(b []byte, field int, v uint64) []byte {
+	return pbUvarint(pbUvarint(b, uint64(field<<3)), v)
+}
+
+func pbBytes(b []byte, field int, data []byte) []byte {
+	b = pbUvarint(pbUvarint(b, uint64(field<<3|2)), uint64(len(data)))
+	return append(b, data...)
+}
+
+func pbFixed32(b []byte, field int, v uint32) []byte {
+	b = pbUvarint(b, uint64(field<<3|5))
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+//tapFrame 按dnstap.proto编码 CLIENT_QUERY 或者 CLIENT_RESPONSE 客户端192.0.2.1:40000 服务端192.0.2.53:53
+func tapFrame(t *testing.T, response bool) []byte {
+	var q dns.Msg
+	q.SetQuestion("tap.example.com.", dns.TypeA)
+	query, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg []byte
+	kind := uint64(5)
+	if response {
+		kind = 6
+	}
+	msg = pbVarint(msg, 1, kind)
+	msg = pbVarint(msg, 2, 1)
+	msg = pbVarint(msg, 3, 2)
+	msg = pbBytes(msg, 4, net.IPv4(192, 0, 2, 1).To4())
+	msg = pbBytes(msg, 5, net.IPv4(192, 0, 2, 53).To4())
+	msg = pbVarint(msg, 6, 40000)
+	msg = pbVarint(msg, 7, 53)
+	msg = pbVarint(msg, 8, 1700000000)
+	msg = pbFixed32(msg, 9, 5000)
+	msg = pbBytes(msg, 10, query)
+
+	if response {
+		r := new(dns.Msg)
+		r.SetReply(&q)
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "tap.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(198, 51, 100, 7),
+		})
+
+		answer, err := r.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg = pbVarint(msg, 12, 1700000001)
+		msg = pbFixed32(msg, 13, 7000)
+		msg = pbBytes(msg, 14, answer)
+	}
+
+	var b []byte
+	b = pbBytes(b, 1, []byte("resolver1"))
+	b = pbBytes(b, 2, []byte("unbound 1.17"))
+	b = pbBytes(b, 14, msg)
+	b = pbVarint(b, 15, 1)
+	return b
+}
+
+//tapTx 和处理协程一样把job转换成tx
+func tapTx(t *testing.T, frame []byte) *Tx {
+	info, msg, err := decodeDnstap(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := msg.job(info)
+	if j == nil {
+		t.Fatal("dnstap message without job")
+	}
+
+	var dm dns.Msg
+	if err = dm.Unpack(j.raw); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &monitor{cfg: &config{name: "dns"}}
+	tx := m.newTx("", "", &j.f, j.src, j.dst, dm)
+	tx.tap = j.tap
+	return tx
+}
+
+func TestDecodeDnstapQuery(t *testing.T) {
+	tx := tapTx(t, tapFrame(t, false))
+
+	if tx.msg.Response || tx.Qname() != "tap.example.com." || tx.service != "dns" {
+		t.Fatalf("query got response=%v qname=%s service=%s", tx.msg.Response, tx.Qname(), tx.service)
+	}
+
+	if tx.Remote() != "192.0.2.1" || tx.Client() != "192.0.2.1" || tx.src != 40000 || tx.dst != 53 {
+		t.Fatalf("query got %s:%d -> %d client %s", tx.Remote(), tx.src, tx.dst, tx.Client())
+	}
+
+	if tx.Proto() != "tcp" || !tx.time.Equal(time.Unix(1700000000, 5000)) {
+		t.Fatalf("query got proto %s time %v", tx.Proto(), tx.time)
+	}
+
+	if tx.tap.identity != "resolver1" || tx.tap.version != "unbound 1.17" || tx.tap.kind != "CLIENT_QUERY" {
+		t.Fatalf("query got tap %+v", tx.tap)
+	}
+}
+
+func TestDecodeDnstapResponse(t *testing.T) {
+	tx := tapTx(t, tapFrame(t, true))
+
+	if !tx.msg.Response || tx.tap.kind != "CLIENT_RESPONSE" {
+		t.Fatalf("response got response=%v kind=%s", tx.msg.Response, tx.tap.kind)
+	}
+
+	//应答的来源是服务端 客户端是目的地址
+	if tx.Remote() != "192.0.2.53" || tx.Client() != "192.0.2.1" || tx.src != 53 || tx.dst != 40000 {
+		t.Fatalf("response got %s:%d -> %d client %s", tx.Remote(), tx.src, tx.dst, tx.Client())
+	}
+
+	if !tx.time.Equal(time.Unix(1700000001, 7000)) {
+		t.Fatalf("response got time %v", tx.time)
+	}
+
+	ips := tx.AnswerIP()
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(198, 51, 100, 7)) {
+		t.Fatalf("response got answer %v", ips)
+	}
+}
+
+func TestDecodeDnstapTruncated(t *testing.T) {
+	frame := tapFrame(t, true)
+	for _, n := range []int{1, len(frame) / 2, len(frame) - 1} {
+		if _, _, err := decodeDnstap(frame[:n]); err == nil {
+			t.Fatalf("truncated frame %d/%d decoded", n, len(frame))
+		}
+	}
+
+	//没有message字段
+	if _, _, err := decodeDnstap(pbBytes(nil, 1, []byte("resolver1"))); err == nil {
+		t.Fatal("dnstap without message decoded")
+	}
+}
+
+func writeData(t *testing.T, w io.Writer, frame []byte) {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(frame)))
+	if _, err := w.Write(append(hdr[:], frame...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//readControl 读取服务端回复的控制帧
+func readControl(t *testing.T, r io.Reader) (uint32, []string) {
+	var esc [4]byte
+	if _, err := io.ReadFull(r, esc[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.BigEndian.Uint32(esc[:]) != 0 {
+		t.Fatal("expect control frame")
+	}
+
+	typ, types, err := fstrmControl(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return typ, types
+}
+
+//serveFstrm 服务端握手后读取数据帧 直到出错
+func serveFstrm(conn net.Conn) (chan [][]byte, chan error) {
+	frames := make(chan [][]byte, 1)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		if err := fstrmHandshake(r, conn); err != nil {
+			frames <- nil
+			errs <- err
+			return
+		}
+
+		var got [][]byte
+		for {
+			frame, err := fstrmRead(r, conn, nil)
+			if err != nil {
+				frames <- got
+				errs <- err
+				return
+			}
+
+			if frame != nil {
+				got = append(got, append([]byte(nil), frame...))
+			}
+		}
+	}()
+
+	return frames, errs
+}
+
+func TestFstrmBidirectional(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	frames, errs := serveFstrm(server)
+
+	if err := fstrmWrite(client, fstrmReady, "protobuf:other", dnstapContentType); err != nil {
+		t.Fatal(err)
+	}
+
+	if typ, types := readControl(t, client); typ != fstrmAccept || len(types) != 1 || types[0] != dnstapContentType {
+		t.Fatalf("expect ACCEPT got %d %v", typ, types)
+	}
+
+	if err := fstrmWrite(client, fstrmStart, dnstapContentType); err != nil {
+		t.Fatal(err)
+	}
+
+	query, response := tapFrame(t, false), tapFrame(t, true)
+	writeData(t, client, query)
+	writeData(t, client, response)
+
+	if err := fstrmWrite(client, fstrmStop); err != nil {
+		t.Fatal(err)
+	}
+
+	if typ, _ := readControl(t, client); typ != fstrmFinish {
+		t.Fatalf("expect FINISH got %d", typ)
+	}
+
+	got := <-frames
+	if err := <-errs; err != errFstrmStop {
+		t.Fatalf("expect stop got %v", err)
+	}
+
+	if len(got) != 2 || !bytes.Equal(got[0], query) || !bytes.Equal(got[1], response) {
+		t.Fatalf("got %d frames", len(got))
+	}
+}
+
+func TestFstrmUnidirectional(t *testing.T) {
+	client, server := net.Pipe()
+	frames, errs := serveFstrm(server)
+
+	if err := fstrmWrite(client, fstrmStart); err != nil {
+		t.Fatal(err)
+	}
+
+	query := tapFrame(t, false)
+	writeData(t, client, query)
+	client.Close()
+
+	got := <-frames
+	if err := <-errs; err != io.EOF {
+		t.Fatalf("expect eof got %v", err)
+	}
+
+	if len(got) != 1 || !bytes.Equal(got[0], query) {
+		t.Fatalf("got %d frames", len(got))
+	}
+}
+
+func TestFstrmHandshakeReject(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	_, errs := serveFstrm(server)
+
+	if err := fstrmWrite(client, fstrmReady, "protobuf:other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err == nil {
+		t.Fatal("unsupported content type accepted")
+	}
+}
+
+func TestFstrmTruncatedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], 100)
+	buf.Write(hdr[:])
+	buf.Write(make([]byte, 10))
+
+	if _, err := fstrmRead(&buf, io.Discard, nil); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expect unexpected eof got %v", err)
+	}
+
+	buf.Reset()
+	binary.BigEndian.PutUint32(hdr[:], fstrmMaxFrame+1)
+	buf.Write(hdr[:])
+	if _, err := fstrmRead(&buf, io.Discard, nil); err == nil {
+		t.Fatal("oversize frame accepted")
+	}
+}
@@ -0,0 +1,39 @@
+package dns
+
+import (
+	"golang.org/x/net/publicsuffix"
+	"strings"
+)
+
+//normalize 小写 去掉末尾的点
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+//parentDomain 按照public suffix取注册域名 如 a.b.example.co.uk -> example.co.uk
+func parentDomain(name string) string {
+	name = normalize(name)
+	if name == "" {
+		return ""
+	}
+
+	parent, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err == nil {
+		return parent
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) <= 2 {
+		return name
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+//subdomain 注册域名前面的部分 没有返回空
+func subdomain(name, parent string) string {
+	name = normalize(name)
+	if len(name) <= len(parent) {
+		return ""
+	}
+	return strings.TrimSuffix(name[:len(name)-len(parent)], ".")
+}
@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//domainRule 名单中的一条规则
+//evil.com      只匹配evil.com
+//*.evil.com    匹配evil.com的子域名
+//+evil.com     按public suffix计算注册域名 注册域名是evil.com时匹配 包含evil.com本身
+type domainRule struct {
+	rule string
+	tags []string
+}
+
+//trieNode 按label倒序的字典树 com -> evil -> www
+type trieNode struct {
+	child    map[string]*trieNode
+	exact    *domainRule
+	wildcard *domainRule
+	parent   *domainRule
+}
+
+func (n *trieNode) next(label string) *trieNode {
+	if n.child == nil {
+		n.child = make(map[string]*trieNode)
+	}
+
+	c, ok := n.child[label]
+	if !ok {
+		c = &trieNode{}
+		n.child[label] = c
+	}
+	return c
+}
+
+type domainTrie struct {
+	root  trieNode
+	count int
+}
+
+func (t *domainTrie) insert(line string, tags []string) error {
+	line = normalize(strings.TrimSpace(line))
+
+	var kind byte
+	switch {
+	case strings.HasPrefix(line, "*."):
+		kind = '*'
+		line = line[2:]
+	case strings.HasPrefix(line, "+"):
+		kind = '+'
+		line = line[1:]
+	}
+
+	if line == "" || strings.ContainsAny(line, " \t*") {
+		return fmt.Errorf("invalid domain rule %q", line)
+	}
+
+	labels := strings.Split(line, ".")
+	node := &t.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		if labels[i] == "" {
+			return fmt.Errorf("invalid domain rule %q", line)
+		}
+		node = node.next(labels[i])
+	}
+
+	r := &domainRule{tags: tags}
+	switch kind {
+	case '*':
+		r.rule = "*." + line
+		node.wildcard = r
+	case '+':
+		r.rule = "+" + line
+		node.parent = r
+	default:
+		r.rule = line
+		node.exact = r
+	}
+
+	t.count++
+	return nil
+}
+
+//match 沿着倒序的label往下走 最多走label个数的深度
+func (t *domainTrie) match(name string) *domainRule {
+	name = normalize(name)
+	if name == "" {
+		return nil
+	}
+
+	labels := strings.Split(name, ".")
+	depth := -1
+	if parent := parentDomain(name); parent != "" {
+		depth = strings.Count(parent, ".") + 1
+	}
+
+	node := &t.root
+	var hit *domainRule
+	for i := len(labels) - 1; i >= 0; i-- {
+		c, ok := node.child[labels[i]]
+		if !ok {
+			return hit
+		}
+		node = c
+
+		level := len(labels) - i
+		if node.parent != nil && level == depth {
+			hit = node.parent
+		}
+
+		if i == 0 {
+			if node.exact != nil {
+				return node.exact
+			}
+			return hit
+		}
+
+		//越长的后缀越具体
+		if node.wildcard != nil {
+			hit = node.wildcard
+		}
+	}
+
+	return hit
+}
+
+//domainSet 从本地文件加载的名单 文件变化后自动重新加载
+//重新加载时整体替换字典树 读取不加锁
+type domainSet struct {
+	name  string
+	path  string
+	trie  atomic.Value
+	mtime time.Time
+	size  int64
+}
+
+func newDomainSet(uri string) (*domainSet, error) {
+	if !strings.HasPrefix(uri, "file://") {
+		return nil, fmt.Errorf("invalid domain list %s must be file://", uri)
+	}
+
+	path := strings.TrimPrefix(uri, "file://")
+	base := filepath.Base(path)
+	ds := &domainSet{
+		name: strings.TrimSuffix(base, filepath.Ext(base)),
+		path: path,
+	}
+
+	if err := ds.load(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+//load 每行一个域名 或者 domain,tag1,tag2 的csv格式 #开头是注释
+func (ds *domainSet) load() error {
+	stat, err := os.Stat(ds.path)
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.Open(ds.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	trie := &domainTrie{}
+	scanner := bufio.NewScanner(fd)
+	no := 0
+	for scanner.Scan() {
+		no++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var tags []string
+		fields := strings.Split(line, ",")
+		for _, tag := range fields[1:] {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+
+		if err := trie.insert(fields[0], tags); err != nil {
+			return fmt.Errorf("%s:%d %v", ds.path, no, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ds.trie.Store(trie)
+	ds.mtime = stat.ModTime()
+	ds.size = stat.Size()
+	return nil
+}
+
+//changed 根据修改时间和大小判断文件是否变化
+func (ds *domainSet) changed() bool {
+	stat, err := os.Stat(ds.path)
+	if err != nil {
+		return false
+	}
+	return !stat.ModTime().Equal(ds.mtime) || stat.Size() != ds.size
+}
+
+func (ds *domainSet) Match(name string) *domainRule {
+	return ds.trie.Load().(*domainTrie).match(name)
+}
+
+func (ds *domainSet) Len() int {
+	return ds.trie.Load().(*domainTrie).count
+}
+
+//listMatch tx命中的名单
+type listMatch struct {
+	list string
+	rule string
+	tags []string
+}
+
+func (lm listMatch) encode(enc encoder) {
+	enc.KV("list", lm.list)
+	enc.KV("rule", lm.rule)
+	enc.KV("tags", strings.Join(lm.tags, ","))
+}
+
+func matchSets(sets []*domainSet, name string) []listMatch {
+	var hit []listMatch
+	for _, ds := range sets {
+		if r := ds.Match(name); r != nil {
+			hit = append(hit, listMatch{list: ds.name, rule: r.rule, tags: r.tags})
+		}
+	}
+	return hit
+}
+
+func openSets(uris []string) ([]*domainSet, error) {
+	sets := make([]*domainSet, 0, len(uris))
+	for _, uri := range uris {
+		ds, err := newDomainSet(uri)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, ds)
+	}
+	return sets, nil
+}
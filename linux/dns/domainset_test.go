@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeList(t *testing.T, path, text string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkMatch(t *testing.T, ds *domainSet, cases map[string]string) {
+	t.Helper()
+	for name, want := range cases {
+		var got string
+		if r := ds.Match(name); r != nil {
+			got = r.rule
+		}
+
+		if got != want {
+			t.Fatalf("%s got %q want %q", name, got, want)
+		}
+	}
+}
+
+func TestDomainSetMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ioc.csv")
+	writeList(t, path, `# ioc
+evil.com,c2
+*.bad.org,phish,apt
+*.deep.bad.org,deep
+exact.bad.org
++evil.co.uk
++co.uk
++user.github.io
+`)
+
+	ds, err := newDomainSet("file://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ds.name != "ioc" || ds.Len() != 7 {
+		t.Fatalf("got name %s len %d", ds.name, ds.Len())
+	}
+
+	checkMatch(t, ds, map[string]string{
+		//只匹配名称本身 不区分大小写 末尾的点忽略
+		"evil.com":     "evil.com",
+		"EVIL.COM.":    "evil.com",
+		"www.evil.com": "",
+		"notevil.com":  "",
+
+		//通配只匹配子域名 越长的后缀越优先 精确匹配最优先
+		"bad.org":          "",
+		"a.bad.org":        "*.bad.org",
+		"a.b.bad.org":      "*.bad.org",
+		"x.deep.bad.org":   "*.deep.bad.org",
+		"deep.bad.org":     "*.bad.org",
+		"exact.bad.org":    "exact.bad.org",
+		"a.exact.bad.org":  "*.bad.org",
+		"a.bad.org.evil.x": "",
+
+		//按public suffix计算注册域名 包括注册域名本身 后缀下的其他注册域名不匹配
+		"evil.co.uk":       "+evil.co.uk",
+		"x.y.evil.co.uk":   "+evil.co.uk",
+		"other.co.uk":      "",
+		"user.github.io":   "+user.github.io",
+		"a.user.github.io": "+user.github.io",
+		"other.github.io":  "",
+		"":                 "",
+	})
+
+	tags := ds.Match("a.bad.org").tags
+	if len(tags) != 2 || tags[0] != "phish" || tags[1] != "apt" {
+		t.Fatalf("tags got %v", tags)
+	}
+
+	hit := matchSets([]*domainSet{ds, ds}, "evil.com")
+	if len(hit) != 2 || hit[0].list != "ioc" || hit[0].rule != "evil.com" || hit[0].tags[0] != "c2" {
+		t.Fatalf("matchSets got %v", hit)
+	}
+}
+
+func TestDomainSetInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for i, text := range []string{"a..com\n", "*.\n", "a b.com\n", "x.*.com\n"} {
+		path := filepath.Join(dir, "bad.txt")
+		writeList(t, path, text)
+		if _, err := newDomainSet("file://" + path); err == nil {
+			t.Fatalf("rule %d %q accepted", i, text)
+		}
+	}
+
+	if _, err := newDomainSet(filepath.Join(dir, "bad.txt")); err == nil {
+		t.Fatal("path without file:// accepted")
+	}
+
+	if _, err := newDomainSet("file://" + filepath.Join(dir, "none.txt")); err == nil {
+		t.Fatal("missing file accepted")
+	}
+}
+
+func TestDomainSetReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	writeList(t, path, "evil.com\n")
+
+	ds, err := newDomainSet("file://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ds.changed() {
+		t.Fatal("changed without write")
+	}
+
+	writeList(t, path, "www.evil.com\n*.bad.org\n")
+	if !ds.changed() {
+		t.Fatal("size change not detected")
+	}
+
+	if err = ds.load(); err != nil {
+		t.Fatal(err)
+	}
+	checkMatch(t, ds, map[string]string{"www.evil.com": "www.evil.com", "evil.com": "", "a.bad.org": "*.bad.org"})
+
+	//大小不变只有修改时间变化
+	writeList(t, path, "www.evil.net\n*.bad.org\n")
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+	if !ds.changed() {
+		t.Fatal("mtime change not detected")
+	}
+
+	//加载失败时继续使用旧的名单
+	writeList(t, path, "www.evil.net\n*.\n")
+	if err = ds.load(); err == nil {
+		t.Fatal("invalid list loaded")
+	}
+	checkMatch(t, ds, map[string]string{"www.evil.com": "www.evil.com", "www.evil.net": ""})
+	if ds.Len() != 2 {
+		t.Fatalf("got len %d", ds.Len())
+	}
+}
@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ednsOptionName = map[uint16]string{
+	dns.EDNS0LLQ:          "LLQ",
+	dns.EDNS0UL:           "UL",
+	dns.EDNS0NSID:         "NSID",
+	dns.EDNS0DAU:          "DAU",
+	dns.EDNS0DHU:          "DHU",
+	dns.EDNS0N3U:          "N3U",
+	dns.EDNS0SUBNET:       "ECS",
+	dns.EDNS0EXPIRE:       "EXPIRE",
+	dns.EDNS0COOKIE:       "COOKIE",
+	dns.EDNS0TCPKEEPALIVE: "KEEPALIVE",
+	dns.EDNS0PADDING:      "PADDING",
+	dns.EDNS0EDE:          "EDE",
+}
+
+func ednsName(code uint16) string {
+	if name, ok := ednsOptionName[code]; ok {
+		return name
+	}
+
+	if code >= dns.EDNS0LOCALSTART && code <= dns.EDNS0LOCALEND {
+		return "LOCAL"
+	}
+	return "OPT" + strconv.Itoa(int(code))
+}
+
+func algs(codes []uint8) []string {
+	ss := make([]string, len(codes))
+	for i, c := range codes {
+		ss[i] = strconv.Itoa(int(c))
+	}
+	return ss
+}
+
+//subnet ecs 地址按掩码截断后的网段
+func subnet(e *dns.EDNS0_SUBNET) string {
+	bits := 32
+	if e.Family == 2 {
+		bits = 128
+	}
+
+	ipn := net.IPNet{IP: e.Address, Mask: net.CIDRMask(int(e.SourceNetmask), bits)}
+	if e.Family == 1 {
+		ipn.IP = e.Address.To4()
+	}
+
+	if ipn.IP == nil || int(e.SourceNetmask) > bits {
+		return ""
+	}
+
+	ipn.IP = ipn.IP.Mask(ipn.Mask)
+	return ipn.String()
+}
+
+//printable nsid 一般是可读的主机名 不可读时为空
+func printable(b []byte) string {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return ""
+		}
+	}
+	return string(b)
+}
+
+//OPT2S 伪记录 OPT 的 class 是udp大小 ttl 是扩展rcode 版本和DO位
+func (tx *Tx) OPT2S(enc encoder, v *dns.OPT) {
+	enc.KV("udp_size", v.UDPSize())
+	enc.KV("ext_rcode", v.ExtendedRcode())
+	enc.KV("version", v.Version())
+	enc.KV("do", v.Do())
+	enc.KV("z", v.Z())
+
+	enc.Arr("options")
+	for _, o := range v.Option {
+		enc.Tab("")
+		enc.KV("code", o.Option())
+		enc.KV("option", ednsName(o.Option()))
+
+		switch e := o.(type) {
+		case *dns.EDNS0_SUBNET:
+			enc.KV("family", e.Family)
+			enc.KV("source_netmask", e.SourceNetmask)
+			enc.KV("source_scope", e.SourceScope)
+			enc.KV("address", e.Address.String())
+			enc.KV("subnet", subnet(e))
+
+		case *dns.EDNS0_COOKIE:
+			//客户端cookie固定8字节 后面是服务端cookie
+			enc.KV("cookie", e.Cookie)
+			if len(e.Cookie) >= 16 {
+				enc.KV("client", e.Cookie[:16])
+				enc.KV("server", e.Cookie[16:])
+			}
+
+		case *dns.EDNS0_PADDING:
+			enc.KV("length", len(e.Padding))
+
+		case *dns.EDNS0_NSID:
+			enc.KV("nsid", e.Nsid)
+			if b, err := hex.DecodeString(e.Nsid); err == nil {
+				enc.KV("nsid_text", printable(b))
+			}
+
+		case *dns.EDNS0_EDE:
+			enc.KV("info_code", e.InfoCode)
+			enc.KV("info_text", dns.ExtendedErrorCodeToString[e.InfoCode])
+			enc.KV("extra_text", e.ExtraText)
+
+		case *dns.EDNS0_UL:
+			enc.KV("lease", e.Lease)
+			enc.KV("key_lease", e.KeyLease)
+
+		case *dns.EDNS0_LLQ:
+			enc.KV("version", e.Version)
+			enc.KV("opcode", e.Opcode)
+			enc.KV("error", e.Error)
+			enc.KV("id", e.Id)
+			enc.KV("lease_life", e.LeaseLife)
+
+		case *dns.EDNS0_DAU:
+			enc.Join("alg", algs(e.AlgCode))
+		case *dns.EDNS0_DHU:
+			enc.Join("alg", algs(e.AlgCode))
+		case *dns.EDNS0_N3U:
+			enc.Join("alg", algs(e.AlgCode))
+
+		case *dns.EDNS0_EXPIRE:
+			enc.KV("expire", e.Expire)
+
+		case *dns.EDNS0_TCP_KEEPALIVE:
+			enc.KV("timeout", e.Timeout)
+
+		case *dns.EDNS0_LOCAL:
+			enc.KV("data", hex.EncodeToString(e.Data))
+		}
+
+		enc.End("},")
+	}
+	enc.End("],")
+}
+
+func (tx *Tx) ecs() (string, int) {
+	e := tx.ECS()
+	if e == nil {
+		return "", 0
+	}
+	return subnet(e), int(e.SourceScope)
+}
+
+//ECS 第一个client subnet选项 转发器后面真实客户端的网段
+func (tx *Tx) ECS() *dns.EDNS0_SUBNET {
+	opt := tx.msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+//EDE 所有的扩展错误
+func (tx *Tx) EDE() []*dns.EDNS0_EDE {
+	opt := tx.msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	var ede []*dns.EDNS0_EDE
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok {
+			ede = append(ede, e)
+		}
+	}
+	return ede
+}
+
+//edeCode 第一个扩展错误码 没有时为-1
+func (tx *Tx) edeCode() int {
+	ede := tx.EDE()
+	if len(ede) == 0 {
+		return -1
+	}
+	return int(ede[0].InfoCode)
+}
+
+func (tx *Tx) edeText() string {
+	var text []string
+	for _, e := range tx.EDE() {
+		s := dns.ExtendedErrorCodeToString[e.InfoCode]
+		if e.ExtraText != "" {
+			s += ": " + e.ExtraText
+		}
+		text = append(text, s)
+	}
+	return strings.Join(text, "; ")
+}
@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+//optEncoder 记录OPT2S输出的每个选项
+type optEncoder struct {
+	top     map[string]interface{}
+	options []map[string]interface{}
+	cur     map[string]interface{}
+}
+
+func (e *optEncoder) Tab(string) {
+	e.cur = make(map[string]interface{})
+	e.options = append(e.options, e.cur)
+}
+
+func (e *optEncoder) Arr(string) {}
+
+func (e *optEncoder) KV(k string, v interface{}) {
+	if e.cur == nil {
+		e.top[k] = v
+		return
+	}
+	e.cur[k] = v
+}
+
+func (e *optEncoder) Join(k string, v []string) {
+	e.KV(k, v)
+}
+
+func (e *optEncoder) End(string) {
+	e.cur = nil
+}
+
+//ednsTx 打包再解析 和抓包得到的报文一样
+func ednsTx(t *testing.T, options ...dns.EDNS0) *Tx {
+	t.Helper()
+
+	var msg dns.Msg
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(1232, true)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, options...)
+
+	wire, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := &Tx{}
+	if err = tx.msg.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestEdnsDecode(t *testing.T) {
+	tx := ednsTx(t,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 16, Address: net.ParseIP("203.0.113.77")},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708aabbccddeeff0011"},
+		&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited, ExtraText: "blocked"},
+		&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer},
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte("ns1"))},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 10)},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2}},
+	)
+
+	if ecs, scope := tx.ecs(); ecs != "203.0.113.0/24" || scope != 16 {
+		t.Fatalf("ecs got %s scope %d", ecs, scope)
+	}
+
+	if code := tx.edeCode(); code != int(dns.ExtendedErrorCodeProhibited) {
+		t.Fatalf("ede_code got %d", code)
+	}
+
+	if text := tx.edeText(); text != "Prohibited: blocked; Stale Answer" {
+		t.Fatalf("ede_text got %q", text)
+	}
+
+	enc := &optEncoder{top: make(map[string]interface{})}
+	tx.OPT2S(enc, tx.msg.IsEdns0())
+	if enc.top["udp_size"] != uint16(1232) || enc.top["do"] != true {
+		t.Fatalf("opt got %v", enc.top)
+	}
+
+	want := []map[string]interface{}{
+		{"option": "ECS", "subnet": "203.0.113.0/24", "address": "203.0.113.0", "source_netmask": uint8(24), "source_scope": uint8(16)},
+		{"option": "COOKIE", "client": "0102030405060708", "server": "aabbccddeeff0011"},
+		{"option": "EDE", "info_code": dns.ExtendedErrorCodeProhibited, "info_text": "Prohibited", "extra_text": "blocked"},
+		{"option": "EDE", "info_code": dns.ExtendedErrorCodeStaleAnswer, "extra_text": ""},
+		{"option": "NSID", "nsid_text": "ns1"},
+		{"option": "PADDING", "length": 10},
+		{"option": "LOCAL", "code": uint16(65001), "data": "0102"},
+	}
+
+	if len(enc.options) != len(want) {
+		t.Fatalf("got %d options", len(enc.options))
+	}
+
+	for i, w := range want {
+		for k, v := range w {
+			if enc.options[i][k] != v {
+				t.Fatalf("option %d %s got %v want %v", i, k, enc.options[i][k], v)
+			}
+		}
+	}
+}
+
+func TestEdnsSubnet(t *testing.T) {
+	for _, c := range []struct {
+		e    *dns.EDNS0_SUBNET
+		want string
+	}{
+		{&dns.EDNS0_SUBNET{Family: 2, SourceNetmask: 56, Address: net.ParseIP("2001:db8:1234:5678::1")}, "2001:db8:1234:5600::/56"},
+		{&dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.0.2.1")}, "192.0.2.1/32"},
+		{&dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 0, Address: net.IPv4zero}, "0.0.0.0/0"},
+		{&dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 33, Address: net.ParseIP("192.0.2.1")}, ""},
+		{&dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24, Address: net.ParseIP("2001:db8::1")}, ""},
+	} {
+		if got := subnet(c.e); got != c.want {
+			t.Fatalf("%v got %q want %q", c.e, got, c.want)
+		}
+	}
+
+	tx := ednsTx(t, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: 48, Address: net.ParseIP("2001:db8:abcd:1::1")})
+	if ecs, scope := tx.ecs(); ecs != "2001:db8:abcd::/48" || scope != 0 {
+		t.Fatalf("v6 ecs got %s scope %d", ecs, scope)
+	}
+}
+
+func TestEdnsAbsent(t *testing.T) {
+	tx := &Tx{}
+	tx.msg.SetQuestion("example.com.", dns.TypeA)
+	if ecs, scope := tx.ecs(); ecs != "" || scope != 0 || tx.edeCode() != -1 || tx.edeText() != "" {
+		t.Fatalf("got ecs %q scope %d ede %d %q", ecs, scope, tx.edeCode(), tx.edeText())
+	}
+
+	//有OPT没有选项
+	tx = ednsTx(t)
+	if ecs, _ := tx.ecs(); ecs != "" || tx.edeCode() != -1 {
+		t.Fatalf("got ecs %q ede %d", ecs, tx.edeCode())
+	}
+
+	for code, want := range map[uint16]string{dns.EDNS0SUBNET: "ECS", dns.EDNS0EDE: "EDE", 65001: "LOCAL", 20: "OPT20"} {
+		if got := ednsName(code); got != want {
+			t.Fatalf("%d got %s want %s", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"github.com/rock-go/rock/auxlib"
+	"github.com/rock-go/rock/json"
+	"github.com/rock-go/rock/lua"
+	"github.com/rock-go/rock/node"
+	"sort"
+	"time"
+)
+
+//Event 检测模块产生的告警或者汇总事件 和tx一样通过pipe输出
+type Event struct {
+	kind string
+	name string
+	time time.Time
+	kv   []eventKV
+}
+
+type eventKV struct {
+	key string
+	val interface{}
+}
+
+func newEvent(name, kind string, t time.Time) *Event {
+	return &Event{name: name, kind: kind, time: t}
+}
+
+//Set 已经存在的字段直接覆盖
+func (ev *Event) Set(key string, val interface{}) *Event {
+	for i := range ev.kv {
+		if ev.kv[i].key == key {
+			ev.kv[i].val = val
+			return ev
+		}
+	}
+
+	ev.kv = append(ev.kv, eventKV{key: key, val: val})
+	return ev
+}
+
+func (ev *Event) Get(key string) (interface{}, bool) {
+	for _, item := range ev.kv {
+		if item.key == key {
+			return item.val, true
+		}
+	}
+	return nil, false
+}
+
+func (ev *Event) ToLValue() lua.LValue {
+	return lua.NewAnyData(ev)
+}
+
+func (ev *Event) String() string {
+	enc := json.NewEncoder()
+	enc.Tab("")
+	enc.KV("ID", node.ID())
+	enc.KV("inet", node.LoadAddr())
+	enc.KV("name", ev.name)
+	enc.KV("kind", ev.kind)
+	enc.KV("time", ev.time.Format(time.RFC3339Nano))
+
+	for _, item := range ev.kv {
+		switch v := item.val.(type) {
+		case []map[string]interface{}:
+			enc.Arr(item.key)
+			for _, row := range v {
+				keys := make([]string, 0, len(row))
+				for k := range row {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+
+				enc.Tab("")
+				for _, k := range keys {
+					enc.KV(k, row[k])
+				}
+				enc.End("},")
+			}
+			enc.End("],")
+		default:
+			enc.KV(item.key, item.val)
+		}
+	}
+
+	enc.End("}")
+	return auxlib.B2S(enc.Bytes())
+}
+
+func (ev *Event) Index(L *lua.LState, key string) lua.LValue {
+	switch key {
+	case "kind":
+		return lua.S2L(ev.kind)
+	case "name":
+		return lua.S2L(ev.name)
+	case "time":
+		return lua.LNumber(ev.time.Unix())
+	}
+
+	val, ok := ev.Get(key)
+	if !ok {
+		return lua.LNil
+	}
+
+	if rows, ok := val.([]map[string]interface{}); ok {
+		tab := L.CreateTable(len(rows), 0)
+		for _, row := range rows {
+			item := L.CreateTable(0, len(row))
+			for k, v := range row {
+				item.RawSetString(k, toLValue(L, v))
+			}
+			tab.Append(item)
+		}
+		return tab
+	}
+
+	return toLValue(L, val)
+}
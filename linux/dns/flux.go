@@ -0,0 +1,338 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/lua"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//fluxConfig fast-flux 同一个域名在滑动窗口内解析到大量地址 分布在多个ASN 并且ttl很低
+type fluxConfig struct {
+	window   int //滑动窗口 秒 窗口外的地址删除
+	ips      int //不同地址数量
+	asns     int //不同ASN数量 没有mmdb时不判断
+	ttl      int //平均ttl上限 秒
+	interval int //汇总事件的输出间隔 秒
+	max      int //跟踪的域名上限
+}
+
+func newFluxConfig(L *lua.LState, val lua.LValue) *fluxConfig {
+	cfg := &fluxConfig{window: 3600, ips: 10, asns: 3, ttl: 300, interval: 300, max: 100000}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "window":
+				cfg.window = checkInt(L, key, v)
+			case "ips":
+				cfg.ips = checkInt(L, key, v)
+			case "asns":
+				cfg.asns = checkInt(L, key, v)
+			case "ttl":
+				cfg.ttl = checkInt(L, key, v)
+			case "interval":
+				cfg.interval = checkInt(L, key, v)
+			case "max":
+				cfg.max = checkInt(L, key, v)
+			default:
+				L.RaiseError("fast_flux config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("fast_flux must be bool or table , got %s", val.Type().String())
+	}
+
+	return cfg
+}
+
+func (cfg *fluxConfig) valid() error {
+	if cfg.window <= 0 || cfg.ips <= 0 || cfg.asns < 0 || cfg.ttl < 0 || cfg.interval <= 0 || cfg.max <= 0 {
+		return fmt.Errorf("invalid fast_flux config")
+	}
+	return nil
+}
+
+//fluxMaxIP 每个域名最多记录的地址 超过后只更新已有的地址
+const fluxMaxIP = 1024
+
+type fluxIP struct {
+	last    time.Time
+	ttl     uint32
+	asn     uint64
+	country string
+}
+
+type fluxName struct {
+	first   time.Time
+	last    time.Time
+	queries int
+	ips     map[string]*fluxIP
+}
+
+//fluxStat 窗口内的汇总
+type fluxStat struct {
+	ips       int
+	asns      []string
+	countries []string
+	ttlMin    uint32
+	ttlMax    uint32
+	ttlAvg    float64
+}
+
+type flux struct {
+	mu    sync.Mutex
+	cfg   *fluxConfig
+	geo   bool
+	names map[string]*fluxName
+	last  time.Time
+}
+
+func newFlux(cfg *fluxConfig, geo bool) *flux {
+	return &flux{cfg: cfg, geo: geo, names: make(map[string]*fluxName)}
+}
+
+func (f *flux) window() time.Duration {
+	return time.Duration(f.cfg.window) * time.Second
+}
+
+//observe 记录成功应答中的A和AAAA地址 ttl取地址所在记录的ttl
+func (f *flux) observe(tx *Tx) {
+	if !tx.msg.Response || tx.msg.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	name := normalize(tx.Qname())
+	if name == "" {
+		return
+	}
+
+	type answer struct {
+		ip  string
+		ttl uint32
+	}
+
+	var answers []answer
+	for _, r := range tx.msg.Answer {
+		switch v := r.(type) {
+		case *dns.A:
+			answers = append(answers, answer{v.A.String(), v.Hdr.Ttl})
+		case *dns.AAAA:
+			answers = append(answers, answer{v.AAAA.String(), v.Hdr.Ttl})
+		}
+	}
+
+	if len(answers) == 0 {
+		return
+	}
+
+	geo := make(map[string]*ipInfo, len(tx.answerGeo))
+	for _, item := range tx.answerGeo {
+		geo[item.ip.String()] = item.info
+	}
+
+	now := tx.time
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fn, ok := f.names[name]
+	if !ok {
+		if len(f.names) >= f.cfg.max {
+			f.prune(now)
+		}
+
+		if len(f.names) >= f.cfg.max {
+			return
+		}
+
+		fn = &fluxName{first: now, ips: make(map[string]*fluxIP)}
+		f.names[name] = fn
+	}
+
+	fn.last = now
+	fn.queries++
+
+	for _, a := range answers {
+		item, ok := fn.ips[a.ip]
+		if !ok {
+			if len(fn.ips) >= fluxMaxIP {
+				continue
+			}
+			item = &fluxIP{}
+			fn.ips[a.ip] = item
+		}
+
+		item.last = now
+		item.ttl = a.ttl
+		if info := geo[a.ip]; info != nil {
+			item.asn = info.ASN
+			item.country = info.Country
+		}
+	}
+}
+
+//prune 删除窗口外的地址 没有地址的域名整个删除
+func (f *flux) prune(now time.Time) {
+	window := f.window()
+	for name, fn := range f.names {
+		for ip, item := range fn.ips {
+			if now.Sub(item.last) > window {
+				delete(fn.ips, ip)
+			}
+		}
+
+		if len(fn.ips) == 0 {
+			delete(f.names, name)
+		}
+	}
+}
+
+func (fn *fluxName) stat() fluxStat {
+	st := fluxStat{ips: len(fn.ips)}
+	asns := make(map[string]struct{})
+	countries := make(map[string]struct{})
+
+	var sum float64
+	first := true
+	for _, item := range fn.ips {
+		if item.asn != 0 {
+			asns[strconv.FormatUint(item.asn, 10)] = struct{}{}
+		}
+
+		if item.country != "" {
+			countries[item.country] = struct{}{}
+		}
+
+		if first || item.ttl < st.ttlMin {
+			st.ttlMin = item.ttl
+		}
+
+		if first || item.ttl > st.ttlMax {
+			st.ttlMax = item.ttl
+		}
+		first = false
+		sum += float64(item.ttl)
+	}
+
+	if st.ips > 0 {
+		st.ttlAvg = sum / float64(st.ips)
+	}
+
+	st.asns = sortedKeys(asns)
+	st.countries = sortedKeys(countries)
+	return st
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//flagged 地址数和ttl满足条件 开启ip信息后还要求ASN数量
+func (f *flux) flagged(st fluxStat) bool {
+	if st.ips < f.cfg.ips || st.ttlAvg > float64(f.cfg.ttl) {
+		return false
+	}
+
+	return !f.geo || len(st.asns) >= f.cfg.asns
+}
+
+//sample 最近出现的地址 最多20个
+func (fn *fluxName) sample() []map[string]interface{} {
+	ips := make([]string, 0, len(fn.ips))
+	for ip := range fn.ips {
+		ips = append(ips, ip)
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		a, b := fn.ips[ips[i]], fn.ips[ips[j]]
+		if !a.last.Equal(b.last) {
+			return a.last.After(b.last)
+		}
+		return ips[i] < ips[j]
+	})
+
+	if len(ips) > 20 {
+		ips = ips[:20]
+	}
+
+	rows := make([]map[string]interface{}, len(ips))
+	for i, ip := range ips {
+		item := fn.ips[ip]
+		rows[i] = map[string]interface{}{
+			"ip":      ip,
+			"ttl":     item.ttl,
+			"asn":     item.asn,
+			"country": item.country,
+		}
+	}
+	return rows
+}
+
+//summary 每interval秒输出一次窗口内命中的域名
+func (f *flux) summary(m *monitor, now time.Time) []*Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.last.IsZero() {
+		f.last = now
+		return nil
+	}
+
+	if now.Sub(f.last) < time.Duration(f.cfg.interval)*time.Second {
+		return nil
+	}
+
+	return f.collect(m, now)
+}
+
+//report 立即输出 离线回放结束时调用
+func (f *flux) report(m *monitor, now time.Time) []*Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.collect(m, now)
+}
+
+func (f *flux) collect(m *monitor, now time.Time) []*Event {
+	f.last = now
+	f.prune(now)
+
+	var evs []*Event
+	for name, fn := range f.names {
+		st := fn.stat()
+		if !f.flagged(st) {
+			continue
+		}
+
+		evs = append(evs, newEvent(m.Name(), "fast_flux", now).
+			Set("domain", name).
+			Set("ips", st.ips).
+			Set("asns", st.asns).
+			Set("countries", st.countries).
+			Set("ttl_min", st.ttlMin).
+			Set("ttl_max", st.ttlMax).
+			Set("ttl_avg", st.ttlAvg).
+			Set("queries", fn.queries).
+			Set("first_seen", fn.first.Unix()).
+			Set("last_seen", fn.last.Unix()).
+			Set("answers", fn.sample()).
+			Set("window", f.cfg.window))
+	}
+
+	return evs
+}
@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//fluxTx 一个应答 每个地址带上ASN和国家 asn为0表示没有ip信息
+func fluxTx(name string, at int, ttl uint32, asn uint64, ips ...string) *Tx {
+	tx := &Tx{service: "dns", time: time.Unix(1700000000+int64(at), 0)}
+	tx.msg.SetQuestion(name, dns.TypeA)
+	tx.msg.Response = true
+
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		tx.msg.Answer = append(tx.msg.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip})
+		if asn != 0 {
+			tx.answerGeo = append(tx.answerGeo, ipGeo{ip: ip, info: &ipInfo{ASN: asn, Country: "C" + strconv.FormatUint(asn%2, 10)}})
+		}
+	}
+	return tx
+}
+
+func TestFluxSummary(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	f := newFlux(&fluxConfig{window: 600, ips: 10, asns: 3, ttl: 300, interval: 60, max: 10}, true)
+	base := time.Unix(1700000000, 0)
+
+	//第一次调用只记录时间
+	if evs := f.summary(m, base); evs != nil {
+		t.Fatal("first summary reported")
+	}
+
+	for i := 0; i < 6; i++ {
+		n := strconv.Itoa(i)
+		f.observe(fluxTx("flux.bad.", i, 60, uint64(100+i%3), "1.1."+n+".1", "1.1."+n+".2"))
+		f.observe(fluxTx("cdn.good.", i, 3600, uint64(200+i%3), "2.2."+n+".1", "2.2."+n+".2"))
+		f.observe(fluxTx("one.asn.", i, 60, 300, "3.3."+n+".1", "3.3."+n+".2"))
+	}
+
+	//query和失败的应答不记录
+	q := fluxTx("flux.bad.", 6, 60, 100, "1.1.9.1")
+	q.msg.Response = false
+	f.observe(q)
+	nx := fluxTx("flux.bad.", 6, 60, 100, "1.1.9.2")
+	nx.msg.Rcode = dns.RcodeNameError
+	f.observe(nx)
+
+	if evs := f.summary(m, base.Add(30*time.Second)); evs != nil {
+		t.Fatal("summary before interval")
+	}
+
+	//ttl太长和ASN太少的不算
+	evs := f.summary(m, base.Add(61*time.Second))
+	if len(evs) != 1 {
+		t.Fatalf("got %d events", len(evs))
+	}
+
+	ev := evs[0]
+	for k, want := range map[string]interface{}{
+		"domain":     "flux.bad",
+		"ips":        12,
+		"queries":    6,
+		"ttl_min":    uint32(60),
+		"ttl_max":    uint32(60),
+		"ttl_avg":    float64(60),
+		"first_seen": base.Unix(),
+		"last_seen":  base.Unix() + 5,
+	} {
+		if v, _ := ev.Get(k); v != want {
+			t.Fatalf("%s got %v want %v", k, v, want)
+		}
+	}
+
+	if v, _ := ev.Get("asns"); len(v.([]string)) != 3 || v.([]string)[0] != "100" {
+		t.Fatalf("asns got %v", v)
+	}
+
+	if v, _ := ev.Get("countries"); len(v.([]string)) != 2 {
+		t.Fatalf("countries got %v", v)
+	}
+
+	//最近出现的地址在前
+	if v, _ := ev.Get("answers"); v.([]map[string]interface{})[0]["ip"] != "1.1.5.1" {
+		t.Fatalf("answers got %v", v)
+	}
+
+	//下一个interval之前不再输出
+	if evs = f.summary(m, base.Add(90*time.Second)); evs != nil {
+		t.Fatal("summary repeated in interval")
+	}
+}
+
+//TestFluxWindow 窗口外的地址不计数 地址都过期的域名删除
+func TestFluxWindow(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	f := newFlux(&fluxConfig{window: 100, ips: 4, ttl: 300, interval: 60, max: 2}, false)
+	base := time.Unix(1700000000, 0)
+
+	f.observe(fluxTx("flux.bad.", 0, 30, 0, "1.1.1.1", "1.1.1.2"))
+	f.observe(fluxTx("flux.bad.", 80, 30, 0, "1.1.1.3", "1.1.1.4"))
+
+	//没有ip信息时不要求ASN数量
+	if evs := f.report(m, base.Add(90*time.Second)); len(evs) != 1 {
+		t.Fatalf("got %d events in window", len(evs))
+	}
+
+	//前两个地址过期 只剩两个
+	if evs := f.report(m, base.Add(150*time.Second)); len(evs) != 0 {
+		t.Fatal("expired ips counted")
+	}
+
+	if st := f.names["flux.bad"].stat(); st.ips != 2 {
+		t.Fatalf("got %d ips", st.ips)
+	}
+
+	//域名满了先删除过期的 依然满了不记录新的域名
+	f.observe(fluxTx("a.com.", 150, 30, 0, "2.2.2.2"))
+	f.observe(fluxTx("b.com.", 200, 30, 0, "3.3.3.3"))
+	if _, ok := f.names["b.com"]; !ok || len(f.names) != 2 {
+		t.Fatalf("got %d names", len(f.names))
+	}
+
+	f.observe(fluxTx("c.com.", 201, 30, 0, "4.4.4.4"))
+	if _, ok := f.names["c.com"]; ok {
+		t.Fatal("name recorded over max")
+	}
+
+	if evs := f.report(m, base.Add(400*time.Second)); len(evs) != 0 || len(f.names) != 0 {
+		t.Fatalf("got %d names after window", len(f.names))
+	}
+}
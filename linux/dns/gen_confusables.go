@@ -0,0 +1,133 @@
+//go:build ignore
+// +build ignore
+
+//生成confusables_table.go 数据来自unicode的confusables.txt
+//go run gen_confusables.go -src https://www.unicode.org/Public/security/latest/confusables.txt
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	src = flag.String("src", "https://www.unicode.org/Public/security/latest/confusables.txt", "confusables.txt的地址或者本地文件")
+	out = flag.String("out", "confusables_table.go", "输出的文件")
+)
+
+var versionRe = regexp.MustCompile(`^#\s*Version:\s*(\S+)`)
+
+func open(src string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return os.Open(src)
+	}
+
+	resp, err := http.Get(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("get %s status %s", src, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func parseRunes(v string) ([]rune, error) {
+	var rs []rune
+	for _, f := range strings.Fields(v) {
+		n, err := strconv.ParseUint(f, 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, rune(n))
+	}
+	return rs, nil
+}
+
+func main() {
+	flag.Parse()
+
+	r, err := open(*src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	version := "unknown"
+	type entry struct {
+		source rune
+		target string
+	}
+	var entries []entry
+
+	//每行格式 source ; target ; MA # 注释 source只有一个字符
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(scanner.Text(), "\ufeff")
+		if m := versionRe.FindStringSubmatch(line); m != nil {
+			version = m[1]
+		}
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Split(line, ";")
+		if len(fields) < 2 {
+			continue
+		}
+
+		source, err := parseRunes(fields[0])
+		if err != nil || len(source) != 1 {
+			log.Fatalf("invalid line %q", scanner.Text())
+		}
+
+		target, err := parseRunes(fields[1])
+		if err != nil || len(target) == 0 {
+			log.Fatalf("invalid line %q", scanner.Text())
+		}
+
+		entries = append(entries, entry{source: source[0], target: string(target)})
+	}
+
+	if err = scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(entries) == 0 {
+		log.Fatalf("%s has no confusables", *src)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by gen_confusables.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package dns\n\n")
+	fmt.Fprintf(&b, "//confusablesVersion 生成时使用的confusables.txt版本\n")
+	fmt.Fprintf(&b, "const confusablesVersion = %q\n\n", version)
+	fmt.Fprintf(&b, "//confusables unicode confusables.txt中每个字符对应的原型 共%d条\n", len(entries))
+	fmt.Fprintf(&b, "var confusables = map[rune]string{\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "\t0x%04X: %+q,\n", e.source, e.target)
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	data, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = os.WriteFile(*out, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
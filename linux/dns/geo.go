@@ -0,0 +1,188 @@
+package dns
+
+import (
+	"github.com/rock-go/rock/lua"
+	"github.com/rock-go/rock/region"
+	"net"
+)
+
+//ipInfo ip的地理位置和运营商信息
+type ipInfo struct {
+	Country     string
+	CountryName string
+	Province    string
+	City        string
+	ISP         string
+	ASN         uint64
+	Org         string
+}
+
+type ipGeo struct {
+	ip   net.IP
+	info *ipInfo
+}
+
+//enricher ip信息查询接口 没有结果返回nil
+type enricher interface {
+	Lookup(ip net.IP) *ipInfo
+}
+
+//regionEnricher 使用region sdk 只支持ipv4
+type regionEnricher struct {
+	r *region.Region
+}
+
+func (re regionEnricher) Lookup(ip net.IP) *ipInfo {
+	if ip.To4() == nil {
+		return nil
+	}
+
+	info, err := re.r.Search(ip)
+	if err != nil || info == nil {
+		return nil
+	}
+
+	return &ipInfo{
+		Country:  string(info.Country),
+		Province: string(info.Province),
+		City:     string(info.City),
+		ISP:      string(info.ISP),
+	}
+}
+
+//mmdbEnricher 使用本地的MaxMind数据库 支持ipv4和ipv6 多个库的结果合并
+type mmdbEnricher struct {
+	dbs []*mmdb
+}
+
+func mmdbString(m map[string]interface{}, path ...string) string {
+	var cur interface{} = m
+	for _, key := range path {
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			cur = v[key]
+		case []interface{}:
+			if len(v) == 0 {
+				return ""
+			}
+			first, ok := v[0].(map[string]interface{})
+			if !ok {
+				return ""
+			}
+			cur = first[key]
+		default:
+			return ""
+		}
+	}
+
+	s, _ := cur.(string)
+	return s
+}
+
+func (me mmdbEnricher) Lookup(ip net.IP) *ipInfo {
+	var info *ipInfo
+
+	for _, db := range me.dbs {
+		m, err := db.Lookup(ip)
+		if err != nil || m == nil {
+			continue
+		}
+
+		if info == nil {
+			info = &ipInfo{}
+		}
+
+		merge(&info.Country, mmdbString(m, "country", "iso_code"))
+		merge(&info.CountryName, mmdbString(m, "country", "names", "en"))
+		merge(&info.Province, mmdbString(m, "subdivisions", "names", "en"))
+		merge(&info.City, mmdbString(m, "city", "names", "en"))
+		merge(&info.ISP, mmdbString(m, "isp"))
+		merge(&info.Org, mmdbString(m, "autonomous_system_organization"))
+		merge(&info.Org, mmdbString(m, "organization"))
+
+		if info.ASN == 0 {
+			info.ASN = mmdbUint(m["autonomous_system_number"])
+		}
+	}
+
+	return info
+}
+
+func merge(dst *string, v string) {
+	if *dst == "" {
+		*dst = v
+	}
+}
+
+//fill 只填充info中为空的字段
+func (info *ipInfo) fill(v *ipInfo) {
+	merge(&info.Country, v.Country)
+	merge(&info.CountryName, v.CountryName)
+	merge(&info.Province, v.Province)
+	merge(&info.City, v.City)
+	merge(&info.ISP, v.ISP)
+	merge(&info.Org, v.Org)
+
+	if info.ASN == 0 {
+		info.ASN = v.ASN
+	}
+}
+
+//geo 依次查询所有的enricher 合并后的结果放在lru缓存中
+type geo struct {
+	items []enricher
+	cache *lru
+}
+
+func newGeo(cache int, items ...enricher) *geo {
+	return &geo{items: items, cache: newLru(cache)}
+}
+
+func (g *geo) Lookup(ip net.IP) *ipInfo {
+	if g == nil || ip == nil {
+		return nil
+	}
+
+	key := ip.String()
+	if v, ok := g.cache.get(key); ok {
+		return v.(*ipInfo)
+	}
+
+	//region在前 mmdb补充region没有的字段 如asn org
+	var info *ipInfo
+	for _, item := range g.items {
+		v := item.Lookup(ip)
+		if v == nil {
+			continue
+		}
+
+		if info == nil {
+			info = v
+			continue
+		}
+		info.fill(v)
+	}
+
+	g.cache.set(key, info, 0)
+	return info
+}
+
+func (info *ipInfo) encode(enc encoder) {
+	enc.KV("country", info.Country)
+	enc.KV("country_name", info.CountryName)
+	enc.KV("province", info.Province)
+	enc.KV("city", info.City)
+	enc.KV("isp", info.ISP)
+	enc.KV("asn", info.ASN)
+	enc.KV("org", info.Org)
+}
+
+func (info *ipInfo) table(L *lua.LState) lua.LValue {
+	if info == nil {
+		return lua.LNil
+	}
+
+	enc := newTableEncoder(L)
+	info.encode(enc)
+	return enc.Table()
+}
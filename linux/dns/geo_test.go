@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+//regionStub 和regionEnricher一样只返回ipv4的地区信息 没有asn
+type regionStub map[string]*ipInfo
+
+func (rs regionStub) Lookup(ip net.IP) *ipInfo {
+	if ip.To4() == nil {
+		return nil
+	}
+
+	if v, ok := rs[ip.String()]; ok {
+		info := *v
+		return &info
+	}
+	return nil
+}
+
+func TestGeoMerge(t *testing.T) {
+	db, err := openMmdb(writeMmdb(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := regionStub{
+		"1.2.3.4": {Country: "澳大利亚", City: "悉尼", ISP: "电信"},
+		"8.8.8.8": {Country: "美国", ISP: "谷歌"},
+	}
+	g := newGeo(16, rs, mmdbEnricher{dbs: []*mmdb{db}})
+
+	//region的字段优先 asn由mmdb补充
+	info := g.Lookup(net.ParseIP("1.2.3.4"))
+	if info == nil || info.Country != "澳大利亚" || info.City != "悉尼" || info.ASN != 13335 {
+		t.Fatalf("1.2.3.4 got %+v", info)
+	}
+
+	//mmdb没有记录时只有region的结果
+	info = g.Lookup(net.ParseIP("8.8.8.8"))
+	if info == nil || info.Country != "美国" || info.ASN != 0 {
+		t.Fatalf("8.8.8.8 got %+v", info)
+	}
+
+	//region没有结果时使用mmdb
+	info = g.Lookup(net.ParseIP("1.1.1.1"))
+	if info == nil || info.Country != "AU" || info.ASN != 13335 {
+		t.Fatalf("1.1.1.1 got %+v", info)
+	}
+
+	if info = g.Lookup(net.ParseIP("9.9.9.9")); info != nil {
+		t.Fatalf("9.9.9.9 got %+v", info)
+	}
+
+	//命中缓存
+	if v, ok := g.cache.get("1.2.3.4"); !ok || v.(*ipInfo).ASN != 13335 {
+		t.Fatalf("1.2.3.4 not cached")
+	}
+}
@@ -0,0 +1,296 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/rock-go/rock/lua"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+//homographConfig 受保护的品牌域名 同形字符和拼写相近的注册域名标记在tx上
+type homographConfig struct {
+	brands   []string //品牌注册域名 如 paypal.com
+	distance int      //注册域名去掉后缀后 编辑距离不超过distance算拼写相近
+	min      int      //品牌名称短于min时不检查拼写相近 太短的名称误报多
+}
+
+func newHomographConfig(L *lua.LState, val lua.LValue) *homographConfig {
+	cfg := &homographConfig{distance: 1, min: 5}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "brands":
+				cfg.brands = checkStrings(L, key, v)
+			case "distance":
+				cfg.distance = checkInt(L, key, v)
+			case "min":
+				cfg.min = checkInt(L, key, v)
+			default:
+				L.RaiseError("homograph config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("homograph must be bool or table , got %s", val.Type().String())
+	}
+
+	//品牌可以写成中文等unicode形式 统一转成punycode
+	for i, b := range cfg.brands {
+		if v, err := idna.Punycode.ToASCII(normalize(b)); err == nil {
+			b = v
+		}
+		cfg.brands[i] = normalize(b)
+	}
+
+	return cfg
+}
+
+func (cfg *homographConfig) valid() error {
+	if cfg.distance < 0 || cfg.min < 0 {
+		return fmt.Errorf("invalid homograph config")
+	}
+
+	if len(cfg.brands) == 0 {
+		return fmt.Errorf("homograph brands is empty")
+	}
+
+	for _, b := range cfg.brands {
+		if parentDomain(b) != b {
+			return fmt.Errorf("homograph brand %s must be registered domain", b)
+		}
+	}
+	return nil
+}
+
+//go:generate go run gen_confusables.go -out confusables_table.go
+
+//skeleton 去掉附加符号后按confusables替换成原型 两个名称的skeleton相同说明看起来一样
+//原型可能是大写字母 如 0 对应 O 替换后再转小写
+func skeleton(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+
+		r = unicode.ToLower(r)
+		v, ok := confusables[r]
+		if !ok {
+			b.WriteRune(r)
+			continue
+		}
+
+		for _, c := range norm.NFD.String(v) {
+			if !unicode.Is(unicode.Mn, c) {
+				b.WriteRune(unicode.ToLower(c))
+			}
+		}
+	}
+	return b.String()
+}
+
+//allowScripts 允许混用的文字 日文和中文 韩文都可以和拉丁字母混用
+var allowScripts = [][]*unicode.RangeTable{
+	{unicode.Latin, unicode.Han, unicode.Hiragana, unicode.Katakana},
+	{unicode.Latin, unicode.Han, unicode.Bopomofo},
+	{unicode.Latin, unicode.Han, unicode.Hangul},
+}
+
+var labelScripts = []*unicode.RangeTable{
+	unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Armenian, unicode.Georgian, unicode.Cherokee,
+	unicode.Arabic, unicode.Hebrew, unicode.Thai, unicode.Han, unicode.Hiragana, unicode.Katakana,
+	unicode.Bopomofo, unicode.Hangul,
+}
+
+//mixedScript 一个label中的字母来自多种文字 并且不是允许的组合 数字和连字符不算
+func mixedScript(label string) bool {
+	used := make(map[*unicode.RangeTable]struct{})
+	for _, r := range label {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+
+		for _, t := range labelScripts {
+			if unicode.Is(t, r) {
+				used[t] = struct{}{}
+				break
+			}
+		}
+	}
+
+	if len(used) <= 1 {
+		return false
+	}
+
+	for _, allow := range allowScripts {
+		n := 0
+		for _, t := range allow {
+			if _, ok := used[t]; ok {
+				n++
+			}
+		}
+
+		if n == len(used) {
+			return false
+		}
+	}
+	return true
+}
+
+//decodeIDN 解码xn--开头的label 不是国际化域名时返回空
+func decodeIDN(name string) (string, bool) {
+	name = normalize(name)
+	if !strings.Contains(name, "xn--") {
+		return "", false
+	}
+
+	labels := strings.Split(name, ".")
+	var mixed bool
+	for i, label := range labels {
+		if !strings.HasPrefix(label, "xn--") {
+			continue
+		}
+
+		u, err := idna.Punycode.ToUnicode(label)
+		if err != nil {
+			continue
+		}
+
+		labels[i] = u
+		if mixedScript(u) {
+			mixed = true
+		}
+	}
+
+	return strings.Join(labels, "."), mixed
+}
+
+//osaDistance 编辑距离 相邻字符交换算一次
+func osaDistance(a, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			v := d[i-1][j] + 1
+			if d[i][j-1]+1 < v {
+				v = d[i][j-1] + 1
+			}
+
+			if d[i-1][j-1]+cost < v {
+				v = d[i-1][j-1] + cost
+			}
+
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < v {
+				v = d[i-2][j-2] + 1
+			}
+			d[i][j] = v
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+//brandLabel 注册域名去掉public suffix
+func brandLabel(domain string) string {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	if suffix == "" || len(suffix) >= len(domain) {
+		return domain
+	}
+	return strings.TrimSuffix(domain[:len(domain)-len(suffix)], ".")
+}
+
+type brand struct {
+	domain string
+	label  []rune
+}
+
+type homograph struct {
+	cfg      *homographConfig
+	brands   []brand
+	skeleton map[string]string
+}
+
+func newHomograph(cfg *homographConfig) *homograph {
+	h := &homograph{cfg: cfg, skeleton: make(map[string]string, len(cfg.brands))}
+	for _, b := range cfg.brands {
+		u, _ := idna.Punycode.ToUnicode(b)
+		h.skeleton[skeleton(u)] = b
+		h.brands = append(h.brands, brand{domain: b, label: []rune(brandLabel(b))})
+	}
+	return h
+}
+
+//inspect 注册域名和品牌的skeleton相同是同形 否则按编辑距离判断拼写相近 品牌自己和子域名不标记
+func (h *homograph) inspect(tx *Tx) {
+	parent := parentDomain(normalize(tx.Qname()))
+	if parent == "" {
+		return
+	}
+
+	for _, b := range h.brands {
+		if parent == b.domain {
+			return
+		}
+	}
+
+	//qname解码后取和注册域名相同数量的label
+	u := parent
+	if v, _ := tx.idn(); v != "" {
+		labels := strings.Split(v, ".")
+		if n := strings.Count(parent, ".") + 1; n <= len(labels) {
+			u = strings.Join(labels[len(labels)-n:], ".")
+		}
+	}
+
+	if b, ok := h.skeleton[skeleton(u)]; ok {
+		tx.homographOf = b
+		return
+	}
+
+	if h.cfg.distance == 0 {
+		return
+	}
+
+	label := []rune(brandLabel(parent))
+	for _, b := range h.brands {
+		if len(b.label) < h.cfg.min {
+			continue
+		}
+
+		diff := len(label) - len(b.label)
+		if diff < 0 {
+			diff = -diff
+		}
+
+		if diff > h.cfg.distance {
+			continue
+		}
+
+		if n := osaDistance(label, b.label); n > 0 && n <= h.cfg.distance {
+			tx.typosquatOf = b.domain
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+	"net"
+	"testing"
+	"time"
+)
+
+func idnTx(name string) *Tx {
+	var msg dns.Msg
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+
+	f := &frame{addr: &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, daddr: net.IPv4(192, 0, 2, 53), proto: protoUDP, ts: time.Now()}
+	m := &monitor{cfg: &config{name: "dns"}}
+	return m.newTx("", "", f, 40000, 53, msg)
+}
+
+func TestSkeleton(t *testing.T) {
+	same := [][2]string{
+		{"pаypal", "paypal"},    //西里尔字母а
+		{"paypa1", "paypal"},    //数字1
+		{"g00gle", "google"},    //数字0的原型是大写O
+		{"exarnple", "example"}, //rn和m
+		{"pαypal", "paypal"},    //希腊字母α
+		{"pàypál", "paypal"},    //附加符号
+		{"PayPal", "paypal"},
+	}
+
+	for _, c := range same {
+		if a, b := skeleton(c[0]), skeleton(c[1]); a != b {
+			t.Fatalf("%s skeleton %q want %q", c[0], a, b)
+		}
+	}
+
+	for _, c := range [][2]string{{"paypal", "paypai"}, {"google", "gooogle"}, {"例子", "例字"}} {
+		if skeleton(c[0]) == skeleton(c[1]) {
+			t.Fatalf("%s and %s got same skeleton", c[0], c[1])
+		}
+	}
+}
+
+func TestConfusables(t *testing.T) {
+	if len(confusables) < 6000 || confusablesVersion == "" {
+		t.Fatalf("confusables got %d entries version %q", len(confusables), confusablesVersion)
+	}
+
+	for r, want := range map[rune]string{'а': "a", 'ο': "o", '1': "l", 'm': "rn"} {
+		if v := confusables[r]; v != want {
+			t.Fatalf("%U got %q want %q", r, v, want)
+		}
+	}
+}
+
+func TestMixedScript(t *testing.T) {
+	for label, want := range map[string]bool{
+		"paypal":    false,
+		"pаypal":    true, //拉丁和西里尔
+		"пример":    false,
+		"αβγ":       false,
+		"pαypal":    true,
+		"日本語テスト":    false,
+		"テストtest":   false,
+		"中文test":    false,
+		"한국어test":   false,
+		"中文한국어ひらがな": true,
+		"test-123":  false,
+		"рaypal-1":  true,
+	} {
+		if got := mixedScript(label); got != want {
+			t.Fatalf("%s got %v want %v", label, got, want)
+		}
+	}
+}
+
+func TestOsaDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"paypal", "paypal", 0},
+		{"paypal", "paypall", 1},
+		{"paypal", "paypa", 1},
+		{"paypal", "paypel", 1},
+		{"paypal", "pyapal", 1}, //相邻交换
+		{"abcd", "abdc", 1},
+		{"ca", "abc", 3}, //osa不允许交换后再插入
+		{"kitten", "sitting", 3},
+		{"例子", "例字", 1},
+	} {
+		if got := osaDistance([]rune(c.a), []rune(c.b)); got != c.want {
+			t.Fatalf("%s %s got %d want %d", c.a, c.b, got, c.want)
+		}
+
+		if got := osaDistance([]rune(c.b), []rune(c.a)); got != c.want {
+			t.Fatalf("%s %s got %d want %d", c.b, c.a, got, c.want)
+		}
+	}
+}
+
+func TestDecodeIDN(t *testing.T) {
+	puny, _ := idna.Punycode.ToASCII("pаypal.com")
+	if u, mixed := decodeIDN("www." + puny + "."); u != "www.pаypal.com" || !mixed {
+		t.Fatalf("%s got %s %v", puny, u, mixed)
+	}
+
+	jp, _ := idna.Punycode.ToASCII("日本語テスト.jp")
+	if u, mixed := decodeIDN(jp); u != "日本語テスト.jp" || mixed {
+		t.Fatalf("%s got %s %v", jp, u, mixed)
+	}
+
+	if u, mixed := decodeIDN("example.com."); u != "" || mixed {
+		t.Fatalf("example.com got %s %v", u, mixed)
+	}
+}
+
+func TestHomographInspect(t *testing.T) {
+	h := newHomograph(&homographConfig{brands: []string{"paypal.com", "example.com", "qq.com"}, distance: 1, min: 5})
+	puny, _ := idna.Punycode.ToASCII("pаypal.com")
+
+	for name, want := range map[string][2]string{
+		"www." + puny:      {"paypal.com", ""},
+		"login.paypa1.com": {"paypal.com", ""},
+		"exarnple.com":     {"example.com", ""},
+		"paypal.com":       {"", ""},
+		"a.b.paypal.com":   {"", ""},
+		"paypall.com":      {"", "paypal.com"},
+		"pyapal.net":       {"", "paypal.com"},
+		"qa.com":           {"", ""},
+		"google.com":       {"", ""},
+	} {
+		tx := idnTx(name)
+		h.inspect(tx)
+		if tx.homographOf != want[0] || tx.typosquatOf != want[1] {
+			t.Fatalf("%s got homograph %q typosquat %q", name, tx.homographOf, tx.typosquatOf)
+		}
+	}
+}
+
+//TestHomographIDN String只输出已经解码的idn字段 只有homograph检测会解码
+func TestHomographIDN(t *testing.T) {
+	tx := idnTx("xn--80ak6aa92e.com")
+	if tx.idnDone {
+		t.Fatal("idn decoded without homograph")
+	}
+
+	h := newHomograph(&homographConfig{brands: []string{"paypal.com"}, distance: 1, min: 5})
+	h.inspect(tx)
+	if !tx.idnDone || tx.idnUnicode != "аррӏе.com" || tx.idnMixed {
+		t.Fatalf("got done=%v unicode=%s mixed=%v", tx.idnDone, tx.idnUnicode, tx.idnMixed)
+	}
+}
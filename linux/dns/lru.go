@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+//lru 带过期时间的定长缓存 ttl为0表示不过期
+type lru struct {
+	mu    sync.Mutex
+	max   int
+	items map[string]*list.Element
+	queue *list.List
+}
+
+type lruEntry struct {
+	key    string
+	val    interface{}
+	expire time.Time
+}
+
+func newLru(max int) *lru {
+	return &lru{
+		max:   max,
+		items: make(map[string]*list.Element),
+		queue: list.New(),
+	}
+}
+
+func (c *lru) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if !entry.expire.IsZero() && time.Now().After(entry.expire) {
+		c.queue.Remove(elem)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.queue.MoveToFront(elem)
+	return entry.val, true
+}
+
+func (c *lru) set(key string, val interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expire time.Time
+	if ttl > 0 {
+		expire = time.Now().Add(ttl)
+	}
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.val = val
+		entry.expire = expire
+		c.queue.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.queue.PushFront(&lruEntry{key: key, val: val, expire: expire})
+	for c.queue.Len() > c.max {
+		back := c.queue.Back()
+		c.queue.Remove(back)
+		delete(c.items, back.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lru) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queue.Len()
+}
@@ -9,6 +9,11 @@ import (
 var xEnv *xbase.EnvT
 
 func (m *monitor) pipeL(L *lua.LState) int {
+	if w := checkTxWriter(L, L.Get(1)); w != nil {
+		m.cfg.sink = append(m.cfg.sink, w)
+		return 0
+	}
+
 	pv := pipe.LValue(L.Get(1))
 	if pv == nil {
 		return 0
@@ -18,16 +23,66 @@ func (m *monitor) pipeL(L *lua.LState) int {
 	return 0
 }
 
+func (m *monitor) statsL(L *lua.LState) int {
+	L.Push(m.stats.table(L))
+	return 1
+}
+
 func (m *monitor) Index(L *lua.LState, key string) lua.LValue {
 	switch key {
 	case "pipe":
 		return L.NewFunction(m.pipeL)
+	case "stats":
+		return L.NewFunction(m.statsL)
+	case "client":
+		return L.NewFunction(m.clientL)
+	case "pdns":
+		if m.pdns == nil {
+			return lua.LNil
+		}
+		return lua.NewAnyData(m.pdns)
 	}
 	return lua.LNil
 }
 
 func constructor(L *lua.LState) int {
+	return newProc(L, newConfig(L))
+}
+
+//tapConstructor linux.dnstap 和 linux.dns 共用配置和输出 只是输入换成dnstap
+func tapConstructor(L *lua.LState) int {
 	cfg := newConfig(L)
+	cfg.dnstap = true
+	return newProc(L, cfg)
+}
+
+func pcapWriterL(L *lua.LState) int {
+	cfg := newPcapWriterConfig(L)
+	proc := L.NewProc(cfg.name, pcapWriterTypeof)
+	if proc.IsNil() {
+		proc.Set(newPcapWriter(cfg))
+	} else {
+		proc.Data.(*pcapWriter).cfg = cfg
+	}
+
+	L.Push(proc)
+	return 1
+}
+
+func tapWriterL(L *lua.LState) int {
+	cfg := newTapWriterConfig(L)
+	proc := L.NewProc(cfg.name, tapWriterTypeof)
+	if proc.IsNil() {
+		proc.Set(newTapWriter(cfg))
+	} else {
+		proc.Data.(*tapWriter).cfg = cfg
+	}
+
+	L.Push(proc)
+	return 1
+}
+
+func newProc(L *lua.LState, cfg *config) int {
 	proc := L.NewProc(cfg.name, typeof)
 	if proc.IsNil() {
 		proc.Set(newM(cfg))
@@ -54,5 +109,11 @@ func constructor(L *lua.LState) int {
 
 func Inject(env *xbase.EnvT, x lua.UserKV) {
 	xEnv = env
-	x.Set("dns", lua.NewFunction(constructor))
+	kv := lua.NewUserKV()
+	kv.Set("dga", lua.NewFunction(dgaL))
+	kv.Set("resolve", lua.NewFunction(resolveL))
+	kv.Set("pcap_writer", lua.NewFunction(pcapWriterL))
+	kv.Set("dnstap_writer", lua.NewFunction(tapWriterL))
+	x.Set("dnstap", lua.NewFunction(tapConstructor))
+	x.Set("dns", lua.NewExport("linux.dns.export", lua.WithFunc(constructor), lua.WithTable(kv)))
 }
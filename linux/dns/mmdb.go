@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"os"
+)
+
+//mmdb 读取MaxMind格式的数据库 country city asn isp 都可以 文件整体读入内存 不需要关闭
+type mmdb struct {
+	path   string
+	reader *maxminddb.Reader
+}
+
+func openMmdb(path string) (*mmdb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mmdb{path: path, reader: reader}, nil
+}
+
+//Lookup 返回ip对应的数据 没有命中或者ipv4的库查询ipv6地址时返回nil
+func (db *mmdb) Lookup(ip net.IP) (map[string]interface{}, error) {
+	if ip.To4() == nil && db.reader.Metadata.IPVersion == 4 {
+		return nil, nil
+	}
+
+	var m map[string]interface{}
+	if err := db.reader.Lookup(ip, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func mmdbUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case uint32:
+		return uint64(n)
+	case uint16:
+		return uint64(n)
+	case int:
+		return uint64(n)
+	case int64:
+		return uint64(n)
+	case float64:
+		return uint64(n)
+	default:
+		return 0
+	}
+}
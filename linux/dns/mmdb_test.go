@@ -0,0 +1,138 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mmdbStr(s string) []byte {
+	return append([]byte{byte(2<<5 | len(s))}, s...)
+}
+
+func mmdbMap(n int) []byte {
+	return []byte{byte(7<<5 | n)}
+}
+
+func mmdbU16(v uint16) []byte {
+	return []byte{5<<5 | 2, byte(v >> 8), byte(v)}
+}
+
+func mmdbU32(v uint32) []byte {
+	return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+//writeMmdb 只有1.0.0.0/8一条记录的数据库 record_size=24 ipv6的库前96位是0
+func writeMmdb(t *testing.T, ipv6 bool) string {
+	var data bytes.Buffer
+	data.Write(mmdbMap(2))
+	data.Write(mmdbStr("country"))
+	data.Write(mmdbMap(1))
+	data.Write(mmdbStr("iso_code"))
+	data.Write(mmdbStr("AU"))
+	data.Write(mmdbStr("autonomous_system_number"))
+	data.Write(mmdbU32(13335))
+
+	skip := 0
+	if ipv6 {
+		skip = 96
+	}
+
+	//第i个节点按1.0.0.0/8的第i位走向下一个节点 另一边指向空记录(node_count) 最后一个节点指向数据
+	nodes := skip + 8
+	var tree bytes.Buffer
+	put := func(v int) { tree.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)}) }
+	for i := 0; i < nodes-1; i++ {
+		put(i + 1)
+		put(nodes)
+	}
+
+	//1的最后一位是1
+	put(nodes)
+	put(nodes + 16)
+
+	var f bytes.Buffer
+	f.Write(tree.Bytes())
+	f.Write(make([]byte, 16))
+	f.Write(data.Bytes())
+	f.WriteString("\xab\xcd\xefMaxMind.com")
+	f.Write(mmdbMap(3))
+	f.Write(mmdbStr("node_count"))
+	f.Write(mmdbU32(uint32(nodes)))
+	f.Write(mmdbStr("record_size"))
+	f.Write(mmdbU16(24))
+	f.Write(mmdbStr("ip_version"))
+	if ipv6 {
+		f.Write(mmdbU16(6))
+	} else {
+		f.Write(mmdbU16(4))
+	}
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, f.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMmdbLookup(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		db, err := openMmdb(writeMmdb(t, ipv6))
+		if err != nil {
+			t.Fatalf("ipv6=%v open %v", ipv6, err)
+		}
+
+		m, err := db.Lookup(net.ParseIP("1.2.3.4"))
+		if err != nil || m == nil {
+			t.Fatalf("ipv6=%v 1.2.3.4 got %v %v", ipv6, m, err)
+		}
+
+		if mmdbUint(m["autonomous_system_number"]) != 13335 || mmdbString(m, "country", "iso_code") != "AU" {
+			t.Fatalf("ipv6=%v 1.2.3.4 got %v", ipv6, m)
+		}
+
+		if m, err = db.Lookup(net.ParseIP("2.2.3.4")); err != nil || m != nil {
+			t.Fatalf("ipv6=%v 2.2.3.4 got %v %v", ipv6, m, err)
+		}
+
+		//ipv4的库查询ipv6地址不报错
+		if m, err = db.Lookup(net.ParseIP("2001:db8::1")); err != nil || m != nil {
+			t.Fatalf("ipv6=%v 2001:db8::1 got %v %v", ipv6, m, err)
+		}
+	}
+}
+
+func TestMmdbOpenInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.mmdb")
+	if err := os.WriteFile(path, []byte("not a mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openMmdb(path); err == nil {
+		t.Fatal("invalid mmdb opened")
+	}
+}
+
+func TestMmdbEnricher(t *testing.T) {
+	v4, err := openMmdb(writeMmdb(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v6, err := openMmdb(writeMmdb(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	me := mmdbEnricher{dbs: []*mmdb{v4, v6}}
+	info := me.Lookup(net.ParseIP("1.1.1.1"))
+	if info == nil || info.Country != "AU" || info.ASN != 13335 {
+		t.Fatalf("1.1.1.1 got %+v", info)
+	}
+
+	if info = me.Lookup(net.ParseIP("8.8.8.8")); info != nil {
+		t.Fatalf("8.8.8.8 got %+v", info)
+	}
+}
@@ -2,6 +2,7 @@ package dns
 
 import (
 	"fmt"
+	"github.com/miekg/dns"
 	"github.com/rock-go/rock/auxlib"
 	"github.com/rock-go/rock/buffer"
 	"github.com/rock-go/rock/lua"
@@ -11,6 +12,9 @@ import (
 	"gopkg.in/tomb.v2"
 	"net"
 	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var typeof = reflect.TypeOf((*monitor)(nil)).String()
@@ -20,6 +24,31 @@ type monitor struct {
 	cfg  *config
 	tom  *tomb.Tomb
 	conn net.PacketConn
+	ln   net.Listener
+	pair *correlator
+	asm  *assembler
+	ring *ring
+	geo  *geo
+	proc *procResolver
+	tun  *tunnel
+	dga  *dga
+	pois *poison
+	rb   *rebind
+	flux *flux
+	sp   *spoof
+	prof *profile
+	sum  *summary
+	homo *homograph
+	ms   *membership
+
+	deny  []*domainSet
+	allow []*domainSet
+	pdns  *pdns
+	nod   *nod
+
+	block   bool
+	stats   stats
+	workers []*worker
 }
 
 func newM(cfg *config) *monitor {
@@ -36,6 +65,7 @@ func (m *monitor) Type() string {
 	return typeof
 }
 
+//Region region库只支持ipv4 ipv6地址返回nil 位置信息从mmdb中获取 在tx.geo
 func (m *monitor) Region(addr net.Addr) *region.Info {
 	if m.cfg.region == nil {
 		return nil
@@ -54,51 +84,304 @@ func (m *monitor) Region(addr net.Addr) *region.Info {
 	return info
 }
 
-func (m *monitor) newTx(code, host string, addr net.Addr, udp *packet.UDPHeader) *Tx {
-	msg, err := packet.Dns(udp)
-	if err != nil {
-		xEnv.Infof("%s tx parse dns fail %v", m.Name(), err)
-		return nil
+func (m *monitor) newTx(code, host string, f *frame, src, dst uint16, msg dns.Msg) *Tx {
+	return &Tx{
+		service: service(src, dst),
+		msg:     msg,
+		code:    code,
+		host:    host,
+		addr:    f.addr,
+		daddr:   f.daddr,
+		proto:   f.proto,
+		name:    m.Name(),
+		src:     src,
+		dst:     dst,
+		time:    f.ts,
+		region:  m.Region(f.addr),
 	}
+}
 
-	return &Tx{
-		msg:    msg,
-		code:   code,
-		host:   host,
-		addr:   addr,
-		name:   m.Name(),
-		src:    udp.Source,
-		dst:    udp.Destination,
-		region: m.Region(addr),
+//enrich 补充来源地址和应答中A/AAAA地址的ip信息
+func (m *monitor) enrich(tx *Tx) {
+	if m.geo == nil {
+		return
+	}
+
+	if ip, ok := tx.addr.(*net.IPAddr); ok {
+		tx.geo = m.geo.Lookup(ip.IP)
+	}
+
+	for _, ip := range tx.AnswerIP() {
+		if info := m.geo.Lookup(ip); info != nil {
+			tx.answerGeo = append(tx.answerGeo, ipGeo{ip: ip, info: info})
+		}
 	}
 }
 
-func (m *monitor) pipe(tx *Tx) {
+//attribute 本机发出的query或者收到的response 找到对应的本地进程
+func (m *monitor) attribute(tx *Tx) {
+	if m.proc == nil {
+		return
+	}
+
+	port := tx.src
+	ip := tx.daddr
+	if tx.msg.Response {
+		port = tx.dst
+	} else if addr, ok := tx.addr.(*net.IPAddr); ok {
+		ip = addr.IP
+	}
+
+	//raw socket 下response的目的地址未知 只能是本机
+	if ip != nil && !m.proc.local(ip) {
+		return
+	}
+
+	tx.proc = m.proc.Lookup(tx.proto, port)
+}
+
+func (m *monitor) newGeo() (*geo, error) {
+	var items []enricher
+	if m.cfg.region != nil {
+		items = append(items, regionEnricher{r: m.cfg.region})
+	}
+
+	if len(m.cfg.mmdb) > 0 {
+		me := mmdbEnricher{}
+		for _, path := range m.cfg.mmdb {
+			db, err := openMmdb(path)
+			if err != nil {
+				return nil, err
+			}
+			me.dbs = append(me.dbs, db)
+		}
+		items = append(items, me)
+	}
+
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	return newGeo(m.cfg.geoCache, items...), nil
+}
+
+func (m *monitor) pipe(co *lua.LState, tx *Tx) {
 	defer func() {
 		if tx.buf != nil {
 			buffer.Put(tx.buf)
 		}
 	}()
 
-	pipe.Do(m.cfg.pipe, tx, m.cfg.co, func(err error) {
+	if !m.forward(tx) {
+		return
+	}
+
+	pipe.Do(m.cfg.pipe, tx, co, func(err error) {
+		atomic.AddUint64(&m.stats.pipeFailed, 1)
 		xEnv.Errorf("%s pipe call fail %v", m.Name(), err)
 	})
 }
 
-func (m *monitor) acl(udp *packet.UDPHeader) bool {
-	bp := m.cfg.bind.Port()
-	if bp != 0 {
-		return bp == int(udp.Source)
+//emit 检测模块产生的事件 和tx走同一个pipe
+func (m *monitor) emit(co *lua.LState, ev *Event) {
+	if ev == nil {
+		return
+	}
+
+	atomic.AddUint64(&m.stats.events, 1)
+	pipe.Do(m.cfg.pipe, ev, co, func(err error) {
+		atomic.AddUint64(&m.stats.pipeFailed, 1)
+		xEnv.Errorf("%s pipe event call fail %v", m.Name(), err)
+	})
+}
+
+//alert 检测模块针对tx产生的事件 同时标记tx 汇总的suspicious输出会保留这条tx
+func (m *monitor) alert(co *lua.LState, tx *Tx, ev *Event) {
+	if ev == nil {
+		return
+	}
+
+	tx.alerted = true
+	m.emit(co, ev)
+}
+
+//lists 匹配名单
+func (m *monitor) lists(tx *Tx) {
+	if len(m.deny)+len(m.allow) == 0 {
+		return
+	}
+
+	name := tx.Qname()
+	tx.deny = matchSets(m.deny, name)
+	tx.allow = matchSets(m.allow, name)
+}
+
+//reload 定时检查名单文件 加载失败时继续使用旧的名单
+func (m *monitor) reload() {
+	tk := time.NewTicker(time.Duration(m.cfg.listReload) * time.Second)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-m.tom.Dying():
+			return
+
+		case <-tk.C:
+			for _, sets := range [][]*domainSet{m.deny, m.allow} {
+				for _, ds := range sets {
+					if !ds.changed() {
+						continue
+					}
+
+					if err := ds.load(); err != nil {
+						xEnv.Errorf("%s reload %s fail %v", m.Name(), ds.path, err)
+						continue
+					}
+					xEnv.Infof("%s reload %s %d rules", m.Name(), ds.path, ds.Len())
+				}
+			}
+		}
+	}
+}
+
+//inspect 按顺序执行开启的检测模块 白名单中的域名不检测 组播协议只做投毒检测
+func (m *monitor) inspect(co *lua.LState, tx *Tx) {
+	if len(tx.allow) > 0 {
+		return
+	}
+
+	if tx.service != "dns" {
+		if m.pois != nil {
+			for _, ev := range m.pois.inspect(m, tx) {
+				m.alert(co, tx, ev)
+			}
+		}
+		return
+	}
+
+	if m.homo != nil {
+		m.homo.inspect(tx)
+	}
+
+	if m.tun != nil {
+		m.alert(co, tx, m.tun.inspect(m, tx))
+	}
+
+	if m.dga != nil {
+		m.alert(co, tx, m.dga.inspect(m, tx))
+	}
+
+	if m.prof != nil {
+		for _, ev := range m.prof.inspect(m, tx) {
+			m.alert(co, tx, ev)
+		}
+	}
+
+	if m.rb != nil {
+		m.alert(co, tx, m.rb.inspect(m, tx))
+	}
+
+	if m.flux != nil {
+		m.flux.observe(tx)
+	}
+
+	if m.sp != nil {
+		for _, ev := range m.sp.inspect(m, tx) {
+			m.alert(co, tx, ev)
+		}
+	}
+
+	if m.nod != nil {
+		m.alert(co, tx, m.nod.inspect(m, tx))
+	}
+}
+
+//write 写入原始报文 失败时只计数
+func (m *monitor) write(tx *Tx) {
+	for _, w := range m.cfg.sink {
+		if err := w.WriteTx(tx); err != nil {
+			atomic.AddUint64(&m.stats.sinkFailed, 1)
+		}
+	}
+}
+
+//handle 开启关联后 query 等待应答 response 合并时延后输出
+func (m *monitor) handle(co *lua.LState, tx *Tx) {
+	m.write(tx)
+	m.enrich(tx)
+	m.attribute(tx)
+	m.lists(tx)
+
+	if m.pdns != nil && tx.service == "dns" {
+		m.pdns.observe(tx)
+	}
+
+	m.inspect(co, tx)
+
+	if m.sum != nil {
+		m.sum.observe(tx)
+	}
+
+	if m.pair == nil {
+		m.pipe(co, tx)
+		return
+	}
+
+	if !tx.msg.Response {
+		m.pair.query(tx)
+		return
+	}
+
+	m.pair.answer(tx)
+	m.pipe(co, tx)
+}
+
+func (m *monitor) tick(now time.Time) {
+	if m.nod != nil {
+		for _, ev := range m.nod.expire(now) {
+			m.dispatch(&job{ev: ev})
+		}
+	}
+
+	if m.flux != nil {
+		for _, ev := range m.flux.summary(m, now) {
+			m.dispatch(&job{ev: ev})
+		}
+	}
+
+	if m.prof != nil {
+		m.prof.expire(now)
 	}
-	ps := m.cfg.bind.Ports()
 
-	n := len(ps)
-	if n == 0 {
-		return false
+	if m.sum != nil {
+		if ev := m.sum.report(m, now); ev != nil {
+			m.dispatch(&job{ev: ev})
+		}
+	}
+
+	if m.pair == nil {
+		return
 	}
 
-	for i := 0; i < n; i++ {
-		if int(udp.Source) == ps[i] {
+	for _, tx := range m.pair.expire(now) {
+		m.dispatch(&job{tx: tx})
+	}
+}
+
+func (m *monitor) read(buf []byte) (int, net.Addr, error) {
+	m.conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := m.conn.ReadFrom(buf)
+	m.tick(time.Now())
+	return n, addr, err
+}
+
+func (m *monitor) acl(src, dst uint16) bool {
+	return m.match(src) || m.match(dst)
+}
+
+func (m *monitor) match(port uint16) bool {
+	for _, p := range m.ports() {
+		if int(port) == p {
 			return true
 		}
 	}
@@ -106,39 +389,95 @@ func (m *monitor) acl(udp *packet.UDPHeader) bool {
 	return false
 }
 
+//capture 配置了写入器并且是抓包输入时保留完整的ip报文
+func (m *monitor) capture(f *frame) bool {
+	return len(m.cfg.sink) > 0 && len(f.pkt) > 0
+}
+
+//decode 读取协程中只做端口过滤和tcp重组 dns解析交给处理协程
+func (m *monitor) decode(f *frame) {
+	switch f.proto {
+	case protoUDP:
+		if len(f.data) < 8 {
+			return
+		}
+
+		udp := packet.NewUDPHeader(f.data)
+		if !m.acl(udp.Source, udp.Destination) {
+			return
+		}
+
+		atomic.AddUint64(&m.stats.received, 1)
+		j := &job{f: frame{addr: f.addr, daddr: f.daddr, proto: f.proto, ts: f.ts}, src: udp.Source, dst: udp.Destination}
+		if m.capture(f) {
+			//写入器需要完整的报文 udp头直接引用报文副本
+			j.pkt = append([]byte(nil), f.pkt...)
+			j.udp = packet.NewUDPHeader(j.pkt[len(j.pkt)-len(f.data):])
+		} else {
+			j.udp = packet.NewUDPHeader(append([]byte(nil), f.data...))
+		}
+		m.dispatch(j)
+
+	case protoTCP:
+		tcp := newTCPHeader(f.data)
+		if tcp == nil || !m.acl(tcp.Source, tcp.Destination) {
+			return
+		}
+
+		msgs := m.asm.feed(f.addr.String(), tcp, f.ts)
+		for _, raw := range msgs {
+			atomic.AddUint64(&m.stats.received, 1)
+			j := &job{f: frame{addr: f.addr, daddr: f.daddr, proto: f.proto, ts: f.ts}, src: tcp.Source, dst: tcp.Destination, raw: raw}
+
+			//分段刚好是一个完整报文时保留原始分段 跨分段的报文由写入器还原
+			if len(msgs) == 1 && len(tcp.Payload) == len(raw)+2 && m.capture(f) {
+				j.pkt = append([]byte(nil), f.pkt...)
+			}
+			m.dispatch(j)
+		}
+	}
+}
+
 func (m *monitor) accept() {
-	buf := make([]byte, 4096)
-	host := m.cfg.bind.Hostname()
-	code := m.cfg.co.CodeVM()
+	buf := make([]byte, 65535)
+
+	proto := uint8(protoUDP)
+	if m.cfg.bind.Scheme() == "tcp" {
+		proto = protoTCP
+	}
 
 	for {
 		select {
 
 		case <-m.tom.Dying():
-			xEnv.Errorf("%s accept %v", m.tom.Err())
+			xEnv.Errorf("%s accept %v", m.Name(), m.tom.Err())
 			return
 
 		default:
-			n, addr, err := m.conn.ReadFrom(buf)
+			n, addr, err := m.read(buf)
 			if err != nil {
 				continue
 			}
 
-			udp := packet.NewUDPHeader(buf[:n])
-			if !m.acl(udp) {
-				continue
-			}
-
-			tx := m.newTx(code, host, addr, udp)
-			if tx == nil {
-				continue
-			}
-			m.pipe(tx)
+			m.decode(&frame{addr: addr, proto: proto, ts: time.Now(), data: buf[:n]})
 		}
 	}
 }
 
 func (m *monitor) Listen() error {
+	if m.cfg.bind.Scheme() == "afpacket" {
+		r, err := newRing(m.cfg.bind.Hostname(), m.cfg.promisc, m.cfg.blockSize, m.cfg.blockNum)
+		if err != nil {
+			return err
+		}
+
+		m.ring = r
+		if err = m.attach(r.attach); err != nil {
+			r.detach()
+		}
+		r.drain()
+		return nil
+	}
 
 	conn, err := net.ListenPacket(m.cfg.net(), m.cfg.bind.Hostname())
 	if err != nil {
@@ -146,16 +485,246 @@ func (m *monitor) Listen() error {
 	}
 
 	m.conn = conn
+	if sc, ok := conn.(syscall.Conn); ok {
+		m.attach(func(insn []bpfInsn) error {
+			return attachConn(sc, insn)
+		})
+	}
 	return nil
 }
 
+//join 加入组播组 afpacket 只加入抓包的网卡 失败时只能看到本机的组播报文
+func (m *monitor) join() {
+	if !m.cfg.multicast {
+		return
+	}
+
+	var iface string
+	if m.cfg.bind.Scheme() == "afpacket" {
+		iface = m.cfg.bind.Hostname()
+	}
+
+	ms, err := joinGroups(iface)
+	if err != nil {
+		xEnv.Errorf("%s %v", m.Name(), err)
+		return
+	}
+	m.ms = ms
+}
+
+func (m *monitor) ports() []int {
+	var ps []int
+	if bp := m.cfg.bind.Port(); bp != 0 {
+		ps = []int{bp}
+	} else {
+		ps = m.cfg.bind.Ports()
+	}
+
+	if !m.cfg.multicast {
+		return ps
+	}
+
+	for _, p := range []int{portMdns, portLlmnr, portNbns} {
+		found := false
+		for _, v := range ps {
+			if v == p {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+//attach 内核里过滤非dns端口的报文 失败时依旧使用用户态的acl
+func (m *monitor) attach(fn func([]bpfInsn) error) error {
+	insn := m.cfg.bpf
+	if len(insn) == 0 {
+		var err error
+		insn, err = portFilter(m.ports())
+		if err != nil {
+			xEnv.Errorf("%s compile bpf fail %v", m.Name(), err)
+			return err
+		}
+	}
+
+	err := fn(insn)
+	if err != nil {
+		xEnv.Errorf("%s attach bpf fail %v , use userspace acl", m.Name(), err)
+	}
+	return err
+}
+
 func (m *monitor) Start() error {
-	if e := m.Listen(); e != nil {
+	if e := m.cfg.valid(); e != nil {
 		return e
 	}
 
+	m.pair = nil
+	if m.cfg.correlate {
+		m.pair = newCorrelator(m.cfg.correlateMax, time.Duration(m.cfg.correlateTimeout)*time.Second)
+	}
+	m.asm = newAssembler()
+
+	g, err := m.newGeo()
+	if err != nil {
+		return err
+	}
+	m.geo = g
+
+	m.proc = nil
+	if m.cfg.process {
+		m.proc = newProcResolver(m.cfg.procfs, time.Duration(m.cfg.processTTL)*time.Second)
+	}
+
+	m.tun = nil
+	if m.cfg.tunnel != nil {
+		m.tun = newTunnel(m.cfg.tunnel)
+	}
+
+	m.dga = nil
+	if m.cfg.dga != nil {
+		m.dga = newDga(m.cfg.dga)
+	}
+
+	m.deny, err = openSets(m.cfg.deny)
+	if err != nil {
+		return err
+	}
+
+	m.allow, err = openSets(m.cfg.allow)
+	if err != nil {
+		return err
+	}
+
+	m.pdns = nil
+	if m.cfg.pdns != nil {
+		m.pdns = newPdns(m.cfg.pdns, m.Name())
+		if err = m.pdns.load(); err != nil {
+			xEnv.Errorf("%s pdns load fail %v", m.Name(), err)
+		}
+	}
+
+	m.nod = nil
+	if m.cfg.nod != nil {
+		m.nod = newNod(m.cfg.nod, m.Name())
+		if err = m.nod.load(); err != nil {
+			xEnv.Errorf("%s nod load fail %v", m.Name(), err)
+		}
+	}
+
+	m.pois = nil
+	if m.cfg.poison != nil {
+		m.pois = newPoison(m.cfg.poison)
+	}
+
+	m.rb = nil
+	if m.cfg.rebind != nil {
+		m.rb = newRebind(m.cfg.rebind)
+	}
+
+	//ASN只能从mmdb中获取
+	m.flux = nil
+	if m.cfg.flux != nil {
+		m.flux = newFlux(m.cfg.flux, len(m.cfg.mmdb) > 0)
+	}
+
+	m.sp = nil
+	if m.cfg.spoof != nil {
+		m.sp = newSpoof(m.cfg.spoof)
+	}
+
+	m.prof = nil
+	if m.cfg.prof != nil {
+		m.prof = newProfile(m.cfg.prof)
+	}
+
+	m.homo = nil
+	if m.cfg.homo != nil {
+		m.homo = newHomograph(m.cfg.homo)
+	}
+
+	m.sum = nil
+	if m.cfg.summary != nil {
+		m.sum = newSummary(m.cfg.summary)
+	}
+
 	m.tom = new(tomb.Tomb)
+	m.block = m.cfg.bind.Scheme() == "pcap"
+
+	switch {
+	case m.cfg.dnstap:
+		if e := m.listenTap(); e != nil {
+			return e
+		}
+
+	case !m.block:
+		if e := m.Listen(); e != nil {
+			return e
+		}
+
+		m.join()
+	}
+
+	m.newWorkers()
+	for _, w := range m.workers {
+		w := w
+		m.tom.Go(func() error {
+			m.work(w)
+			return nil
+		})
+	}
+
+	if len(m.deny)+len(m.allow) > 0 {
+		m.tom.Go(func() error {
+			m.reload()
+			return nil
+		})
+	}
+
+	if m.pdns != nil {
+		m.tom.Go(func() error {
+			m.pdns.run(m)
+			return nil
+		})
+	}
+
+	if m.nod != nil {
+		m.tom.Go(func() error {
+			m.nod.run(m)
+			return nil
+		})
+	}
+
+	if m.block {
+		m.tom.Go(m.replay)
+		return nil
+	}
+
+	if m.cfg.dnstap {
+		m.tom.Go(func() error {
+			m.tickTap()
+			return nil
+		})
+
+		ln := m.ln
+		m.tom.Go(func() error {
+			m.acceptTap(ln)
+			return nil
+		})
+		return nil
+	}
+
 	m.tom.Go(func() error {
+		if m.ring != nil {
+			m.acceptRing()
+			return nil
+		}
+
 		m.accept()
 		return nil
 	})
@@ -165,5 +734,30 @@ func (m *monitor) Start() error {
 
 func (m *monitor) Close() error {
 	m.tom.Kill(fmt.Errorf("close"))
-	return m.conn.Close()
+
+	var e error
+	if m.conn != nil {
+		e = m.conn.Close()
+	}
+
+	if m.ln != nil {
+		e = m.ln.Close()
+		m.ln = nil
+	}
+
+	//等待读取和处理协程退出后才能释放mmap和虚拟机
+	m.tom.Wait()
+	m.freeWorkers()
+
+	if m.ring != nil {
+		e = m.ring.close()
+		m.ring = nil
+	}
+
+	if m.ms != nil {
+		m.ms.close()
+		m.ms = nil
+	}
+
+	return e
 }
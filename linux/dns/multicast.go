@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"strings"
+)
+
+const (
+	portMdns  = 5353
+	portLlmnr = 5355
+	portNbns  = 137
+)
+
+//组播组 mDNS 224.0.0.251 ff02::fb LLMNR 224.0.0.252 ff02::1:3 NBNS使用广播不需要加入
+var (
+	groupV4 = []net.IP{net.IPv4(224, 0, 0, 251), net.IPv4(224, 0, 0, 252)}
+	groupV6 = []net.IP{net.ParseIP("ff02::fb"), net.ParseIP("ff02::1:3")}
+)
+
+//service 按端口区分协议 都不是时为普通dns
+func service(src, dst uint16) string {
+	for _, port := range []uint16{src, dst} {
+		switch port {
+		case portMdns:
+			return "mdns"
+		case portLlmnr:
+			return "llmnr"
+		case portNbns:
+			return "nbns"
+		}
+	}
+	return "dns"
+}
+
+//membership 只用来加入组播组的socket 让网卡收下组播报文 数据由抓包的socket读取
+type membership struct {
+	conns []net.PacketConn
+}
+
+func multicastIfaces(name string) ([]net.Interface, error) {
+	if name != "" {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Interface{*ifi}, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var ifaces []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaces = append(ifaces, ifi)
+	}
+	return ifaces, nil
+}
+
+//joinGroups name为空时加入所有开启组播的网卡 ipv6不可用时忽略
+func joinGroups(name string) (*membership, error) {
+	ifaces, err := multicastIfaces(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &membership{}
+	var joined int
+	var errs []string
+
+	if c4, err := net.ListenPacket("udp4", "0.0.0.0:0"); err == nil {
+		ms.conns = append(ms.conns, c4)
+		pc := ipv4.NewPacketConn(c4)
+		for i := range ifaces {
+			for _, g := range groupV4 {
+				if err := pc.JoinGroup(&ifaces[i], &net.UDPAddr{IP: g}); err != nil {
+					errs = append(errs, fmt.Sprintf("%s %s %v", ifaces[i].Name, g, err))
+					continue
+				}
+				joined++
+			}
+		}
+	}
+
+	if c6, err := net.ListenPacket("udp6", "[::]:0"); err == nil {
+		ms.conns = append(ms.conns, c6)
+		pc := ipv6.NewPacketConn(c6)
+		for i := range ifaces {
+			for _, g := range groupV6 {
+				if err := pc.JoinGroup(&ifaces[i], &net.UDPAddr{IP: g}); err != nil {
+					errs = append(errs, fmt.Sprintf("%s %s %v", ifaces[i].Name, g, err))
+					continue
+				}
+				joined++
+			}
+		}
+	}
+
+	if joined == 0 {
+		ms.close()
+		return nil, fmt.Errorf("join multicast group fail %s", strings.Join(errs, " , "))
+	}
+
+	return ms, nil
+}
+
+func (ms *membership) close() {
+	for _, c := range ms.conns {
+		c.Close()
+	}
+	ms.conns = nil
+}
+
+//nbnsName NetBIOS 一级编码 32个A-P字符 还原成15字节名称和1字节后缀
+func nbnsName(name string) (string, byte, bool) {
+	label := normalize(name)
+	if i := strings.IndexByte(label, '.'); i >= 0 {
+		label = label[:i]
+	}
+
+	if len(label) != 32 {
+		return "", 0, false
+	}
+
+	label = strings.ToUpper(label)
+	raw := make([]byte, 16)
+	for i := 0; i < 16; i++ {
+		hi, lo := label[2*i]-'A', label[2*i+1]-'A'
+		if hi > 15 || lo > 15 {
+			return "", 0, false
+		}
+		raw[i] = hi<<4 | lo
+	}
+
+	return strings.TrimRight(string(raw[:15]), " "), raw[15], true
+}
+
+//nbnsAddrs NB记录的rdata 是 flags(2) + ipv4(4) 的数组
+//NB类型0x20和miekg中的NIMLOC相同 会按NIMLOC解析
+func nbnsAddrs(rr dns.RR) []net.IP {
+	var data string
+	switch v := rr.(type) {
+	case *dns.NIMLOC:
+		data = v.Locator
+	case *dns.RFC3597:
+		data = v.Rdata
+	default:
+		return nil
+	}
+
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for i := 0; i+6 <= len(raw); i += 6 {
+		ips = append(ips, net.IPv4(raw[i+2], raw[i+3], raw[i+4], raw[i+5]))
+	}
+	return ips
+}
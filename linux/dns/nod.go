@@ -0,0 +1,461 @@
+package dns
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/bucket"
+	"github.com/rock-go/rock/lua"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//nodConfig 新出现的注册域名
+type nodConfig struct {
+	bucket  string //本地bucket名称
+	learn   int    //学习期 秒 期间只记录不告警
+	age     int    //超过age天没有出现的域名删除 再次出现时重新告警
+	max     int    //最多记录的域名数量
+	flush   int    //压缩和落盘间隔 秒
+	wait    int    //query等待应答的时间 秒 超时按未解析输出
+	pending int    //最多等待应答的query数 满了最早的提前按未解析输出
+}
+
+func newNodConfig(L *lua.LState, val lua.LValue) *nodConfig {
+	cfg := &nodConfig{bucket: "dns_nod", learn: 86400, age: 30, max: 1000000, flush: 60, wait: 5, pending: 65536}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "bucket":
+				cfg.bucket = v.String()
+			case "learn":
+				cfg.learn = checkInt(L, key, v)
+			case "age":
+				cfg.age = checkInt(L, key, v)
+			case "max":
+				cfg.max = checkInt(L, key, v)
+			case "flush":
+				cfg.flush = checkInt(L, key, v)
+			case "wait":
+				cfg.wait = checkInt(L, key, v)
+			case "pending":
+				cfg.pending = checkInt(L, key, v)
+			default:
+				L.RaiseError("nod config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("nod must be bool or table , got %s", val.Type().String())
+	}
+
+	return cfg
+}
+
+func (cfg *nodConfig) valid() error {
+	if cfg.bucket == "" {
+		return fmt.Errorf("not found nod bucket")
+	}
+
+	if cfg.learn < 0 || cfg.age <= 0 || cfg.max <= 0 || cfg.flush <= 0 || cfg.wait <= 0 || cfg.pending <= 0 {
+		return fmt.Errorf("invalid nod config")
+	}
+
+	return nil
+}
+
+//nodMeta 持久化到bucket的学习期开始时间 域名按分片单独保存
+type nodMeta struct {
+	Start int64 `json:"start"`
+}
+
+//nodPending 新域名的query 等待应答确认是否解析成功
+type nodPending struct {
+	domain string
+	ev     *Event
+	time   time.Time
+}
+
+//nod 记录见过的注册域名和最后出现的时间 按域名分片 clock是见过的最新的报文或tick时间 离线回放时不使用当前时间
+//pending按加入的顺序排在queue中 sweep是上次检查超时的秒数
+type nod struct {
+	mu      sync.Mutex
+	cfg     *nodConfig
+	key     string
+	start   int64
+	clock   int64
+	sweep   int64
+	shard   [bucketShards]map[string]int64
+	size    int
+	pending map[string]*list.Element
+	queue   *list.List
+	dirty   map[int]struct{}
+	meta    bool
+}
+
+func newNod(cfg *nodConfig, key string) *nod {
+	n := &nod{
+		cfg:     cfg,
+		key:     key,
+		pending: make(map[string]*list.Element),
+		queue:   list.New(),
+		dirty:   make(map[int]struct{}),
+	}
+
+	for i := range n.shard {
+		n.shard[i] = make(map[string]int64)
+	}
+	return n
+}
+
+func (n *nod) advance(now int64) {
+	if now > n.clock {
+		n.clock = now
+	}
+}
+
+func (n *nod) get(domain string) (int64, bool) {
+	last, ok := n.shard[shardOf(domain)][domain]
+	return last, ok
+}
+
+func (n *nod) set(domain string, last int64) {
+	i := shardOf(domain)
+	if _, ok := n.shard[i][domain]; !ok {
+		n.size++
+	}
+	n.shard[i][domain] = last
+	n.dirty[i] = struct{}{}
+}
+
+func (n *nod) remove(domain string) {
+	i := shardOf(domain)
+	if _, ok := n.shard[i][domain]; !ok {
+		return
+	}
+	delete(n.shard[i], domain)
+	n.size--
+	n.dirty[i] = struct{}{}
+}
+
+//nodDomain 计算注册域名 反向解析和没有后缀的内网名称不统计
+func nodDomain(name string) string {
+	name = normalize(name)
+	if !strings.Contains(name, ".") || strings.HasSuffix(name, ".arpa") {
+		return ""
+	}
+	return parentDomain(name)
+}
+
+func nodResolved(tx *Tx) bool {
+	return tx.msg.Response && tx.msg.Rcode == dns.RcodeSuccess && len(tx.msg.Answer) > 0
+}
+
+func (n *nod) event(m *monitor, tx *Tx, domain string) *Event {
+	q, _ := tx.question()
+	return newEvent(m.Name(), "nod", tx.time).
+		Set("domain", domain).
+		Set("qname", normalize(q.Name)).
+		Set("qtype", dns.TypeToString[q.Qtype]).
+		Set("client", tx.Client()).
+		Set("resolved", nodResolved(tx))
+}
+
+//inspect 第一次出现的域名 query先挂起等待应答 应答直接输出
+func (n *nod) inspect(m *monitor, tx *Tx) *Event {
+	domain := nodDomain(tx.Qname())
+	if domain == "" {
+		return nil
+	}
+
+	now := tx.time.Unix()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.advance(now)
+	if n.start == 0 {
+		n.start = now
+		n.meta = true
+	}
+
+	if elem, ok := n.pending[domain]; ok {
+		if !tx.msg.Response {
+			return nil
+		}
+
+		p := n.pop(elem)
+		p.ev.Set("resolved", nodResolved(tx))
+		return p.ev
+	}
+
+	if last, ok := n.get(domain); ok {
+		if now > last {
+			n.set(domain, now)
+		}
+		return nil
+	}
+
+	if n.size >= n.cfg.max {
+		n.trim(n.cfg.max * 9 / 10)
+	}
+
+	n.set(domain, now)
+
+	//学习期
+	if now-n.start < int64(n.cfg.learn) {
+		return nil
+	}
+
+	ev := n.event(m, tx, domain)
+	if tx.msg.Response {
+		return ev
+	}
+
+	//等待的query满了 最早的一个不再等待应答 提前按未解析输出
+	var evicted *Event
+	if len(n.pending) >= n.cfg.pending {
+		evicted = n.pop(n.queue.Front()).ev
+		atomic.AddUint64(&m.stats.nodEvicted, 1)
+	}
+
+	n.pending[domain] = n.queue.PushBack(&nodPending{domain: domain, ev: ev, time: tx.time})
+	return evicted
+}
+
+func (n *nod) pop(elem *list.Element) *nodPending {
+	p := n.queue.Remove(elem).(*nodPending)
+	delete(n.pending, p.domain)
+	return p
+}
+
+//expire 等待超时的query 按未解析输出 now是tick的时间 离线回放时是报文时间
+//每个报文都会调用 同一秒内只检查一次 queue按加入顺序 只需要从头检查
+func (n *nod) expire(now time.Time) []*Event {
+	sec := now.Unix()
+	if atomic.SwapInt64(&n.sweep, sec) == sec {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.advance(sec)
+
+	var evs []*Event
+	timeout := time.Duration(n.cfg.wait) * time.Second
+	for elem := n.queue.Front(); elem != nil; elem = n.queue.Front() {
+		p := elem.Value.(*nodPending)
+		if now.Sub(p.time) < timeout {
+			break
+		}
+
+		n.pop(elem)
+		evs = append(evs, p.ev)
+	}
+	return evs
+}
+
+//trim 按最后出现的时间淘汰 保留最新的size个
+func (n *nod) trim(size int) {
+	if n.size <= size {
+		return
+	}
+
+	type item struct {
+		domain string
+		last   int64
+	}
+
+	items := make([]item, 0, n.size)
+	for _, shard := range n.shard {
+		for d, last := range shard {
+			items = append(items, item{d, last})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].last < items[j].last })
+
+	for _, it := range items[:len(items)-size] {
+		n.remove(it.domain)
+	}
+}
+
+//compact 按clock删除超过age天没有出现的域名 还没有见过报文时不压缩
+func (n *nod) compact() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.clock == 0 {
+		return
+	}
+
+	expire := n.clock - int64(n.cfg.age)*86400
+	for _, shard := range n.shard {
+		for d, last := range shard {
+			if last < expire {
+				n.remove(d)
+			}
+		}
+	}
+}
+
+//load 读取学习期开始时间和所有分片 单个分片损坏时跳过并返回最后一个错误
+func (n *nod) load() error {
+	bkt := bucket.Pack(xEnv, n.cfg.bucket)
+
+	var last error
+	data, err := bkt.Value(n.key)
+	if err != nil {
+		last = err
+	} else if len(data) > 0 {
+		var meta nodMeta
+		if err = json.Unmarshal(data, &meta); err != nil {
+			last = err
+		} else {
+			n.mu.Lock()
+			n.start = meta.Start
+			n.mu.Unlock()
+		}
+	}
+
+	for i := 0; i < bucketShards; i++ {
+		data, err = bkt.Value(shardKey(n.key, i))
+		if err != nil {
+			last = err
+			continue
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+
+		var domain map[string]int64
+		if err = json.Unmarshal(data, &domain); err != nil {
+			last = err
+			continue
+		}
+
+		n.mu.Lock()
+		for d, v := range domain {
+			if _, ok := n.shard[i][d]; !ok {
+				n.size++
+			}
+			n.shard[i][d] = v
+		}
+		n.mu.Unlock()
+	}
+	return last
+}
+
+type nodShard struct {
+	index  int
+	domain map[string]int64
+	last   int64
+}
+
+//save 在锁内只拷贝有变化的分片 锁外序列化 写入失败的分片下次重试
+func (n *nod) save() error {
+	n.mu.Lock()
+	if len(n.dirty) == 0 && !n.meta {
+		n.mu.Unlock()
+		return nil
+	}
+
+	meta, start := n.meta, nodMeta{Start: n.start}
+	shards := make([]nodShard, 0, len(n.dirty))
+	for i := range n.dirty {
+		s := nodShard{index: i, domain: make(map[string]int64, len(n.shard[i]))}
+		for d, last := range n.shard[i] {
+			s.domain[d] = last
+			if last > s.last {
+				s.last = last
+			}
+		}
+		shards = append(shards, s)
+	}
+
+	clock := n.clock
+	n.dirty = make(map[int]struct{})
+	n.meta = false
+	n.mu.Unlock()
+
+	bkt := bucket.Pack(xEnv, n.cfg.bucket)
+	age := int64(n.cfg.age) * 86400
+
+	var last error
+	if meta {
+		data, err := json.Marshal(&start)
+		if err == nil {
+			err = bkt.Push(n.key, data, 0)
+		}
+
+		if err != nil {
+			last = err
+			n.mu.Lock()
+			n.meta = true
+			n.mu.Unlock()
+		}
+	}
+
+	for _, s := range shards {
+		//分片的过期时间 按clock计算 最后一个域名超过age天后过期
+		ttl := int(age)
+		if len(s.domain) > 0 {
+			if ttl = int(s.last + age - clock); ttl <= 0 {
+				ttl = 1
+			}
+		}
+
+		data, err := json.Marshal(s.domain)
+		if err == nil {
+			err = bkt.Push(shardKey(n.key, s.index), data, ttl)
+		}
+
+		if err != nil {
+			last = err
+			n.mu.Lock()
+			n.dirty[s.index] = struct{}{}
+			n.mu.Unlock()
+		}
+	}
+	return last
+}
+
+func (n *nod) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.size
+}
+
+//run 定时压缩和落盘 退出前再写一次
+func (n *nod) run(m *monitor) {
+	tk := time.NewTicker(time.Duration(n.cfg.flush) * time.Second)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-m.tom.Dying():
+			if err := n.save(); err != nil {
+				xEnv.Errorf("%s nod save fail %v", m.Name(), err)
+			}
+			return
+
+		case <-tk.C:
+			n.compact()
+			if err := n.save(); err != nil {
+				xEnv.Errorf("%s nod save fail %v", m.Name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func nodTx(name string, response bool, ts time.Time) *Tx {
+	tx := &Tx{time: ts, addr: &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}}
+	tx.msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	if response {
+		tx.msg.Response = true
+		tx.addr, tx.daddr = &net.IPAddr{IP: net.IPv4(192, 0, 2, 53)}, net.IPv4(192, 0, 2, 1)
+		rr, _ := dns.NewRR(dns.Fqdn(name) + " 60 IN A 198.51.100.1")
+		tx.msg.Answer = []dns.RR{rr}
+	}
+	return tx
+}
+
+func TestNodInspect(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	n := newNod(&nodConfig{learn: 60, age: 1, max: 100, wait: 5, pending: 10}, "dns")
+
+	//学习期内只记录
+	t0 := time.Unix(1600000000, 0)
+	if ev := n.inspect(m, nodTx("a.learn.com", true, t0)); ev != nil {
+		t.Fatal("event in learning")
+	}
+
+	t1 := t0.Add(2 * time.Minute)
+	if ev := n.inspect(m, nodTx("b.learn.com", true, t1)); ev != nil {
+		t.Fatal("event for known domain")
+	}
+
+	ev := n.inspect(m, nodTx("www.new.co.uk", true, t1))
+	if ev == nil {
+		t.Fatal("no event for new domain")
+	}
+
+	if v, _ := ev.Get("domain"); v != "new.co.uk" {
+		t.Fatalf("domain got %v", v)
+	}
+
+	if v, _ := ev.Get("resolved"); v != true {
+		t.Fatalf("resolved got %v", v)
+	}
+
+	//反向解析不统计
+	if ev = n.inspect(m, nodTx("1.2.0.192.in-addr.arpa", true, t1)); ev != nil {
+		t.Fatal("event for arpa")
+	}
+}
+
+func TestNodPending(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	n := newNod(&nodConfig{learn: 0, age: 1, max: 100, wait: 5, pending: 10}, "dns")
+
+	t0 := time.Unix(1600000000, 0)
+	if ev := n.inspect(m, nodTx("q.example.org", false, t0)); ev != nil || len(n.pending) != 1 {
+		t.Fatal("query not pending")
+	}
+
+	//应答合并到挂起的query
+	ev := n.inspect(m, nodTx("q.example.org", true, t0.Add(time.Second)))
+	if ev == nil || len(n.pending) != 0 || n.queue.Len() != 0 {
+		t.Fatal("pending query not resolved")
+	}
+
+	if v, _ := ev.Get("resolved"); v != true {
+		t.Fatalf("resolved got %v", v)
+	}
+
+	n.inspect(m, nodTx("q.example.net", false, t0))
+	if evs := n.expire(t0.Add(time.Second)); len(evs) != 0 {
+		t.Fatalf("expire before wait got %d events", len(evs))
+	}
+
+	evs := n.expire(t0.Add(6 * time.Second))
+	if len(evs) != 1 || len(n.pending) != 0 {
+		t.Fatalf("expire got %d events", len(evs))
+	}
+
+	if v, _ := evs[0].Get("resolved"); v != false {
+		t.Fatalf("resolved got %v", v)
+	}
+}
+
+func TestNodExpireThrottle(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	n := newNod(&nodConfig{learn: 0, age: 1, max: 100, wait: 1, pending: 10}, "dns")
+
+	t0 := time.Unix(1600000000, 0)
+	n.expire(t0.Add(2 * time.Second))
+	n.inspect(m, nodTx("q.example.org", false, t0))
+
+	//同一秒内不再检查
+	if evs := n.expire(t0.Add(2*time.Second + 500*time.Millisecond)); len(evs) != 0 {
+		t.Fatalf("expire in same second got %d events", len(evs))
+	}
+
+	if evs := n.expire(t0.Add(3 * time.Second)); len(evs) != 1 {
+		t.Fatalf("expire got %d events", len(evs))
+	}
+}
+
+func TestNodPendingMax(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	n := newNod(&nodConfig{learn: 0, age: 1, max: 100, wait: 5, pending: 2}, "dns")
+
+	t0 := time.Unix(1600000000, 0)
+	n.inspect(m, nodTx("www.a.org", false, t0))
+	n.inspect(m, nodTx("www.b.org", false, t0))
+
+	//满了以后最早的query提前输出
+	ev := n.inspect(m, nodTx("www.c.org", false, t0))
+	if ev == nil || len(n.pending) != 2 || m.stats.nodEvicted != 1 {
+		t.Fatalf("pending %d evicted %d", len(n.pending), m.stats.nodEvicted)
+	}
+
+	if v, _ := ev.Get("domain"); v != "a.org" {
+		t.Fatalf("evicted %v", v)
+	}
+
+	if _, ok := n.pending["a.org"]; ok {
+		t.Fatal("evicted query still pending")
+	}
+}
+
+func TestNodCompact(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	n := newNod(&nodConfig{learn: 0, age: 1, max: 100, wait: 5, pending: 10}, "dns")
+
+	//按报文时间压缩 回放旧的报文不会删除刚学到的域名
+	t0 := time.Unix(1600000000, 0)
+	n.inspect(m, nodTx("www.old.org", true, t0))
+	n.inspect(m, nodTx("www.new.org", true, t0.Add(12*time.Hour)))
+	n.compact()
+	if n.Len() != 2 {
+		t.Fatalf("got %d domains", n.Len())
+	}
+
+	n.inspect(m, nodTx("www.last.org", true, t0.Add(25*time.Hour)))
+	n.compact()
+	if _, ok := n.get("old.org"); ok || n.Len() != 2 {
+		t.Fatalf("got %d domains", n.Len())
+	}
+}
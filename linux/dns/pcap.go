@@ -0,0 +1,279 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+
+	ngSectionHeader   = 0x0a0d0d0a
+	ngInterface       = 0x00000001
+	ngPacket          = 0x00000002
+	ngSimplePacket    = 0x00000003
+	ngEnhancedPacket  = 0x00000006
+	ngByteOrderMagic  = 0x1a2b3c4d
+	ngOptionTsResol   = 9
+	pcapMaxPacketSize = 256 * 1024
+)
+
+//record 文件中的一个数据包
+type record struct {
+	link int
+	ts   time.Time
+	data []byte
+}
+
+//pcapReader 纯go读取 pcap 和 pcapng 文件
+type pcapReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+
+	//pcap
+	link int
+	nano bool
+
+	//pcapng 每个接口的链路类型和时间精度
+	ifaces []ngIface
+}
+
+type ngIface struct {
+	link  int
+	resol uint64
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	head, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &pcapReader{r: br}
+
+	if binary.LittleEndian.Uint32(head) == ngSectionHeader {
+		pr.ng = true
+		return pr, nil
+	}
+
+	hdr := make([]byte, 24)
+	if _, err = io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicMicro:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr) == pcapMagicMicro:
+		pr.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicNano:
+		pr.order, pr.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr) == pcapMagicNano:
+		pr.order, pr.nano = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("invalid pcap magic %x", hdr[:4])
+	}
+
+	pr.link = int(pr.order.Uint32(hdr[20:24]) & 0x0fffffff)
+	return pr, nil
+}
+
+func (pr *pcapReader) Next() (*record, error) {
+	if pr.ng {
+		return pr.nextNg()
+	}
+	return pr.nextPcap()
+}
+
+func (pr *pcapReader) nextPcap() (*record, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(pr.r, hdr); err != nil {
+		return nil, err
+	}
+
+	sec := int64(pr.order.Uint32(hdr[0:4]))
+	frac := int64(pr.order.Uint32(hdr[4:8]))
+	caplen := pr.order.Uint32(hdr[8:12])
+	if caplen > pcapMaxPacketSize {
+		return nil, fmt.Errorf("invalid pcap packet length %d", caplen)
+	}
+
+	data := make([]byte, caplen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, err
+	}
+
+	if !pr.nano {
+		frac *= 1000
+	}
+
+	return &record{link: pr.link, ts: time.Unix(sec, frac), data: data}, nil
+}
+
+func (pr *pcapReader) nextNg() (*record, error) {
+	for {
+		typ, body, err := pr.block()
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case ngSectionHeader:
+			pr.ifaces = pr.ifaces[:0]
+
+		case ngInterface:
+			if len(body) < 8 {
+				return nil, fmt.Errorf("invalid pcapng interface block")
+			}
+			iface := ngIface{link: int(pr.order.Uint16(body[0:2])), resol: 1000000}
+			pr.option(body[8:], &iface)
+			pr.ifaces = append(pr.ifaces, iface)
+
+		case ngEnhancedPacket:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("invalid pcapng packet block")
+			}
+
+			id := int(pr.order.Uint32(body[0:4]))
+			if id >= len(pr.ifaces) {
+				return nil, fmt.Errorf("pcapng packet with unknown interface %d", id)
+			}
+
+			iface := pr.ifaces[id]
+			stamp := uint64(pr.order.Uint32(body[4:8]))<<32 | uint64(pr.order.Uint32(body[8:12]))
+			caplen := int(pr.order.Uint32(body[12:16]))
+			if 20+caplen > len(body) {
+				return nil, fmt.Errorf("invalid pcapng packet length %d", caplen)
+			}
+
+			return &record{link: iface.link, ts: stampTime(stamp, iface.resol), data: body[20 : 20+caplen]}, nil
+
+		case ngSimplePacket:
+			if len(body) < 4 || len(pr.ifaces) == 0 {
+				continue
+			}
+
+			caplen := int(pr.order.Uint32(body[0:4]))
+			if 4+caplen > len(body) {
+				caplen = len(body) - 4
+			}
+			return &record{link: pr.ifaces[0].link, data: body[4 : 4+caplen]}, nil
+
+		case ngPacket:
+			if len(body) < 20 {
+				continue
+			}
+
+			id := int(pr.order.Uint16(body[0:2]))
+			if id >= len(pr.ifaces) {
+				continue
+			}
+
+			iface := pr.ifaces[id]
+			stamp := uint64(pr.order.Uint32(body[4:8]))<<32 | uint64(pr.order.Uint32(body[8:12]))
+			caplen := int(pr.order.Uint32(body[12:16]))
+			if 20+caplen > len(body) {
+				continue
+			}
+			return &record{link: iface.link, ts: stampTime(stamp, iface.resol), data: body[20 : 20+caplen]}, nil
+
+		default:
+			//忽略其他类型的块
+		}
+	}
+}
+
+//block 读取一个pcapng块 返回类型和块内容(不含头尾)
+func (pr *pcapReader) block() (uint32, []byte, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(pr.r, hdr); err != nil {
+		return 0, nil, err
+	}
+
+	if binary.LittleEndian.Uint32(hdr[0:4]) == ngSectionHeader {
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(pr.r, magic); err != nil {
+			return 0, nil, err
+		}
+
+		switch {
+		case binary.LittleEndian.Uint32(magic) == ngByteOrderMagic:
+			pr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == ngByteOrderMagic:
+			pr.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("invalid pcapng byte order magic %x", magic)
+		}
+
+		size := int(pr.order.Uint32(hdr[4:8]))
+		if size < 16 || size > pcapMaxPacketSize {
+			return 0, nil, fmt.Errorf("invalid pcapng section length %d", size)
+		}
+
+		if _, err := pr.r.Discard(size - 12); err != nil {
+			return 0, nil, err
+		}
+		return ngSectionHeader, nil, nil
+	}
+
+	if pr.order == nil {
+		return 0, nil, fmt.Errorf("pcapng missing section header")
+	}
+
+	typ := pr.order.Uint32(hdr[0:4])
+	size := int(pr.order.Uint32(hdr[4:8]))
+	if size < 12 || size%4 != 0 || size > pcapMaxPacketSize {
+		return 0, nil, fmt.Errorf("invalid pcapng block length %d", size)
+	}
+
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(pr.r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return typ, body[:len(body)-4], nil
+}
+
+func (pr *pcapReader) option(b []byte, iface *ngIface) {
+	for len(b) >= 4 {
+		code := pr.order.Uint16(b[0:2])
+		size := int(pr.order.Uint16(b[2:4]))
+		if code == 0 || 4+size > len(b) {
+			return
+		}
+
+		if code == ngOptionTsResol && size >= 1 {
+			v := b[4]
+			if v&0x80 != 0 {
+				iface.resol = 1 << (v & 0x7f)
+			} else {
+				iface.resol = 1
+				for i := uint8(0); i < v; i++ {
+					iface.resol *= 10
+				}
+			}
+		}
+
+		next := 4 + (size+3)&^3
+		if next > len(b) {
+			return
+		}
+		b = b[next:]
+	}
+}
+
+func stampTime(stamp, resol uint64) time.Time {
+	if resol == 0 {
+		resol = 1000000
+	}
+
+	sec := stamp / resol
+	frac := stamp % resol
+	return time.Unix(int64(sec), int64(frac*1000000000/resol))
+}
@@ -0,0 +1,312 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//capPacket 用gopacket生成 以太网(可选vlan) ip udp dns 的报文
+func capPacket(t *testing.T, link layers.LinkType, vlan bool, src, dst string, name string) []byte {
+	t.Helper()
+
+	var msg dns.Msg
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	wire, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ls []gopacket.SerializableLayer
+	var ip gopacket.NetworkLayer
+	typ := layers.EthernetTypeIPv4
+	if v4 := net.ParseIP(src).To4(); v4 != nil {
+		ip = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: v4, DstIP: net.ParseIP(dst).To4()}
+	} else {
+		typ = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	}
+
+	if link == layers.LinkTypeEthernet {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: typ}
+		ls = append(ls, eth)
+		if vlan {
+			eth.EthernetType = layers.EthernetTypeDot1Q
+			ls = append(ls, &layers.Dot1Q{VLANIdentifier: 100, Type: typ})
+		}
+	}
+
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	ls = append(ls, ip.(gopacket.SerializableLayer), udp, gopacket.Payload(wire))
+
+	buf := gopacket.NewSerializeBuffer()
+	if err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+//checkRecord 解析记录中的报文 检查时间 地址 端口 和qname
+func checkRecord(t *testing.T, rec *record, ts time.Time, src, dst, name string) {
+	t.Helper()
+
+	if !rec.ts.Equal(ts) {
+		t.Fatalf("got ts %v want %v", rec.ts, ts)
+	}
+
+	f, err := decodeLink(rec.link, rec.data)
+	if err != nil {
+		t.Fatalf("link %d decode %v", rec.link, err)
+	}
+
+	if f.proto != protoUDP || f.addr.String() != src || f.daddr.String() != dst {
+		t.Fatalf("got proto %d %s > %s", f.proto, f.addr, f.daddr)
+	}
+
+	if len(f.data) < 8 || binary.BigEndian.Uint16(f.data[2:4]) != 53 {
+		t.Fatalf("got udp %x", f.data)
+	}
+
+	var msg dns.Msg
+	if err = msg.Unpack(f.data[8:]); err != nil || msg.Question[0].Name != dns.Fqdn(name) {
+		t.Fatalf("unpack dns %v", err)
+	}
+}
+
+func TestPcapRead(t *testing.T) {
+	t1 := time.Unix(1700000000, 123456789)
+	t2 := time.Unix(1700000001, 5000)
+	p1 := capPacket(t, layers.LinkTypeEthernet, false, "10.0.0.1", "8.8.8.8", "a.example.com")
+	p2 := capPacket(t, layers.LinkTypeEthernet, true, "2001:db8::1", "2001:db8::53", "b.example.com")
+
+	for _, nano := range []bool{false, true} {
+		var b bytes.Buffer
+		w := pcapgo.NewWriter(&b)
+		if nano {
+			w = pcapgo.NewWriterNanos(&b)
+		}
+		w.WriteFileHeader(65535, layers.LinkTypeEthernet)
+		w.WritePacket(gopacket.CaptureInfo{Timestamp: t1, CaptureLength: len(p1), Length: len(p1)}, p1)
+		w.WritePacket(gopacket.CaptureInfo{Timestamp: t2, CaptureLength: len(p2), Length: len(p2)}, p2)
+
+		pr, err := newPcapReader(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := t1.Truncate(time.Microsecond)
+		if nano {
+			want = t1
+		}
+
+		rec, err := pr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRecord(t, rec, want, "10.0.0.1", "8.8.8.8", "a.example.com")
+
+		if rec, err = pr.Next(); err != nil {
+			t.Fatal(err)
+		}
+		checkRecord(t, rec, t2, "2001:db8::1", "2001:db8::53", "b.example.com")
+
+		if _, err = pr.Next(); err != io.EOF {
+			t.Fatalf("got %v want eof", err)
+		}
+	}
+}
+
+//TestPcapBigEndian 大端的文件头和记录头
+func TestPcapBigEndian(t *testing.T) {
+	pkt := capPacket(t, layers.LinkTypeRaw, false, "10.0.0.1", "8.8.8.8", "a.example.com")
+
+	var b bytes.Buffer
+	hdr := make([]byte, 24)
+	binary.BigEndian.PutUint32(hdr[0:4], pcapMagicMicro)
+	binary.BigEndian.PutUint32(hdr[20:24], linkRaw)
+	b.Write(hdr)
+
+	rec := make([]byte, 16)
+	binary.BigEndian.PutUint32(rec[0:4], 1700000000)
+	binary.BigEndian.PutUint32(rec[4:8], 42)
+	binary.BigEndian.PutUint32(rec[8:12], uint32(len(pkt)))
+	binary.BigEndian.PutUint32(rec[12:16], uint32(len(pkt)))
+	b.Write(rec)
+	b.Write(pkt)
+
+	pr, err := newPcapReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := pr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, r, time.Unix(1700000000, 42000), "10.0.0.1", "8.8.8.8", "a.example.com")
+}
+
+func TestPcapngRead(t *testing.T) {
+	t1 := time.Unix(1700000000, 123456789)
+	p1 := capPacket(t, layers.LinkTypeEthernet, false, "10.0.0.1", "8.8.8.8", "a.example.com")
+	p2 := capPacket(t, layers.LinkTypeRaw, false, "2001:db8::1", "2001:db8::53", "b.example.com")
+
+	//第二个接口是raw链路 gopacket写入的时间精度都是纳秒
+	var b bytes.Buffer
+	w, err := pcapgo.NewNgWriter(&b, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := w.AddInterface(pcapgo.NgInterface{LinkType: layers.LinkTypeRaw})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.WritePacket(gopacket.CaptureInfo{Timestamp: t1, CaptureLength: len(p1), Length: len(p1)}, p1)
+	w.WritePacket(gopacket.CaptureInfo{Timestamp: t1, CaptureLength: len(p2), Length: len(p2), InterfaceIndex: id}, p2)
+	w.Flush()
+
+	pr, err := newPcapReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := pr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, rec, t1, "10.0.0.1", "8.8.8.8", "a.example.com")
+
+	if rec, err = pr.Next(); err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, rec, t1, "2001:db8::1", "2001:db8::53", "b.example.com")
+
+	if _, err = pr.Next(); err != io.EOF {
+		t.Fatalf("got %v want eof", err)
+	}
+}
+
+//TestPcapngResolution if_tsresol选项 10的负幂或者2的负幂
+func TestPcapngResolution(t *testing.T) {
+	pr := &pcapReader{order: binary.LittleEndian}
+	for _, c := range []struct {
+		v     byte
+		resol uint64
+	}{
+		{6, 1000000},
+		{9, 1000000000},
+		{0x80 | 10, 1024},
+	} {
+		iface := ngIface{resol: 1000000}
+		opts := []byte{2, 0, 3, 0, 'e', 't', 'h', 0, ngOptionTsResol, 0, 1, 0, c.v, 0, 0, 0, 0, 0, 0, 0}
+		pr.option(opts, &iface)
+		if iface.resol != c.resol {
+			t.Fatalf("tsresol %#x got %d want %d", c.v, iface.resol, c.resol)
+		}
+	}
+
+	if ts := stampTime(1700000000123456, 1000000); !ts.Equal(time.Unix(1700000000, 123456000)) {
+		t.Fatalf("micro got %v", ts)
+	}
+
+	if ts := stampTime(1700000000*1024+512, 1024); !ts.Equal(time.Unix(1700000000, 500000000)) {
+		t.Fatalf("binary got %v", ts)
+	}
+}
+
+//TestPcapTruncated 写了一半的文件 已经完整的记录正常读出 之后返回ErrUnexpectedEOF
+func TestPcapTruncated(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	pkt := capPacket(t, layers.LinkTypeEthernet, false, "10.0.0.1", "8.8.8.8", "a.example.com")
+	ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(pkt), Length: len(pkt)}
+
+	var classic bytes.Buffer
+	pw := pcapgo.NewWriter(&classic)
+	pw.WriteFileHeader(65535, layers.LinkTypeEthernet)
+	pw.WritePacket(ci, pkt)
+	pw.WritePacket(ci, pkt)
+
+	var ng bytes.Buffer
+	nw, err := pcapgo.NewNgWriter(&ng, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nw.WritePacket(ci, pkt)
+	nw.WritePacket(ci, pkt)
+	nw.Flush()
+
+	for name, data := range map[string][]byte{"pcap": classic.Bytes(), "pcapng": ng.Bytes()} {
+		//截断在第二个记录的数据中间和记录头中间
+		for _, cut := range []int{10, len(pkt) + 8} {
+			pr, err := newPcapReader(bytes.NewReader(data[:len(data)-cut]))
+			if err != nil {
+				t.Fatalf("%s %v", name, err)
+			}
+
+			rec, err := pr.Next()
+			if err != nil {
+				t.Fatalf("%s cut %d first record %v", name, cut, err)
+			}
+			checkRecord(t, rec, ts, "10.0.0.1", "8.8.8.8", "a.example.com")
+
+			if _, err = pr.Next(); err != io.ErrUnexpectedEOF {
+				t.Fatalf("%s cut %d got %v", name, cut, err)
+			}
+		}
+	}
+
+	if _, err := newPcapReader(bytes.NewReader(classic.Bytes()[:10])); err == nil {
+		t.Fatal("truncated header accepted")
+	}
+
+	if _, err := newPcapReader(bytes.NewReader(make([]byte, 24))); err == nil {
+		t.Fatal("invalid magic accepted")
+	}
+}
+
+func TestDecodeLink(t *testing.T) {
+	raw := capPacket(t, layers.LinkTypeRaw, false, "10.0.0.1", "8.8.8.8", "a.example.com")
+
+	sll := make([]byte, 16, 16+len(raw))
+	binary.BigEndian.PutUint16(sll[14:16], etherIPv4)
+
+	sll2 := make([]byte, 20, 20+len(raw))
+	binary.BigEndian.PutUint16(sll2[0:2], etherIPv4)
+
+	null := []byte{2, 0, 0, 0}
+
+	for link, data := range map[int][]byte{
+		linkSLL:  append(sll, raw...),
+		linkSLL2: append(sll2, raw...),
+		linkNull: append(null, raw...),
+		linkIPv4: raw,
+	} {
+		checkRecord(t, &record{link: link, data: data}, time.Time{}, "10.0.0.1", "8.8.8.8", "a.example.com")
+	}
+
+	//ip报文后面的以太网填充不属于udp
+	padded := append(append([]byte(nil), raw...), 0, 0, 0, 0)
+	f, err := decodeLink(linkRaw, padded)
+	if err != nil || len(f.data) != len(raw)-20 || len(f.pkt) != len(raw) {
+		t.Fatalf("padded got %v", err)
+	}
+
+	//不是第一片的分片和未知的链路类型跳过
+	frag := append([]byte(nil), raw...)
+	binary.BigEndian.PutUint16(frag[6:8], 100)
+	for link, data := range map[int][]byte{linkRaw: frag, 9999: raw, linkEthernet: raw[:10]} {
+		if _, err = decodeLink(link, data); err != errSkip {
+			t.Fatalf("link %d got %v", link, err)
+		}
+	}
+}
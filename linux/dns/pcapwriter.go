@@ -0,0 +1,293 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rock-go/rock/lua"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const pcapSnapLen = 262144
+
+var pcapWriterTypeof = reflect.TypeOf((*pcapWriter)(nil)).String()
+
+//pcapWriterConfig 链路类型是 LINKTYPE_RAW 抓包输入写入原始的ip报文 其他输入按tx的地址和端口还原
+type pcapWriterConfig struct {
+	name   string
+	rotate rotateConfig
+	nano   bool
+	queue  int
+}
+
+func newPcapWriterConfig(L *lua.LState) *pcapWriterConfig {
+	cfg := &pcapWriterConfig{queue: 4096}
+
+	tab := L.CheckTable(1)
+	tab.Range(func(key string, val lua.LValue) {
+		if cfg.rotate.set(L, key, val) {
+			return
+		}
+
+		switch key {
+		case "name":
+			cfg.name = val.String()
+		case "nano":
+			cfg.nano = lua.CheckBool(L, val)
+		case "queue":
+			cfg.queue = checkInt(L, key, val)
+		default:
+			L.RaiseError("pcap_writer config not found %s field", key)
+		}
+	})
+
+	return cfg
+}
+
+func (cfg *pcapWriterConfig) valid() error {
+	if cfg.queue <= 0 {
+		return fmt.Errorf("invalid pcap_writer queue")
+	}
+	return cfg.rotate.valid()
+}
+
+//pcapWriter 把每个tx按原始报文写入pcap文件 wireshark tcpdump 可以直接打开
+type pcapWriter struct {
+	lua.Super
+	cfg  *pcapWriterConfig
+	sink *sink
+
+	//还原tcp分段时每个方向已经写入的字节数
+	mu  sync.Mutex
+	seq *lru
+}
+
+func newPcapWriter(cfg *pcapWriterConfig) *pcapWriter {
+	w := &pcapWriter{cfg: cfg, sink: newSink(cfg.queue), seq: newLru(65536)}
+	w.V(pcapWriterTypeof, lua.INIT)
+	return w
+}
+
+func (w *pcapWriter) Name() string {
+	return w.cfg.name
+}
+
+func (w *pcapWriter) Type() string {
+	return pcapWriterTypeof
+}
+
+func (w *pcapWriter) Start() error {
+	if e := w.cfg.valid(); e != nil {
+		return e
+	}
+
+	out := newRotateFile(w.cfg.rotate, pcapHeader(w.cfg.nano), nil)
+	if e := out.open(time.Now()); e != nil {
+		return e
+	}
+
+	w.sink.start(w.Name(), out)
+	return nil
+}
+
+func (w *pcapWriter) Close() error {
+	w.sink.stop()
+	return nil
+}
+
+//Write 只接收tx 其他数据没有地址信息 无法还原报文
+func (w *pcapWriter) Write(b []byte) (int, error) {
+	return 0, fmt.Errorf("%s only accept dns tx", w.Name())
+}
+
+func (w *pcapWriter) WriteTx(tx *Tx) error {
+	if len(tx.wire) == 0 {
+		return nil
+	}
+
+	pkt := tx.pkt
+	if len(pkt) == 0 {
+		var err error
+		seq, ack := w.sequence(tx)
+		if pkt, err = rawPacket(tx, seq, ack); err != nil {
+			return err
+		}
+	}
+
+	frac := tx.time.Nanosecond()
+	if !w.cfg.nano {
+		frac /= 1000
+	}
+
+	rec := make([]byte, 16, 16+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(tx.time.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(frac))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(pkt)))
+	return w.sink.push(append(rec, pkt...))
+}
+
+//sequence 同一条流上还原的tcp分段seq连续递增 ack是反方向已经写入的位置
+func (w *pcapWriter) sequence(tx *Tx) (uint32, uint32) {
+	ip, ok := tx.addr.(*net.IPAddr)
+	if !ok || tx.proto != protoTCP {
+		return 0, 0
+	}
+
+	addr := ip.String()
+	daddr := tx.daddr.String()
+	key := addr + ":" + strconv.Itoa(int(tx.src)) + ">" + daddr + ":" + strconv.Itoa(int(tx.dst))
+	rev := daddr + ":" + strconv.Itoa(int(tx.dst)) + ">" + addr + ":" + strconv.Itoa(int(tx.src))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seq, ack := uint32(1), uint32(1)
+	if v, ok := w.seq.get(key); ok {
+		seq = v.(uint32)
+	}
+
+	if v, ok := w.seq.get(rev); ok {
+		ack = v.(uint32)
+	}
+
+	w.seq.set(key, seq+uint32(len(tx.wire)+2), tcpStreamIdle)
+	return seq, ack
+}
+
+func (w *pcapWriter) statsL(L *lua.LState) int {
+	L.Push(w.sink.stats.table(L))
+	return 1
+}
+
+func (w *pcapWriter) Index(L *lua.LState, key string) lua.LValue {
+	switch key {
+	case "stats":
+		return L.NewFunction(w.statsL)
+	}
+	return lua.LNil
+}
+
+func pcapHeader(nano bool) []byte {
+	magic := uint32(pcapMagicMicro)
+	if nano {
+		magic = pcapMagicNano
+	}
+
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], magic)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkRaw)
+	return hdr
+}
+
+func checksum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+//errTxAddr 来源地址不是ip的tx 不能还原成报文
+var errTxAddr = errors.New("tx source is not ip address")
+
+//rawPacket 按tx的地址和端口还原ip报文 dns部分是原始的报文
+//tcp 还原成一个带长度前缀的PSH分段 目的地址未知时使用全0地址
+func rawPacket(tx *Tx, seq, ack uint32) ([]byte, error) {
+	addr, ok := tx.addr.(*net.IPAddr)
+	if !ok {
+		return nil, errTxAddr
+	}
+
+	src := addr.IP
+	dst := tx.daddr
+
+	v4 := src.To4() != nil
+	if v4 {
+		src = src.To4()
+		if dst = dst.To4(); dst == nil {
+			dst = net.IPv4zero.To4()
+		}
+	} else if dst == nil || dst.To4() != nil {
+		dst = net.IPv6unspecified
+	}
+
+	var l4 []byte
+	var sumAt int
+	if tx.proto == protoTCP {
+		l4 = make([]byte, 22, 22+len(tx.wire))
+		binary.BigEndian.PutUint16(l4[0:2], tx.src)
+		binary.BigEndian.PutUint16(l4[2:4], tx.dst)
+		binary.BigEndian.PutUint32(l4[4:8], seq)
+		binary.BigEndian.PutUint32(l4[8:12], ack)
+		l4[12] = 5 << 4
+		l4[13] = 0x18
+		binary.BigEndian.PutUint16(l4[14:16], 0xffff)
+		binary.BigEndian.PutUint16(l4[20:22], uint16(len(tx.wire)))
+		sumAt = 16
+	} else {
+		l4 = make([]byte, 8, 8+len(tx.wire))
+		binary.BigEndian.PutUint16(l4[0:2], tx.src)
+		binary.BigEndian.PutUint16(l4[2:4], tx.dst)
+		binary.BigEndian.PutUint16(l4[4:6], uint16(8+len(tx.wire)))
+		sumAt = 6
+	}
+	l4 = append(l4, tx.wire...)
+
+	hlen := 40
+	if v4 {
+		hlen = 20
+	}
+
+	if hlen+len(l4) > 65535 {
+		return nil, fmt.Errorf("dns message too large %d", len(tx.wire))
+	}
+
+	//伪首部校验和
+	sum := checksum(0, src)
+	sum = checksum(sum, dst)
+	sum += uint32(tx.proto) + uint32(len(l4))
+	cs := fold(checksum(sum, l4))
+	if cs == 0 && tx.proto == protoUDP {
+		cs = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[sumAt:], cs)
+
+	pkt := make([]byte, hlen, hlen+len(l4))
+	if v4 {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(hlen+len(l4)))
+		binary.BigEndian.PutUint16(pkt[6:8], 0x4000)
+		pkt[8] = 64
+		pkt[9] = tx.proto
+		copy(pkt[12:16], src)
+		copy(pkt[16:20], dst)
+		binary.BigEndian.PutUint16(pkt[10:12], fold(checksum(0, pkt)))
+	} else {
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(len(l4)))
+		pkt[6] = tx.proto
+		pkt[7] = 64
+		copy(pkt[8:24], src.To16())
+		copy(pkt[24:40], dst.To16())
+	}
+
+	return append(pkt, l4...), nil
+}
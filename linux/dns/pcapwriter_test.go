@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func pcapTx(resp bool, proto uint8, src, dst net.IP, sport, dport uint16) *Tx {
+	var msg dns.Msg
+	msg.SetQuestion("w.example.com.", dns.TypeA)
+	msg.Response = resp
+	if resp {
+		msg.Answer = append(msg.Answer, &dns.A{Hdr: dns.RR_Header{Name: "w.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(1, 2, 3, 4)})
+	}
+
+	wire, _ := msg.Pack()
+	return &Tx{msg: msg, wire: wire, addr: &net.IPAddr{IP: src}, daddr: dst, proto: proto, src: sport, dst: dport, time: time.Unix(1700000000, 123456789)}
+}
+
+//pcapLayers 用gopacket解析还原的报文 返回ip层 传输层和dns部分
+func pcapLayers(t *testing.T, pkt []byte) (gopacket.SerializableLayer, gopacket.SerializableLayer, []byte) {
+	t.Helper()
+
+	first := layers.LayerTypeIPv4
+	if pkt[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+
+	p := gopacket.NewPacket(pkt, first, gopacket.Default)
+	if e := p.ErrorLayer(); e != nil {
+		t.Fatalf("decode fail %v", e.Error())
+	}
+
+	ip := p.NetworkLayer().(gopacket.SerializableLayer)
+	switch l4 := p.TransportLayer().(type) {
+	case *layers.UDP:
+		return ip, l4, l4.Payload
+	case *layers.TCP:
+		if !l4.PSH || !l4.ACK || len(l4.Payload) < 2 {
+			t.Fatalf("tcp got flags psh=%v ack=%v payload %d", l4.PSH, l4.ACK, len(l4.Payload))
+		}
+		return ip, l4, l4.Payload[2:]
+	default:
+		t.Fatalf("transport layer %v", p.TransportLayer())
+	}
+	return nil, nil, nil
+}
+
+func TestRawPacketChecksum(t *testing.T) {
+	for _, c := range []struct {
+		proto    uint8
+		src, dst net.IP
+	}{
+		{protoUDP, net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.53")},
+		{protoUDP, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::53")},
+		{protoTCP, net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.53")},
+		{protoTCP, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::53")},
+		{protoUDP, net.ParseIP("192.0.2.1"), nil},
+	} {
+		tx := pcapTx(true, c.proto, c.src, c.dst, 53, 40000)
+		pkt, err := rawPacket(tx, 1000, 2000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ip, l4, payload := pcapLayers(t, pkt)
+		var msg dns.Msg
+		if err = msg.Unpack(payload); err != nil || len(msg.Answer) != 1 {
+			t.Fatalf("%v unpack dns %v", c, err)
+		}
+
+		//gopacket重新计算长度和校验和后应该和还原的报文完全一致
+		switch v := l4.(type) {
+		case *layers.UDP:
+			v.SetNetworkLayerForChecksum(ip.(gopacket.NetworkLayer))
+		case *layers.TCP:
+			v.SetNetworkLayerForChecksum(ip.(gopacket.NetworkLayer))
+			if v.Seq != 1000 || v.Ack != 2000 {
+				t.Fatalf("tcp got seq %d ack %d", v.Seq, v.Ack)
+			}
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if c.proto == protoTCP {
+			payload = pkt[len(pkt)-len(payload)-2:]
+		}
+		if err = gopacket.SerializeLayers(buf, opts, ip, l4, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf.Bytes(), pkt) {
+			t.Fatalf("%v got\n%x\nwant\n%x", c, pkt, buf.Bytes())
+		}
+	}
+}
+
+func TestRawPacketNonIP(t *testing.T) {
+	tx := pcapTx(true, protoUDP, net.ParseIP("192.0.2.53"), net.ParseIP("192.0.2.1"), 53, 40000)
+	tx.addr = &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}
+	if _, err := rawPacket(tx, 0, 0); err != errTxAddr {
+		t.Fatalf("got %v", err)
+	}
+}
+
+//TestPcapWriterSequence 同一条流上还原的tcp分段seq连续 ack是反方向已经写入的位置
+func TestPcapWriterSequence(t *testing.T) {
+	w := newPcapWriter(&pcapWriterConfig{queue: 1})
+	client, server := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.53")
+
+	q1 := pcapTx(false, protoTCP, client, server, 40000, 53)
+	r1 := pcapTx(true, protoTCP, server, client, 53, 40000)
+	q2 := pcapTx(false, protoTCP, client, server, 40000, 53)
+	other := pcapTx(false, protoTCP, client, server, 40001, 53)
+
+	qn, rn := uint32(len(q1.wire)+2), uint32(len(r1.wire)+2)
+	for i, c := range []struct {
+		tx       *Tx
+		seq, ack uint32
+	}{
+		{q1, 1, 1},
+		{r1, 1, 1 + qn},
+		{q2, 1 + qn, 1 + rn},
+		{other, 1, 1},
+	} {
+		if seq, ack := w.sequence(c.tx); seq != c.seq || ack != c.ack {
+			t.Fatalf("tx %d got seq %d ack %d want %d %d", i, seq, ack, c.seq, c.ack)
+		}
+	}
+
+	if seq, ack := w.sequence(pcapTx(false, protoUDP, client, server, 40000, 53)); seq != 0 || ack != 0 {
+		t.Fatalf("udp got seq %d ack %d", seq, ack)
+	}
+}
+
+func TestPcapWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.pcap")
+	w := newPcapWriter(&pcapWriterConfig{name: "pcap", rotate: rotateConfig{path: path}, queue: 16})
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	//抓包输入直接写入原始报文 包括还原时不会有的ip id和ttl
+	captured := pcapTx(false, protoUDP, net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.53"), 40000, 53)
+	pkt, _ := rawPacket(captured, 0, 0)
+	pkt[4], pkt[5], pkt[8] = 0x12, 0x34, 57
+	captured.pkt = pkt
+
+	tap := pcapTx(true, protoTCP, net.ParseIP("192.0.2.53"), net.ParseIP("192.0.2.1"), 53, 40000)
+	synth, _ := rawPacket(tap, 1, 1)
+
+	for _, tx := range []*Tx{captured, tap, {addr: tap.addr, time: tap.time}} {
+		if err := w.WriteTx(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	pr, err := newPcapReader(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range [][]byte{pkt, synth} {
+		rec, err := pr.Next()
+		if err != nil {
+			t.Fatalf("record %d %v", i, err)
+		}
+
+		if rec.link != linkRaw || rec.ts.UnixNano() != 1700000000123456000 || !bytes.Equal(rec.data, want) {
+			t.Fatalf("record %d got link %d ts %v data %x", i, rec.link, rec.ts, rec.data)
+		}
+	}
+
+	if _, err = pr.Next(); err == nil {
+		t.Fatal("tx without wire written")
+	}
+}
@@ -0,0 +1,451 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/bucket"
+	"github.com/rock-go/rock/lua"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//pdnsConfig 被动dns 从应答中记录 name type data
+type pdnsConfig struct {
+	bucket string //本地bucket名称
+	ttl    int    //last_seen 超过ttl秒的记录在压缩时删除
+	max    int    //最大记录数
+	flush  int    //压缩和落盘间隔 秒
+}
+
+func newPdnsConfig(L *lua.LState, val lua.LValue) *pdnsConfig {
+	cfg := &pdnsConfig{bucket: "dns_pdns", ttl: 30 * 86400, max: 1000000, flush: 60}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "bucket":
+				cfg.bucket = v.String()
+			case "ttl":
+				cfg.ttl = checkInt(L, key, v)
+			case "max":
+				cfg.max = checkInt(L, key, v)
+			case "flush":
+				cfg.flush = checkInt(L, key, v)
+			default:
+				L.RaiseError("pdns config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("pdns must be bool or table , got %s", val.Type().String())
+	}
+
+	return cfg
+}
+
+func (cfg *pdnsConfig) valid() error {
+	if cfg.bucket == "" {
+		return fmt.Errorf("not found pdns bucket")
+	}
+
+	if cfg.ttl <= 0 || cfg.max <= 0 || cfg.flush <= 0 {
+		return fmt.Errorf("invalid pdns ttl %d max %d or flush %d", cfg.ttl, cfg.max, cfg.flush)
+	}
+
+	return nil
+}
+
+type pdnsRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Data  string `json:"data"`
+	First int64  `json:"first_seen"`
+	Last  int64  `json:"last_seen"`
+	Count uint64 `json:"count"`
+}
+
+func (r *pdnsRecord) key() string {
+	return r.Name + "|" + r.Type + "|" + r.Data
+}
+
+func (r *pdnsRecord) table(L *lua.LState) *lua.LTable {
+	tab := L.CreateTable(0, 6)
+	tab.RawSetString("name", lua.S2L(r.Name))
+	tab.RawSetString("type", lua.S2L(r.Type))
+	tab.RawSetString("data", lua.S2L(r.Data))
+	tab.RawSetString("first_seen", lua.LNumber(r.First))
+	tab.RawSetString("last_seen", lua.LNumber(r.Last))
+	tab.RawSetString("count", lua.LNumber(r.Count))
+	return tab
+}
+
+//rdata 去掉记录头部后的数据部分 A/AAAA 统一成ip的字符串
+func rdata(r dns.RR) string {
+	switch v := r.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(r.String(), r.Header().String()))
+}
+
+//pdnsData 数据是域名的记录转小写 TXT等其他记录保留原始大小写
+func pdnsData(r dns.RR) string {
+	switch r.(type) {
+	case *dns.CNAME, *dns.DNAME, *dns.NS, *dns.PTR, *dns.MX, *dns.SRV, *dns.SOA:
+		return normalize(rdata(r))
+	default:
+		return rdata(r)
+	}
+}
+
+//pdns 内存中按name和data建立索引 记录按key分片 定时压缩后只把有变化的分片写入bucket
+//clock是见过的最新的应答时间 离线回放时压缩和过期不使用当前时间
+type pdns struct {
+	mu     sync.RWMutex
+	cfg    *pdnsConfig
+	key    string
+	clock  int64
+	record map[string]*pdnsRecord
+	byName map[string]map[string]*pdnsRecord
+	byData map[string]map[string]*pdnsRecord
+	shard  [bucketShards]map[string]*pdnsRecord
+	dirty  map[int]struct{}
+}
+
+func newPdns(cfg *pdnsConfig, key string) *pdns {
+	p := &pdns{
+		cfg:    cfg,
+		key:    key,
+		record: make(map[string]*pdnsRecord),
+		byName: make(map[string]map[string]*pdnsRecord),
+		byData: make(map[string]map[string]*pdnsRecord),
+		dirty:  make(map[int]struct{}),
+	}
+
+	for i := range p.shard {
+		p.shard[i] = make(map[string]*pdnsRecord)
+	}
+	return p
+}
+
+func pdnsIndex(idx map[string]map[string]*pdnsRecord, key string, r *pdnsRecord) {
+	m, ok := idx[key]
+	if !ok {
+		m = make(map[string]*pdnsRecord)
+		idx[key] = m
+	}
+	m[r.key()] = r
+}
+
+func pdnsUnindex(idx map[string]map[string]*pdnsRecord, key string, r *pdnsRecord) {
+	m, ok := idx[key]
+	if !ok {
+		return
+	}
+
+	delete(m, r.key())
+	if len(m) == 0 {
+		delete(idx, key)
+	}
+}
+
+func (p *pdns) add(r *pdnsRecord) {
+	k := r.key()
+	p.record[k] = r
+	p.shard[shardOf(k)][k] = r
+	pdnsIndex(p.byName, r.Name, r)
+	pdnsIndex(p.byData, r.Data, r)
+}
+
+func (p *pdns) remove(r *pdnsRecord) {
+	k := r.key()
+	delete(p.record, k)
+	delete(p.shard[shardOf(k)], k)
+	pdnsUnindex(p.byName, r.Name, r)
+	pdnsUnindex(p.byData, r.Data, r)
+}
+
+func (p *pdns) touch(r *pdnsRecord) {
+	p.dirty[shardOf(r.key())] = struct{}{}
+}
+
+//observe 记录成功应答中的answer 满了不再新增 只更新已有记录
+func (p *pdns) observe(tx *Tx) {
+	if !tx.msg.Response || tx.msg.Rcode != dns.RcodeSuccess || len(tx.msg.Answer) == 0 {
+		return
+	}
+
+	now := tx.time.Unix()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if now > p.clock {
+		p.clock = now
+	}
+
+	for _, rr := range tx.msg.Answer {
+		r := &pdnsRecord{
+			Name: normalize(rr.Header().Name),
+			Type: dns.TypeToString[rr.Header().Rrtype],
+			Data: pdnsData(rr),
+		}
+
+		if old, ok := p.record[r.key()]; ok {
+			old.Count++
+			if now > old.Last {
+				old.Last = now
+			}
+			p.touch(old)
+			continue
+		}
+
+		if len(p.record) >= p.cfg.max {
+			continue
+		}
+
+		r.First = now
+		r.Last = now
+		r.Count = 1
+		p.add(r)
+		p.touch(r)
+	}
+}
+
+//compact 按clock删除last_seen超过ttl的记录 还没有见过应答时不压缩
+func (p *pdns) compact() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.clock == 0 {
+		return 0
+	}
+
+	expire := p.clock - int64(p.cfg.ttl)
+	n := 0
+	for _, r := range p.record {
+		if r.Last < expire {
+			p.remove(r)
+			p.touch(r)
+			n++
+		}
+	}
+	return n
+}
+
+//load 读取所有分片 单个分片损坏时跳过并返回最后一个错误
+func (p *pdns) load() error {
+	bkt := bucket.Pack(xEnv, p.cfg.bucket)
+
+	var last error
+	for i := 0; i < bucketShards; i++ {
+		data, err := bkt.Value(shardKey(p.key, i))
+		if err != nil {
+			last = err
+			continue
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+
+		var items []*pdnsRecord
+		if err = json.Unmarshal(data, &items); err != nil {
+			last = err
+			continue
+		}
+
+		p.mu.Lock()
+		for _, r := range items {
+			p.add(r)
+		}
+		p.mu.Unlock()
+	}
+	return last
+}
+
+type pdnsShard struct {
+	index int
+	items []pdnsRecord
+	last  int64
+}
+
+//expire 分片在bucket中的过期时间 秒 按分片内最大的last_seen加上ttl 减去clock计算
+func (s *pdnsShard) expire(ttl int, clock int64) int {
+	if len(s.items) == 0 {
+		return ttl
+	}
+
+	if v := s.last + int64(ttl) - clock; v > 0 {
+		return int(v)
+	}
+	return 1
+}
+
+//save 只拷贝有变化的分片 在锁外序列化 写入失败的分片下次重试
+func (p *pdns) save() error {
+	p.mu.Lock()
+	if len(p.dirty) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+
+	shards := make([]pdnsShard, 0, len(p.dirty))
+	for i := range p.dirty {
+		s := pdnsShard{index: i, items: make([]pdnsRecord, 0, len(p.shard[i]))}
+		for _, r := range p.shard[i] {
+			s.items = append(s.items, *r)
+			if r.Last > s.last {
+				s.last = r.Last
+			}
+		}
+		shards = append(shards, s)
+	}
+
+	clock := p.clock
+	p.dirty = make(map[int]struct{})
+	p.mu.Unlock()
+
+	bkt := bucket.Pack(xEnv, p.cfg.bucket)
+
+	var last error
+	for i := range shards {
+		s := &shards[i]
+		data, err := json.Marshal(s.items)
+		if err == nil {
+			err = bkt.Push(shardKey(p.key, s.index), data, s.expire(p.cfg.ttl, clock))
+		}
+
+		if err != nil {
+			last = err
+			p.mu.Lock()
+			p.dirty[s.index] = struct{}{}
+			p.mu.Unlock()
+		}
+	}
+	return last
+}
+
+func (p *pdns) collect(idx map[string]map[string]*pdnsRecord, key string) []pdnsRecord {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var items []pdnsRecord
+	for _, r := range idx[key] {
+		items = append(items, *r)
+	}
+	return items
+}
+
+//IP 解析到这个ip的所有域名
+func (p *pdns) IP(ip string) []pdnsRecord {
+	if v := net.ParseIP(ip); v != nil {
+		ip = v.String()
+	}
+	return p.collect(p.byData, ip)
+}
+
+//Name 这个域名的所有记录
+func (p *pdns) Name(name string) []pdnsRecord {
+	return p.collect(p.byName, normalize(name))
+}
+
+//Since last_seen 不早于ts的记录 最多limit条
+func (p *pdns) Since(ts int64, limit int) []pdnsRecord {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var items []pdnsRecord
+	for _, r := range p.record {
+		if r.Last >= ts {
+			items = append(items, *r)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Last > items[j].Last })
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
+
+func (p *pdns) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.record)
+}
+
+//run 定时压缩和落盘 退出前再写一次
+func (p *pdns) run(m *monitor) {
+	tk := time.NewTicker(time.Duration(p.cfg.flush) * time.Second)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-m.tom.Dying():
+			if err := p.save(); err != nil {
+				xEnv.Errorf("%s pdns save fail %v", m.Name(), err)
+			}
+			return
+
+		case <-tk.C:
+			p.compact()
+			if err := p.save(); err != nil {
+				xEnv.Errorf("%s pdns save fail %v", m.Name(), err)
+			}
+		}
+	}
+}
+
+func pdnsL(L *lua.LState, items []pdnsRecord) int {
+	tab := L.CreateTable(len(items), 0)
+	for i := range items {
+		tab.Append(items[i].table(L))
+	}
+	L.Push(tab)
+	return 1
+}
+
+func (p *pdns) ipL(L *lua.LState) int {
+	return pdnsL(L, p.IP(L.CheckString(1)))
+}
+
+func (p *pdns) nameL(L *lua.LState) int {
+	return pdnsL(L, p.Name(L.CheckString(1)))
+}
+
+func (p *pdns) sinceL(L *lua.LState) int {
+	return pdnsL(L, p.Since(int64(L.CheckInt(1)), L.OptInt(2, 1000)))
+}
+
+func (p *pdns) sizeL(L *lua.LState) int {
+	L.Push(lua.LNumber(p.Len()))
+	return 1
+}
+
+func (p *pdns) Index(L *lua.LState, key string) lua.LValue {
+	switch key {
+	case "ip":
+		return L.NewFunction(p.ipL)
+	case "name":
+		return L.NewFunction(p.nameL)
+	case "since":
+		return L.NewFunction(p.sinceL)
+	case "size":
+		return L.NewFunction(p.sizeL)
+	}
+	return lua.LNil
+}
@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+//pdnsTx 一个成功的应答 www.example.com CNAME edge.example.net A 192.0.2.10
+func pdnsTx(t *testing.T, ts time.Time, answer ...string) *Tx {
+	tx := &Tx{time: ts}
+	tx.msg.SetQuestion("www.Example.com.", dns.TypeA)
+	tx.msg.Response = true
+
+	for _, v := range answer {
+		rr, err := dns.NewRR(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.msg.Answer = append(tx.msg.Answer, rr)
+	}
+	return tx
+}
+
+var pdnsAnswer = []string{
+	"www.example.com. 60 IN CNAME Edge.Example.NET.",
+	"edge.example.net. 60 IN A 192.0.2.10",
+	`www.example.com. 60 IN TXT "Hello World"`,
+}
+
+func TestPdnsQuery(t *testing.T) {
+	p := newPdns(&pdnsConfig{ttl: 3600, max: 100, flush: 60}, "dns")
+
+	ts := time.Unix(1600000000, 0)
+	p.observe(pdnsTx(t, ts, pdnsAnswer...))
+	p.observe(pdnsTx(t, ts.Add(time.Minute), pdnsAnswer...))
+
+	//nxdomain和query不记录
+	nx := pdnsTx(t, ts, "other.example.com. 60 IN A 192.0.2.11")
+	nx.msg.Rcode = dns.RcodeNameError
+	p.observe(nx)
+
+	if n := p.Len(); n != 3 {
+		t.Fatalf("got %d records", n)
+	}
+
+	r := p.IP("192.0.2.10")
+	if len(r) != 1 || r[0].Name != "edge.example.net" || r[0].Count != 2 || r[0].First != ts.Unix() || r[0].Last != ts.Unix()+60 {
+		t.Fatalf("ip got %+v", r)
+	}
+
+	//CNAME的data转小写 TXT保留原始大小写
+	for _, r := range p.Name("WWW.example.com.") {
+		switch r.Type {
+		case "CNAME":
+			if r.Data != "edge.example.net" {
+				t.Fatalf("cname got %s", r.Data)
+			}
+		case "TXT":
+			if r.Data != `"Hello World"` {
+				t.Fatalf("txt got %s", r.Data)
+			}
+		default:
+			t.Fatalf("name got %+v", r)
+		}
+	}
+
+	if r = p.Since(ts.Unix()+60, 2); len(r) != 2 {
+		t.Fatalf("since got %d records", len(r))
+	}
+
+	if r = p.Since(ts.Unix()+61, 0); len(r) != 0 {
+		t.Fatalf("since got %d records", len(r))
+	}
+}
+
+func TestPdnsMax(t *testing.T) {
+	p := newPdns(&pdnsConfig{ttl: 3600, max: 2, flush: 60}, "dns")
+
+	ts := time.Unix(1600000000, 0)
+	p.observe(pdnsTx(t, ts, pdnsAnswer...))
+	if n := p.Len(); n != 2 {
+		t.Fatalf("got %d records", n)
+	}
+
+	//满了以后已有的记录仍然更新
+	p.observe(pdnsTx(t, ts.Add(time.Minute), pdnsAnswer...))
+	for _, r := range p.Since(0, 0) {
+		if r.Count != 2 {
+			t.Fatalf("got %+v", r)
+		}
+	}
+}
+
+func TestPdnsCompact(t *testing.T) {
+	p := newPdns(&pdnsConfig{ttl: 3600, max: 100, flush: 60}, "dns")
+
+	//回放几年前的报文 按报文时间压缩 不会全部删除
+	ts := time.Unix(1600000000, 0)
+	p.observe(pdnsTx(t, ts, pdnsAnswer[0]))
+	p.observe(pdnsTx(t, ts.Add(30*time.Minute), pdnsAnswer[1]))
+	if n := p.compact(); n != 0 || p.Len() != 2 {
+		t.Fatalf("compact removed %d records", n)
+	}
+
+	//报文时间前进超过ttl CNAME过期 A还在ttl内
+	p.observe(pdnsTx(t, ts.Add(61*time.Minute), pdnsAnswer[2]))
+	if n := p.compact(); n != 1 || p.Len() != 2 {
+		t.Fatalf("compact removed %d records left %d", n, p.Len())
+	}
+
+	if r := p.Name("www.example.com"); len(r) != 1 || r[0].Type != "TXT" {
+		t.Fatalf("name got %+v", r)
+	}
+
+	if r := p.IP("192.0.2.10"); len(r) != 1 {
+		t.Fatalf("ip got %+v", r)
+	}
+}
+
+func TestPdnsShardExpire(t *testing.T) {
+	s := pdnsShard{items: make([]pdnsRecord, 1), last: 1600000000}
+
+	if ttl := s.expire(3600, 1600000000+600); ttl != 3000 {
+		t.Fatalf("got ttl %d", ttl)
+	}
+
+	if ttl := s.expire(3600, 1600000000+7200); ttl != 1 {
+		t.Fatalf("expired shard got ttl %d", ttl)
+	}
+
+	if ttl := (&pdnsShard{}).expire(3600, 1600000000); ttl != 3600 {
+		t.Fatalf("empty shard got ttl %d", ttl)
+	}
+}
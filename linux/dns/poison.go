@@ -0,0 +1,252 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/rock-go/rock/lua"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+//poisonConfig mDNS LLMNR NBNS 投毒检测 类似Responder的主机会应答大量自己没有通告过的名称
+type poisonConfig struct {
+	window int //统计窗口 秒
+	names  int //同一个应答方应答的非通告名称数量
+	wait   int //query和应答之间允许的间隔 秒
+	max    int //跟踪的名称和主机上限
+}
+
+func newPoisonConfig(L *lua.LState, val lua.LValue) *poisonConfig {
+	cfg := &poisonConfig{window: 300, names: 3, wait: 3, max: 65536}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "window":
+				cfg.window = checkInt(L, key, v)
+			case "names":
+				cfg.names = checkInt(L, key, v)
+			case "wait":
+				cfg.wait = checkInt(L, key, v)
+			case "max":
+				cfg.max = checkInt(L, key, v)
+			default:
+				L.RaiseError("poison config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("poison must be bool or table , got %s", val.Type().String())
+	}
+
+	return cfg
+}
+
+func (cfg *poisonConfig) valid() error {
+	if cfg.window <= 0 || cfg.names <= 0 || cfg.wait <= 0 || cfg.max <= 0 {
+		return fmt.Errorf("invalid poison config")
+	}
+	return nil
+}
+
+type poisonStat struct {
+	names   map[string]struct{}
+	alerted bool
+}
+
+//poison 记录组播和广播的query 主机通告过的名称 以及每个应答方应答过的名称
+type poison struct {
+	mu        sync.Mutex
+	cfg       *poisonConfig
+	begin     time.Time
+	query     map[string]time.Time
+	advertise map[string]map[string]struct{}
+	responder map[string]*poisonStat
+	reported  map[string]struct{}
+	sweep     time.Time
+}
+
+func newPoison(cfg *poisonConfig) *poison {
+	p := &poison{
+		cfg:       cfg,
+		query:     make(map[string]time.Time),
+		advertise: make(map[string]map[string]struct{}),
+	}
+	p.reset(time.Time{})
+	return p
+}
+
+//reset 窗口结束 清空应答方的统计 等待应答的query跨窗口保留 只按wait过期
+func (p *poison) reset(now time.Time) {
+	p.begin = now
+	p.responder = make(map[string]*poisonStat)
+	p.reported = make(map[string]struct{})
+}
+
+//expire 每秒最多一次 删除超过wait秒的query
+func (p *poison) expire(now time.Time) {
+	if now.Sub(p.sweep) < time.Second {
+		return
+	}
+	p.sweep = now
+
+	wait := time.Duration(p.cfg.wait) * time.Second
+	for key, at := range p.query {
+		if now.Sub(at) > wait {
+			delete(p.query, key)
+		}
+	}
+}
+
+//names 组播协议中的名称 nbns 还原成NetBIOS名称
+func poisonName(svc, name string) string {
+	if svc == "nbns" {
+		if nb, _, ok := nbnsName(name); ok {
+			return normalize(nb)
+		}
+	}
+	return normalize(name)
+}
+
+func (p *poison) advertised(host, name string) {
+	names, ok := p.advertise[host]
+	if !ok {
+		if len(p.advertise) >= p.cfg.max {
+			p.advertise = make(map[string]map[string]struct{})
+		}
+		names = make(map[string]struct{})
+		p.advertise[host] = names
+	}
+
+	if len(names) < 256 {
+		names[name] = struct{}{}
+	}
+}
+
+func (p *poison) isAdvertised(host, name string) bool {
+	_, ok := p.advertise[host][name]
+	return ok
+}
+
+func (p *poison) event(m *monitor, tx *Tx, reason, responder, name string) *Event {
+	return newEvent(m.Name(), "poison", tx.time).
+		Set("service", tx.service).
+		Set("reason", reason).
+		Set("responder", responder).
+		Set("name", name).
+		Set("client", tx.Client()).
+		Set("answer", ipStrings(tx.AnswerIP()))
+}
+
+func ipStrings(ips []net.IP) []string {
+	ss := make([]string, len(ips))
+	for i, ip := range ips {
+		ss[i] = ip.String()
+	}
+	return ss
+}
+
+//inspect 无人查询的应答每个名称告警一次 应答过多非通告名称的主机每个窗口告警一次
+func (p *poison) inspect(m *monitor, tx *Tx) []*Event {
+	if tx.service == "dns" {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if tx.time.Sub(p.begin) >= time.Duration(p.cfg.window)*time.Second {
+		p.reset(tx.time)
+	}
+	p.expire(tx.time)
+
+	host := tx.Remote()
+
+	if !tx.msg.Response {
+		//nbns 名称注册和刷新 相当于通告自己的名称
+		switch tx.msg.Opcode {
+		case 5, 8, 9:
+			for _, q := range tx.msg.Question {
+				p.advertised(host, poisonName(tx.service, q.Name))
+			}
+			return nil
+		}
+
+		if len(p.query) >= p.cfg.max {
+			return nil
+		}
+
+		for _, q := range tx.msg.Question {
+			p.query[tx.service+"|"+poisonName(tx.service, q.Name)] = tx.time
+		}
+		return nil
+	}
+
+	var evs []*Event
+	wait := time.Duration(p.cfg.wait) * time.Second
+
+	names := make(map[string]bool)
+	for _, rr := range tx.msg.Answer {
+		names[poisonName(tx.service, rr.Header().Name)] = true
+	}
+
+	for name := range names {
+		at, queried := p.query[tx.service+"|"+name]
+		if queried && tx.time.Sub(at) > wait {
+			queried = false
+		}
+
+		if !queried {
+			//mDNS 主机上线时会主动通告自己的名称
+			if tx.service == "mdns" {
+				p.advertised(host, name)
+				continue
+			}
+
+			key := host + "|" + name
+			if _, ok := p.reported[key]; ok || len(p.reported) >= p.cfg.max {
+				continue
+			}
+			p.reported[key] = struct{}{}
+			evs = append(evs, p.event(m, tx, "unsolicited", host, name))
+			continue
+		}
+
+		if p.isAdvertised(host, name) {
+			continue
+		}
+
+		st, ok := p.responder[host]
+		if !ok {
+			if len(p.responder) >= p.cfg.max {
+				continue
+			}
+			st = &poisonStat{names: make(map[string]struct{})}
+			p.responder[host] = st
+		}
+
+		st.names[name] = struct{}{}
+		if st.alerted || len(st.names) < p.cfg.names {
+			continue
+		}
+
+		st.alerted = true
+		sample := make([]string, 0, len(st.names))
+		for n := range st.names {
+			sample = append(sample, n)
+		}
+		sort.Strings(sample)
+		evs = append(evs, p.event(m, tx, "many_names", host, name).
+			Set("names", sample).
+			Set("window", p.cfg.window))
+	}
+
+	return evs
+}
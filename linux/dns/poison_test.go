@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+//nbEncode NetBIOS名称的first-level编码 补齐15个字节加上后缀
+func nbEncode(name string, suffix byte) string {
+	b := []byte(name)
+	for len(b) < 15 {
+		b = append(b, ' ')
+	}
+	b = append(b, suffix)
+
+	out := make([]byte, 0, 32)
+	for _, c := range b {
+		out = append(out, 'A'+(c>>4), 'A'+(c&15))
+	}
+	return string(out) + "."
+}
+
+//poisonTx 组播的query和应答 应答带一个A记录 at是相对的毫秒数
+func poisonTx(svc, name, from, answer string, at int) *Tx {
+	tx := &Tx{
+		service: svc,
+		addr:    &net.IPAddr{IP: net.ParseIP(from)},
+		daddr:   net.ParseIP("10.0.0.5"),
+		time:    time.Unix(1700000000, 0).Add(time.Duration(at) * time.Millisecond),
+	}
+	tx.msg.SetQuestion(name, dns.TypeA)
+
+	if answer != "" {
+		tx.msg.Response = true
+		tx.msg.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP(answer)}}
+	}
+	return tx
+}
+
+func TestPoisonManyNames(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	p := newPoison(&poisonConfig{window: 300, names: 3, wait: 3, max: 100})
+
+	var evs []*Event
+	for i, name := range []string{"fileserv.", "wpad.", "printer.", "intranet."} {
+		p.inspect(m, poisonTx("llmnr", name, "10.0.0.5", "", i*1000))
+		evs = append(evs, p.inspect(m, poisonTx("llmnr", name, "10.0.0.66", "10.0.0.66", i*1000+10))...)
+	}
+
+	if len(evs) != 1 {
+		t.Fatalf("got %d events", len(evs))
+	}
+
+	if v, _ := evs[0].Get("reason"); v != "many_names" {
+		t.Fatalf("reason got %v", v)
+	}
+
+	if v, _ := evs[0].Get("names"); len(v.([]string)) != 3 || v.([]string)[0] != "fileserv" {
+		t.Fatalf("names got %v", v)
+	}
+
+	//主机应答自己通告过的名称不计数
+	p = newPoison(&poisonConfig{window: 300, names: 2, wait: 3, max: 100})
+	if len(p.inspect(m, poisonTx("mdns", "mac.local.", "10.0.0.7", "10.0.0.7", 0))) != 0 {
+		t.Fatal("mdns announcement alerted")
+	}
+
+	p.inspect(m, poisonTx("mdns", "mac.local.", "10.0.0.5", "", 100))
+	p.inspect(m, poisonTx("mdns", "other.local.", "10.0.0.5", "", 100))
+	if evs = p.inspect(m, poisonTx("mdns", "mac.local.", "10.0.0.7", "10.0.0.7", 200)); len(evs) != 0 {
+		t.Fatal("advertised name counted")
+	}
+	if evs = p.inspect(m, poisonTx("mdns", "other.local.", "10.0.0.7", "10.0.0.7", 200)); len(evs) != 0 {
+		t.Fatal("single name alerted")
+	}
+}
+
+func TestPoisonNbns(t *testing.T) {
+	if n, s, ok := nbnsName(nbEncode("WPAD", 0)); !ok || n != "WPAD" || s != 0 {
+		t.Fatalf("got %s %d %v", n, s, ok)
+	}
+
+	m := &monitor{cfg: &config{name: "dns"}}
+	p := newPoison(&poisonConfig{window: 300, names: 3, wait: 3, max: 100})
+
+	//nbns 的NB记录和NIMLOC类型号相同 打包再解析
+	var r dns.Msg
+	r.SetQuestion(nbEncode("CORP-DC", 0x20), 32)
+	r.Response = true
+	r.Answer = []dns.RR{&dns.NIMLOC{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: 32, Class: dns.ClassINET, Ttl: 300}, Locator: "00000a000042"}}
+	wire, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := &Tx{service: "nbns", addr: &net.IPAddr{IP: net.ParseIP("10.0.0.66")}, daddr: net.ParseIP("10.0.0.5"), time: time.Unix(1700000000, 0)}
+	if err = tx.msg.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+
+	evs := p.inspect(m, tx)
+	if len(evs) != 1 || tx.Qname() != "CORP-DC" || tx.AnswerIP()[0].String() != "10.0.0.66" {
+		t.Fatalf("got %d events qname %s answer %v", len(evs), tx.Qname(), tx.AnswerIP())
+	}
+
+	if v, _ := evs[0].Get("reason"); v != "unsolicited" {
+		t.Fatalf("reason got %v", v)
+	}
+
+	if v, _ := evs[0].Get("name"); v != "corp-dc" {
+		t.Fatalf("name got %v", v)
+	}
+
+	//同一个名称只告警一次
+	tx.time = tx.time.Add(time.Second)
+	if len(p.inspect(m, tx)) != 0 {
+		t.Fatal("unsolicited alerted twice")
+	}
+}
+
+//TestPoisonWindow 应答方的统计按窗口清空 等待应答的query跨窗口保留
+func TestPoisonWindow(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	p := newPoison(&poisonConfig{window: 10, names: 3, wait: 3, max: 100})
+
+	//窗口在10秒结束 9.5秒的query在10.5秒收到应答
+	p.inspect(m, poisonTx("llmnr", "fileserv.", "10.0.0.5", "", 0))
+	p.inspect(m, poisonTx("llmnr", "fileserv.", "10.0.0.5", "", 9500))
+	if evs := p.inspect(m, poisonTx("llmnr", "fileserv.", "10.0.0.6", "10.0.0.6", 10500)); len(evs) != 0 {
+		t.Fatal("answer across window alerted")
+	}
+
+	//超过wait的应答算无人查询
+	evs := p.inspect(m, poisonTx("llmnr", "fileserv.", "10.0.0.6", "10.0.0.6", 20000))
+	if len(evs) != 1 {
+		t.Fatalf("got %d events after wait", len(evs))
+	}
+	if v, _ := evs[0].Get("reason"); v != "unsolicited" {
+		t.Fatalf("reason got %v", v)
+	}
+
+	//跨窗口的名称不累计 新窗口里可以再告警
+	var alerts []int
+	for i, name := range []string{"a.", "b.", "c.", "d.", "e.", "f."} {
+		at := 35000 + i*4000
+		p.inspect(m, poisonTx("llmnr", name, "10.0.0.5", "", at))
+		if len(p.inspect(m, poisonTx("llmnr", name, "10.0.0.66", "10.0.0.66", at+10))) != 0 {
+			alerts = append(alerts, i)
+		}
+	}
+
+	//窗口从35秒和47秒开始 a b c 在第一个窗口 d e f 在第二个
+	if len(alerts) != 2 || alerts[0] != 2 || alerts[1] != 5 {
+		t.Fatalf("alerts at %v", alerts)
+	}
+}
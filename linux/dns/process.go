@@ -0,0 +1,244 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var containerRe = regexp.MustCompile(`[0-9a-f]{64}`)
+
+//procInfo 发起dns请求的本地进程
+type procInfo struct {
+	Pid       int
+	Uid       int
+	Exe       string
+	Cmdline   string
+	Cgroup    string
+	Container string
+}
+
+//procResolver 通过 /proc/net/{udp,tcp} 找到端口对应的inode 再通过 /proc/*/fd 找到进程
+type procResolver struct {
+	root  string
+	ttl   time.Duration
+	cache *lru
+
+	mu      sync.Mutex
+	inodes  map[uint64]int
+	scanned time.Time
+
+	locals  map[string]bool
+	refresh time.Time
+	addrs   func() ([]net.Addr, error) //本机地址 默认读取网卡 测试时替换
+}
+
+func newProcResolver(root string, ttl time.Duration) *procResolver {
+	return &procResolver{
+		root:  root,
+		ttl:   ttl,
+		cache: newLru(4096),
+		addrs: net.InterfaceAddrs,
+	}
+}
+
+//local 判断地址是否是本机地址 每30秒刷新一次
+func (pr *procResolver) local(ip net.IP) bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if time.Since(pr.refresh) > 30*time.Second {
+		pr.refresh = time.Now()
+		pr.locals = make(map[string]bool)
+		if addrs, err := pr.addrs(); err == nil {
+			for _, addr := range addrs {
+				if ipn, ok := addr.(*net.IPNet); ok {
+					pr.locals[ipn.IP.String()] = true
+				}
+			}
+		}
+	}
+
+	return pr.locals[ip.String()]
+}
+
+//Lookup 查询本地端口对应的进程 结果短暂缓存
+func (pr *procResolver) Lookup(proto uint8, port uint16) *procInfo {
+	name := "udp"
+	if proto == protoTCP {
+		name = "tcp"
+	}
+
+	key := name + ":" + strconv.Itoa(int(port))
+	if v, ok := pr.cache.get(key); ok {
+		return v.(*procInfo)
+	}
+
+	var info *procInfo
+	inode, uid := pr.inode(name, port)
+	if inode != 0 {
+		if pid := pr.pid(inode); pid != 0 {
+			info = pr.process(pid)
+			if info.Uid < 0 {
+				info.Uid = uid
+			}
+		}
+	}
+
+	pr.cache.set(key, info, pr.ttl)
+	return info
+}
+
+func (pr *procResolver) inode(name string, port uint16) (uint64, int) {
+	for _, file := range []string{name, name + "6"} {
+		if inode, uid := pr.scanNet(filepath.Join(pr.root, "net", file), port); inode != 0 {
+			return inode, uid
+		}
+	}
+	return 0, -1
+}
+
+//scanNet 解析 /proc/net/udp 格式 sl local_address rem_address st ... uid timeout inode
+func (pr *procResolver) scanNet(path string, port uint16) (uint64, int) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, -1
+	}
+	defer fd.Close()
+
+	want := strings.ToUpper(strconv.FormatUint(uint64(port)|0x10000, 16)[1:])
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		idx := strings.LastIndexByte(fields[1], ':')
+		if idx < 0 || fields[1][idx+1:] != want {
+			continue
+		}
+
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || inode == 0 {
+			continue
+		}
+
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			uid = -1
+		}
+		return inode, uid
+	}
+
+	return 0, -1
+}
+
+//pid 从inode找进程 未命中时重新扫描所有进程的fd 1秒内最多扫描一次
+func (pr *procResolver) pid(inode uint64) int {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pid, ok := pr.inodes[inode]; ok {
+		return pid
+	}
+
+	if time.Since(pr.scanned) < time.Second {
+		return 0
+	}
+
+	pr.scanned = time.Now()
+	pr.inodes = pr.scanFd()
+	return pr.inodes[inode]
+}
+
+func (pr *procResolver) scanFd() map[uint64]int {
+	inodes := make(map[uint64]int)
+
+	dirs, err := os.ReadDir(pr.root)
+	if err != nil {
+		return inodes
+	}
+
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+
+		fdDir := filepath.Join(pr.root, dir.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[8:], "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			inodes[inode] = pid
+		}
+	}
+
+	return inodes
+}
+
+func (pr *procResolver) process(pid int) *procInfo {
+	dir := filepath.Join(pr.root, strconv.Itoa(pid))
+	info := &procInfo{Pid: pid, Uid: -1}
+
+	info.Exe, _ = os.Readlink(filepath.Join(dir, "exe"))
+
+	if cmd, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		info.Cmdline = string(bytes.TrimSpace(bytes.ReplaceAll(bytes.TrimRight(cmd, "\x00"), []byte{0}, []byte{' '})))
+	}
+
+	if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			if !strings.HasPrefix(line, "Uid:") {
+				continue
+			}
+
+			if fields := strings.Fields(line[4:]); len(fields) > 0 {
+				if uid, err := strconv.Atoi(fields[0]); err == nil {
+					info.Uid = uid
+				}
+			}
+			break
+		}
+	}
+
+	if cgroup, err := os.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+		for _, line := range strings.Split(strings.TrimSpace(string(cgroup)), "\n") {
+			parts := strings.SplitN(line, ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+
+			if info.Cgroup == "" || parts[0] == "0" {
+				info.Cgroup = parts[2]
+			}
+
+			if id := containerRe.FindString(parts[2]); id != "" {
+				info.Container = id
+			}
+		}
+	}
+
+	return info
+}
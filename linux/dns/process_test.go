@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testContainer = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+//procFixture 伪造的procfs udp 8080端口属于42号进程 tcp6 443端口属于43号进程
+func procFixture(t *testing.T) string {
+	root := t.TempDir()
+
+	files := map[string]string{
+		"net/udp": "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+			"   0: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 999 2 0000000000000000 0\n" +
+			"   1: 0F02000A:1F90 08080808:0035 01 00000000:00000000 00:00000000 00000000  1000        0 12345 2 0000000000000000 0\n",
+		"net/udp6": "  sl  local_address remote_address st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n",
+		"net/tcp":  "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n",
+		"net/tcp6": "  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+			"   0: 00000000000000000000000001000000:01BB 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000   33        0 222 1 0000000000000000 100 0 0 10 0\n",
+		"42/cmdline": "dig\x00example.com\x00",
+		"42/status":  "Name:\tdig\nUid:\t1001\t1001\t1001\t1001\n",
+		"42/cgroup":  "12:cpu:/docker/" + testContainer + "\n0::/system.slice/docker-" + testContainer + ".scope\n",
+		"43/cmdline": "nginx: worker process\x00",
+	}
+
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"42/exe":  "/usr/bin/dig",
+		"42/fd/0": "/dev/null",
+		"42/fd/3": "socket:[12345]",
+		"43/exe":  "/usr/sbin/nginx",
+		"43/fd/7": "socket:[222]",
+		"self":    "42",
+	}
+
+	for name, target := range links {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func TestProcResolverLookup(t *testing.T) {
+	pr := newProcResolver(procFixture(t), time.Minute)
+
+	info := pr.Lookup(protoUDP, 8080)
+	if info == nil {
+		t.Fatal("udp 8080 not found")
+	}
+
+	if info.Pid != 42 || info.Exe != "/usr/bin/dig" || info.Cmdline != "dig example.com" {
+		t.Fatalf("udp 8080 got %+v", info)
+	}
+
+	//status中的uid优先于/proc/net中的uid
+	if info.Uid != 1001 {
+		t.Fatalf("udp 8080 uid got %d", info.Uid)
+	}
+
+	if info.Cgroup != "/system.slice/docker-"+testContainer+".scope" || info.Container != testContainer {
+		t.Fatalf("udp 8080 cgroup got %s container %s", info.Cgroup, info.Container)
+	}
+
+	info = pr.Lookup(protoTCP, 443)
+	if info == nil {
+		t.Fatal("tcp6 443 not found")
+	}
+
+	//没有status时使用/proc/net中的uid
+	if info.Pid != 43 || info.Uid != 33 || info.Cmdline != "nginx: worker process" || info.Container != "" {
+		t.Fatalf("tcp6 443 got %+v", info)
+	}
+
+	if info := pr.Lookup(protoUDP, 53); info != nil {
+		t.Fatalf("udp 53 inode has no process got %+v", info)
+	}
+
+	if info := pr.Lookup(protoTCP, 8080); info != nil {
+		t.Fatalf("tcp 8080 got %+v", info)
+	}
+}
+
+func TestProcResolverCache(t *testing.T) {
+	root := procFixture(t)
+	pr := newProcResolver(root, time.Minute)
+
+	if info := pr.Lookup(protoUDP, 8080); info == nil || info.Pid != 42 {
+		t.Fatalf("udp 8080 got %+v", info)
+	}
+
+	//缓存期内不再读取procfs
+	if err := os.RemoveAll(filepath.Join(root, "net")); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := pr.Lookup(protoUDP, 8080); info == nil || info.Pid != 42 {
+		t.Fatalf("cached udp 8080 got %+v", info)
+	}
+}
+
+func TestProcResolverLocal(t *testing.T) {
+	pr := newProcResolver(t.TempDir(), time.Minute)
+
+	calls := 0
+	pr.addrs = func() ([]net.Addr, error) {
+		calls++
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("10.0.2.15"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPAddr{IP: net.ParseIP("192.0.2.1")},
+		}, nil
+	}
+
+	for ip, want := range map[string]bool{"10.0.2.15": true, "fe80::1": true, "192.0.2.1": false, "8.8.8.8": false} {
+		if got := pr.local(net.ParseIP(ip)); got != want {
+			t.Fatalf("local %s got %v", ip, got)
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("addrs refresh %d times", calls)
+	}
+}
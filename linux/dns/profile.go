@@ -0,0 +1,540 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/lua"
+	"math"
+	"sync"
+	"time"
+)
+
+//profileConfig 按客户端统计最近window秒的滑动窗口内的行为 和自己的历史基线比较 同时检查固定阈值
+type profileConfig struct {
+	window    int     //统计窗口 秒
+	history   int     //基线指数加权的系数 alpha=2/(history+1) 大约相当于最近history个窗口
+	learn     int     //学习的窗口数 之前只检查固定阈值
+	deviation float64 //超过基线均值多少个标准差告警
+	min       int     //窗口内query或应答少于min时不检查
+	queries   int     //固定阈值 窗口内的query数 0不检查
+	unique    int     //窗口内不同的qname数
+	parents   int     //窗口内不同的注册域名数
+	nxdomain  float64 //nxdomain应答比例
+	servfail  float64 //servfail应答比例
+	clients   int     //跟踪的客户端上限
+}
+
+func newProfileConfig(L *lua.LState, val lua.LValue) *profileConfig {
+	cfg := &profileConfig{window: 60, history: 60, learn: 10, deviation: 4, min: 50,
+		queries: 6000, unique: 2000, parents: 1000, nxdomain: 0.6, servfail: 0.6, clients: 65536}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "window":
+				cfg.window = checkInt(L, key, v)
+			case "history":
+				cfg.history = checkInt(L, key, v)
+			case "learn":
+				cfg.learn = checkInt(L, key, v)
+			case "deviation":
+				cfg.deviation = float64(checkNumber(L, key, v))
+			case "min":
+				cfg.min = checkInt(L, key, v)
+			case "queries":
+				cfg.queries = checkInt(L, key, v)
+			case "unique":
+				cfg.unique = checkInt(L, key, v)
+			case "parents":
+				cfg.parents = checkInt(L, key, v)
+			case "nxdomain":
+				cfg.nxdomain = float64(checkNumber(L, key, v))
+			case "servfail":
+				cfg.servfail = float64(checkNumber(L, key, v))
+			case "clients":
+				cfg.clients = checkInt(L, key, v)
+			default:
+				L.RaiseError("profile config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("profile must be bool or table , got %s", val.Type().String())
+	}
+
+	return cfg
+}
+
+func (cfg *profileConfig) valid() error {
+	if cfg.window <= 0 || cfg.history <= 0 || cfg.learn < 0 || cfg.min < 0 || cfg.clients <= 0 {
+		return fmt.Errorf("invalid profile config")
+	}
+
+	if cfg.deviation <= 0 {
+		return fmt.Errorf("invalid profile deviation %v", cfg.deviation)
+	}
+
+	if cfg.queries < 0 || cfg.unique < 0 || cfg.parents < 0 || cfg.nxdomain < 0 || cfg.nxdomain > 1 ||
+		cfg.servfail < 0 || cfg.servfail > 1 {
+		return fmt.Errorf("invalid profile threshold")
+	}
+	return nil
+}
+
+//profileMaxUnique 每个窗口记录的qname和注册域名上限 超过后不再增加
+const profileMaxUnique = 65536
+
+//profileSlots 滑动窗口分成的子窗口数 窗口每次滑动一个子窗口 window/profileSlots秒
+const profileSlots = 10
+
+//基线比较的指标
+const (
+	metricQueries = iota
+	metricUnique
+	metricParents
+	metricNxdomain
+	metricServfail
+	metricCount
+)
+
+var metricName = [metricCount]string{"queries", "unique", "parents", "nxdomain_rate", "servfail_rate"}
+
+//baseline 指数加权移动平均(EWMA)的均值和方差 n是计入的窗口数
+type baseline struct {
+	mean float64
+	vari float64
+	n    int
+}
+
+func (b *baseline) add(alpha, v float64) {
+	b.n++
+	if b.n == 1 {
+		b.mean = v
+		return
+	}
+
+	diff := v - b.mean
+	b.mean += alpha * diff
+	b.vari = (1 - alpha) * (b.vari + alpha*diff*diff)
+}
+
+func (b *baseline) stddev() float64 {
+	return math.Sqrt(b.vari)
+}
+
+//profileSlot 一个子窗口的计数 epoch是子窗口的编号
+type profileSlot struct {
+	epoch     int64
+	queries   int
+	responses int
+	nxdomain  int
+	servfail  int
+	names     map[string]struct{}
+	parents   map[string]struct{}
+	qtype     map[string]int
+}
+
+//clientProfile 子窗口组成的环 计数是所有子窗口的合计 names和parents记录出现在几个子窗口中
+//begin是下一个计入基线的窗口的开始 alerted是每个指标最后告警的时间
+type clientProfile struct {
+	first     time.Time
+	last      time.Time
+	begin     time.Time
+	epoch     int64
+	slots     [profileSlots]profileSlot
+	queries   int
+	responses int
+	nxdomain  int
+	servfail  int
+	names     map[string]int
+	parents   map[string]int
+	qtype     map[string]int
+	alerted   [metricCount]time.Time
+	base      [metricCount]baseline
+}
+
+func slotWidth(cfg *profileConfig) time.Duration {
+	return time.Duration(cfg.window) * time.Second / profileSlots
+}
+
+func newClientProfile(cfg *profileConfig, now time.Time) *clientProfile {
+	width := slotWidth(cfg)
+	epoch := now.UnixNano() / int64(width)
+
+	p := &clientProfile{first: now, epoch: epoch,
+		begin:   time.Unix(0, epoch*int64(width)),
+		names:   make(map[string]int),
+		parents: make(map[string]int),
+		qtype:   make(map[string]int),
+	}
+	p.slots[epoch%profileSlots].epoch = epoch
+	return p
+}
+
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+//values 当前滑动窗口的指标
+func (p *clientProfile) values() [metricCount]float64 {
+	return [metricCount]float64{
+		float64(p.queries),
+		float64(len(p.names)),
+		float64(len(p.parents)),
+		rate(p.nxdomain, p.responses),
+		rate(p.servfail, p.responses),
+	}
+}
+
+//enough 数量太少的窗口不检查 也不计入比例的基线
+func (p *clientProfile) enough(metric, min int) bool {
+	if metric == metricNxdomain || metric == metricServfail {
+		return p.responses >= min
+	}
+	return p.queries >= min
+}
+
+func release(set map[string]int, keys map[string]struct{}) {
+	for k := range keys {
+		if set[k]--; set[k] <= 0 {
+			delete(set, k)
+		}
+	}
+}
+
+//drop 从合计中减去滑出窗口的子窗口
+func (p *clientProfile) drop(slot *profileSlot) {
+	p.queries -= slot.queries
+	p.responses -= slot.responses
+	p.nxdomain -= slot.nxdomain
+	p.servfail -= slot.servfail
+	release(p.names, slot.names)
+	release(p.parents, slot.parents)
+
+	for k, n := range slot.qtype {
+		if p.qtype[k] -= n; p.qtype[k] <= 0 {
+			delete(p.qtype, k)
+		}
+	}
+	*slot = profileSlot{}
+}
+
+//advance 滑动到now所在的子窗口 乱序到达的旧报文计入当前子窗口
+func (p *clientProfile) advance(width time.Duration, now time.Time) {
+	epoch := now.UnixNano() / int64(width)
+	if epoch <= p.epoch {
+		return
+	}
+
+	from := p.epoch + 1
+	if epoch-from >= profileSlots {
+		from = epoch - profileSlots + 1
+	}
+
+	for e := from; e <= epoch; e++ {
+		slot := &p.slots[e%profileSlots]
+		p.drop(slot)
+		slot.epoch = e
+	}
+	p.epoch = epoch
+}
+
+//roll 每过一个window 把窗口结束时的滑动窗口计入基线 中间没有流量的窗口按0计入 最多history个
+func (p *clientProfile) roll(cfg *profileConfig, now time.Time) {
+	window := time.Duration(cfg.window) * time.Second
+	width := slotWidth(cfg)
+	if now.Sub(p.begin) < window {
+		p.advance(width, now)
+		return
+	}
+
+	//滑到窗口的最后一个子窗口 这时的合计就是[begin , begin+window)
+	p.advance(width, p.begin.Add(window-width))
+
+	alpha := 2 / float64(cfg.history+1)
+	vals := p.values()
+	for i := range p.base {
+		if i == metricNxdomain || i == metricServfail {
+			if p.enough(i, cfg.min) {
+				p.base[i].add(alpha, vals[i])
+			}
+			continue
+		}
+		p.base[i].add(alpha, vals[i])
+	}
+
+	idle := int(now.Sub(p.begin)/window) - 1
+	if idle > cfg.history {
+		idle = cfg.history
+	}
+
+	for n := 0; n < idle; n++ {
+		for i := metricQueries; i <= metricParents; i++ {
+			p.base[i].add(alpha, 0)
+		}
+	}
+
+	p.begin = p.begin.Add(now.Sub(p.begin) / window * window)
+	p.advance(width, now)
+}
+
+func hold(set map[string]int, keys *map[string]struct{}, k string) {
+	if _, ok := (*keys)[k]; ok {
+		return
+	}
+
+	if _, ok := set[k]; !ok && len(set) >= profileMaxUnique {
+		return
+	}
+
+	if *keys == nil {
+		*keys = make(map[string]struct{})
+	}
+	(*keys)[k] = struct{}{}
+	set[k]++
+}
+
+func (p *clientProfile) observe(tx *Tx) {
+	p.last = tx.time
+	slot := &p.slots[p.epoch%profileSlots]
+
+	if tx.msg.Response {
+		p.responses++
+		slot.responses++
+		switch tx.msg.Rcode {
+		case dns.RcodeNameError:
+			p.nxdomain++
+			slot.nxdomain++
+		case dns.RcodeServerFailure:
+			p.servfail++
+			slot.servfail++
+		}
+		return
+	}
+
+	p.queries++
+	slot.queries++
+	q, ok := tx.question()
+	if !ok {
+		return
+	}
+
+	qtype := dns.TypeToString[q.Qtype]
+	p.qtype[qtype]++
+	if slot.qtype == nil {
+		slot.qtype = make(map[string]int)
+	}
+	slot.qtype[qtype]++
+
+	name := normalize(q.Name)
+	hold(p.names, &slot.names, name)
+
+	if parent := parentDomain(name); parent != "" {
+		hold(p.parents, &slot.parents, parent)
+	}
+}
+
+type profile struct {
+	mu      sync.Mutex
+	cfg     *profileConfig
+	clients map[string]*clientProfile
+	sweep   time.Time
+}
+
+func newProfile(cfg *profileConfig) *profile {
+	return &profile{cfg: cfg, clients: make(map[string]*clientProfile)}
+}
+
+//limit 固定阈值
+func (pf *profile) limit(metric int) float64 {
+	switch metric {
+	case metricQueries:
+		return float64(pf.cfg.queries)
+	case metricUnique:
+		return float64(pf.cfg.unique)
+	case metricParents:
+		return float64(pf.cfg.parents)
+	case metricNxdomain:
+		return pf.cfg.nxdomain
+	case metricServfail:
+		return pf.cfg.servfail
+	}
+	return 0
+}
+
+//upper 基线的上限 标准差太小时 次数按泊松分布取sqrt(mean) 比例最少取0.05
+func (pf *profile) upper(metric int, b baseline) float64 {
+	sd := b.stddev()
+	if metric == metricNxdomain || metric == metricServfail {
+		sd = math.Max(sd, 0.05)
+	} else {
+		sd = math.Max(sd, math.Max(math.Sqrt(b.mean), 1))
+	}
+	return b.mean + pf.cfg.deviation*sd
+}
+
+//inspect 每个客户端每个指标window秒内只告警一次 固定阈值优先
+//原始socket收不到应答的客户端 nxdomain和servfail比例只在afpacket pcap dnstap模式下有效
+func (pf *profile) inspect(m *monitor, tx *Tx) []*Event {
+	client := tx.Client()
+	if client == "" {
+		return nil
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	p, ok := pf.clients[client]
+	if !ok {
+		if len(pf.clients) >= pf.cfg.clients {
+			return nil
+		}
+		p = newClientProfile(pf.cfg, tx.time)
+		pf.clients[client] = p
+	}
+
+	p.roll(pf.cfg, tx.time)
+	p.observe(tx)
+
+	var evs []*Event
+	window := time.Duration(pf.cfg.window) * time.Second
+	vals := p.values()
+	for i, v := range vals {
+		if !p.enough(i, pf.cfg.min) {
+			continue
+		}
+
+		if !p.alerted[i].IsZero() && tx.time.Sub(p.alerted[i]) < window {
+			continue
+		}
+
+		if limit := pf.limit(i); limit > 0 && v >= limit {
+			p.alerted[i] = tx.time
+			evs = append(evs, pf.event(m, tx, client, p, "threshold", i, v, limit))
+			continue
+		}
+
+		if p.base[i].n < pf.cfg.learn {
+			continue
+		}
+
+		if upper := pf.upper(i, p.base[i]); v > upper {
+			p.alerted[i] = tx.time
+			evs = append(evs, pf.event(m, tx, client, p, "baseline", i, v, upper))
+		}
+	}
+
+	return evs
+}
+
+func (pf *profile) event(m *monitor, tx *Tx, client string, p *clientProfile, reason string, metric int, v, limit float64) *Event {
+	return newEvent(m.Name(), "profile", tx.time).
+		Set("client", client).
+		Set("reason", reason).
+		Set("metric", metricName[metric]).
+		Set("value", v).
+		Set("limit", limit).
+		Set("mean", p.base[metric].mean).
+		Set("stddev", p.base[metric].stddev()).
+		Set("queries", p.queries).
+		Set("responses", p.responses).
+		Set("nxdomain", p.nxdomain).
+		Set("servfail", p.servfail).
+		Set("unique", len(p.names)).
+		Set("parents", len(p.parents)).
+		Set("learned", p.base[metric].n).
+		Set("window", pf.cfg.window)
+}
+
+//expire 每秒最多一次 滑动所有客户端的窗口 超过history个窗口没有流量的客户端删除
+func (pf *profile) expire(now time.Time) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if now.Sub(pf.sweep) < time.Second {
+		return
+	}
+	pf.sweep = now
+
+	idle := time.Duration(pf.cfg.window*pf.cfg.history) * time.Second
+	for client, p := range pf.clients {
+		if now.Sub(p.last) > idle {
+			delete(pf.clients, client)
+			continue
+		}
+		p.roll(pf.cfg, now)
+	}
+}
+
+//start 当前滑动窗口的开始时间 最早的子窗口的开始
+func (p *clientProfile) start(width time.Duration) time.Time {
+	return time.Unix(0, (p.epoch-profileSlots+1)*int64(width))
+}
+
+func (p *clientProfile) table(L *lua.LState, client string, window int) *lua.LTable {
+	vals := p.values()
+	width := time.Duration(window) * time.Second / profileSlots
+
+	tab := L.CreateTable(0, 16)
+	tab.RawSetString("client", lua.S2L(client))
+	tab.RawSetString("first_seen", lua.LNumber(p.first.Unix()))
+	tab.RawSetString("last_seen", lua.LNumber(p.last.Unix()))
+	tab.RawSetString("begin", lua.LNumber(p.start(width).Unix()))
+	tab.RawSetString("window", lua.LNumber(window))
+	tab.RawSetString("queries", lua.LNumber(p.queries))
+	tab.RawSetString("responses", lua.LNumber(p.responses))
+	tab.RawSetString("nxdomain", lua.LNumber(p.nxdomain))
+	tab.RawSetString("servfail", lua.LNumber(p.servfail))
+	tab.RawSetString("nxdomain_rate", lua.LNumber(vals[metricNxdomain]))
+	tab.RawSetString("servfail_rate", lua.LNumber(vals[metricServfail]))
+	tab.RawSetString("unique", lua.LNumber(len(p.names)))
+	tab.RawSetString("parents", lua.LNumber(len(p.parents)))
+
+	qtype := L.CreateTable(0, len(p.qtype))
+	for k, n := range p.qtype {
+		qtype.RawSetString(k, lua.LNumber(n))
+	}
+	tab.RawSetString("qtype", qtype)
+
+	base := L.CreateTable(0, metricCount)
+	for i, b := range p.base {
+		item := L.CreateTable(0, 3)
+		item.RawSetString("mean", lua.LNumber(b.mean))
+		item.RawSetString("stddev", lua.LNumber(b.stddev()))
+		item.RawSetString("windows", lua.LNumber(b.n))
+		base.RawSetString(metricName[i], item)
+	}
+	tab.RawSetString("baseline", base)
+	return tab
+}
+
+//clientL dns.client(ip) 客户端当前滑动窗口的统计和基线 没有记录时返回nil 窗口由报文和tick滑动
+func (m *monitor) clientL(L *lua.LState) int {
+	ip := L.CheckString(1)
+	if m.prof == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	pf := m.prof
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	p, ok := pf.clients[ip]
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	L.Push(p.table(L, ip, pf.cfg.window))
+	return 1
+}
@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+var pfEpoch = time.Unix(1700000000, 0)
+
+//pfQ 客户端在pfEpoch之后at秒发出的query
+func pfQ(client, name string, at float64) *Tx {
+	tx := &Tx{addr: &net.IPAddr{IP: net.ParseIP(client)}, service: "dns",
+		time: pfEpoch.Add(time.Duration(at * float64(time.Second)))}
+	tx.msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return tx
+}
+
+//pfR 发给客户端的应答
+func pfR(client, name string, at float64, rcode int) *Tx {
+	tx := pfQ(client, name, at)
+	tx.msg.Response = true
+	tx.msg.Rcode = rcode
+	tx.addr = &net.IPAddr{IP: net.ParseIP("192.0.2.53")}
+	tx.daddr = net.ParseIP(client)
+	return tx
+}
+
+func pfMetrics(evs []*Event) map[string]string {
+	got := make(map[string]string)
+	for _, ev := range evs {
+		reason, _ := ev.Get("reason")
+		metric, _ := ev.Get("metric")
+		got[metric.(string)] = reason.(string)
+	}
+	return got
+}
+
+func TestProfileThreshold(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	pf := newProfile(&profileConfig{window: 60, history: 10, learn: 5, deviation: 4, min: 10,
+		queries: 100, nxdomain: 0.6, servfail: 0.6, clients: 10})
+
+	//跨过整分钟的突发 两边各60个query 固定窗口会被拆成两半 滑动窗口内是120个
+	var evs []*Event
+	for i := 0; i < 120; i++ {
+		evs = append(evs, pf.inspect(m, pfQ("192.0.2.1", "a.example.com", 30+float64(i)*0.5))...)
+	}
+
+	if got := pfMetrics(evs); len(evs) != 1 || got["queries"] != "threshold" {
+		t.Fatalf("got %v", got)
+	}
+
+	if v, _ := evs[0].Get("value"); v != float64(100) {
+		t.Fatalf("alert at %v queries", v)
+	}
+
+	//window秒内同一个指标只告警一次
+	evs = nil
+	for i := 0; i < 50; i++ {
+		evs = append(evs, pf.inspect(m, pfQ("192.0.2.1", "a.example.com", 90+float64(i)*0.1))...)
+	}
+
+	if len(evs) != 0 {
+		t.Fatalf("got %v", pfMetrics(evs))
+	}
+
+	//比例类指标按应答计算
+	evs = nil
+	for i := 0; i < 20; i++ {
+		evs = append(evs, pf.inspect(m, pfR("192.0.2.2", "a.example.com", float64(i), dns.RcodeServerFailure))...)
+	}
+
+	if got := pfMetrics(evs); len(evs) != 1 || got["servfail_rate"] != "threshold" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestProfileSliding(t *testing.T) {
+	pf := newProfile(&profileConfig{window: 60, history: 10, learn: 5, deviation: 4, min: 10, clients: 10})
+	m := &monitor{cfg: &config{name: "dns"}}
+
+	for i := 0; i < 30; i++ {
+		pf.inspect(m, pfQ("192.0.2.1", fmt.Sprintf("h%d.example.com", i), float64(i)))
+	}
+
+	p := pf.clients["192.0.2.1"]
+	if p.queries != 30 || len(p.names) != 30 || len(p.parents) != 1 || p.qtype["A"] != 30 {
+		t.Fatalf("got queries %d names %d parents %d", p.queries, len(p.names), len(p.parents))
+	}
+
+	//前30秒的query滑出窗口
+	pf.inspect(m, pfQ("192.0.2.1", "other.example.org", 100))
+	if p.queries != 1 || len(p.names) != 1 || len(p.parents) != 1 || p.qtype["A"] != 1 {
+		t.Fatalf("got queries %d names %d parents %d", p.queries, len(p.names), len(p.parents))
+	}
+
+	if _, ok := p.names["other.example.org"]; !ok {
+		t.Fatal("name not in window")
+	}
+}
+
+func TestProfileBaseline(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	pf := newProfile(&profileConfig{window: 60, history: 10, learn: 5, deviation: 4, min: 10,
+		queries: 1000, nxdomain: 0.6, servfail: 0.6, clients: 10})
+
+	//6个正常的窗口 每个窗口20个query 5个qname 20个应答中1个nxdomain
+	var evs []*Event
+	for w := 0; w < 6; w++ {
+		for i := 0; i < 20; i++ {
+			at := float64(w*60 + i)
+			evs = append(evs, pf.inspect(m, pfQ("192.0.2.1", fmt.Sprintf("h%d.example.com", i%5), at))...)
+
+			rcode := dns.RcodeSuccess
+			if i == 0 {
+				rcode = dns.RcodeNameError
+			}
+			evs = append(evs, pf.inspect(m, pfR("192.0.2.1", "h0.example.com", at, rcode))...)
+		}
+	}
+
+	if len(evs) != 0 {
+		t.Fatalf("normal traffic got %v", pfMetrics(evs))
+	}
+
+	p := pf.clients["192.0.2.1"]
+	if b := p.base[metricQueries]; b.n != 5 || b.mean != 20 {
+		t.Fatalf("queries baseline got %+v", b)
+	}
+
+	if b := p.base[metricNxdomain]; b.n != 5 || b.mean != 0.05 {
+		t.Fatalf("nxdomain baseline got %+v", b)
+	}
+
+	//学习后的突发 200个不同的注册域名 超过基线但是没有达到固定阈值
+	evs = nil
+	for i := 0; i < 200; i++ {
+		evs = append(evs, pf.inspect(m, pfQ("192.0.2.1", fmt.Sprintf("r%d.evil%d.com", i, i), 360+float64(i)*0.1))...)
+	}
+
+	got := pfMetrics(evs)
+	if len(evs) != 3 || got["queries"] != "baseline" || got["unique"] != "baseline" || got["parents"] != "baseline" {
+		t.Fatalf("burst got %v", got)
+	}
+
+	//没有流量的客户端删除
+	pf.expire(pfEpoch.Add(100000 * time.Second))
+	if len(pf.clients) != 0 {
+		t.Fatalf("got %d clients", len(pf.clients))
+	}
+}
+
+func TestProfileIdle(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	pf := newProfile(&profileConfig{window: 60, history: 10, learn: 5, deviation: 4, min: 10, clients: 10})
+
+	for i := 0; i < 20; i++ {
+		pf.inspect(m, pfQ("192.0.2.1", "a.example.com", float64(i)))
+	}
+
+	//中间3个窗口没有流量 按0计入基线
+	pf.expire(pfEpoch.Add(250 * time.Second))
+	p := pf.clients["192.0.2.1"]
+	if b := p.base[metricQueries]; b.n != 4 || p.queries != 0 {
+		t.Fatalf("baseline got %+v queries %d", b, p.queries)
+	}
+}
@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/lua"
+	"golang.org/x/net/publicsuffix"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//rebindConfig 公网域名解析到内网地址 以及同一个域名在公网和内网地址之间切换
+type rebindConfig struct {
+	window int      //切换的统计窗口 秒
+	zones  []string //内部域名后缀 解析到内网地址是正常的
+	max    int      //跟踪的域名上限
+}
+
+func newRebindConfig(L *lua.LState, val lua.LValue) *rebindConfig {
+	cfg := &rebindConfig{window: 60, max: 65536}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "window":
+				cfg.window = checkInt(L, key, v)
+			case "zones":
+				cfg.zones = checkStrings(L, key, v)
+			case "max":
+				cfg.max = checkInt(L, key, v)
+			default:
+				L.RaiseError("rebinding config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("rebinding must be bool or table , got %s", val.Type().String())
+	}
+
+	for i, z := range cfg.zones {
+		cfg.zones[i] = normalize(strings.TrimPrefix(z, "*."))
+	}
+
+	return cfg
+}
+
+func (cfg *rebindConfig) valid() error {
+	if cfg.window <= 0 || cfg.max <= 0 {
+		return fmt.Errorf("invalid rebinding config")
+	}
+	return nil
+}
+
+//internal 域名本身或者是zones的子域名
+func (cfg *rebindConfig) internal(name string) bool {
+	for _, z := range cfg.zones {
+		if name == z || strings.HasSuffix(name, "."+z) {
+			return true
+		}
+	}
+	return false
+}
+
+type privateNet struct {
+	kind string
+	ipn  *net.IPNet
+}
+
+func mustCIDR(kind, cidr string) privateNet {
+	_, ipn, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return privateNet{kind: kind, ipn: ipn}
+}
+
+//privateNets 公网域名不应该解析到的地址段
+var privateNets = []privateNet{
+	mustCIDR("unspecified", "0.0.0.0/8"),
+	mustCIDR("rfc1918", "10.0.0.0/8"),
+	mustCIDR("rfc1918", "172.16.0.0/12"),
+	mustCIDR("rfc1918", "192.168.0.0/16"),
+	mustCIDR("loopback", "127.0.0.0/8"),
+	mustCIDR("link_local", "169.254.0.0/16"),
+	mustCIDR("cgnat", "100.64.0.0/10"),
+	mustCIDR("unspecified", "::/128"),
+	mustCIDR("loopback", "::1/128"),
+	mustCIDR("link_local", "fe80::/10"),
+	mustCIDR("ula", "fc00::/7"),
+}
+
+//privateKind 地址所属的内网类型 公网地址返回空
+func privateKind(ip net.IP) string {
+	for _, p := range privateNets {
+		if p.ipn.Contains(ip) {
+			return p.kind
+		}
+	}
+	return ""
+}
+
+//publicName 在公共后缀下注册的域名 .local .lan .internal 等内网后缀和反向解析不算
+func publicName(name string) bool {
+	if !strings.Contains(name, ".") || strings.HasSuffix(name, ".arpa") {
+		return false
+	}
+
+	ps, icann := publicsuffix.PublicSuffix(name)
+	return ps != name && (icann || strings.Contains(ps, "."))
+}
+
+//rebindState 一个域名最后一次解析到公网和内网地址的时间
+type rebindState struct {
+	public   time.Time
+	private  time.Time
+	pubIP    []net.IP
+	privIP   []net.IP
+	reason   string
+	reported time.Time
+}
+
+type rebind struct {
+	mu    sync.Mutex
+	cfg   *rebindConfig
+	names map[string]*rebindState
+}
+
+func newRebind(cfg *rebindConfig) *rebind {
+	return &rebind{cfg: cfg, names: make(map[string]*rebindState)}
+}
+
+//state 满了先删除窗口外的域名 依然满了全部清空
+func (r *rebind) state(name string, now time.Time) *rebindState {
+	if st, ok := r.names[name]; ok {
+		return st
+	}
+
+	if len(r.names) >= r.cfg.max {
+		window := time.Duration(r.cfg.window) * time.Second
+		for n, st := range r.names {
+			if now.Sub(st.public) > window && now.Sub(st.private) > window {
+				delete(r.names, n)
+			}
+		}
+
+		if len(r.names) >= r.cfg.max {
+			r.names = make(map[string]*rebindState)
+		}
+	}
+
+	st := &rebindState{}
+	r.names[name] = st
+	return st
+}
+
+func minTTL(rr []dns.RR) uint32 {
+	var ttl uint32
+	for i, r := range rr {
+		if t := r.Header().Ttl; i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	return ttl
+}
+
+func privateKinds(ips []net.IP) []string {
+	kinds := make([]string, len(ips))
+	for i, ip := range ips {
+		kinds[i] = privateKind(ip)
+	}
+	return kinds
+}
+
+//inspect 命中时标记tx 同一个域名同一个原因每个窗口只输出一次事件
+func (r *rebind) inspect(m *monitor, tx *Tx) *Event {
+	if !tx.msg.Response || tx.msg.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	name := normalize(tx.Qname())
+	if !publicName(name) || r.cfg.internal(name) {
+		return nil
+	}
+
+	var pub, priv []net.IP
+	for _, ip := range tx.AnswerIP() {
+		if privateKind(ip) == "" {
+			pub = append(pub, ip)
+		} else {
+			priv = append(priv, ip)
+		}
+	}
+
+	if len(pub)+len(priv) == 0 {
+		return nil
+	}
+
+	now := tx.time
+	window := time.Duration(r.cfg.window) * time.Second
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := r.state(name, now)
+
+	var reason string
+	bad := priv
+	switch {
+	case len(priv) > 0:
+		reason = "private_answer"
+		if len(pub) > 0 || (!st.public.IsZero() && now.Sub(st.public) <= window) {
+			reason = "alternating"
+		}
+
+	case !st.private.IsZero() && now.Sub(st.private) <= window:
+		reason = "alternating"
+		bad = st.privIP
+	}
+
+	if len(pub) > 0 {
+		st.public, st.pubIP = now, pub
+	}
+
+	if len(priv) > 0 {
+		st.private, st.privIP = now, priv
+	}
+
+	if reason == "" {
+		return nil
+	}
+
+	tx.rebinding = true
+	tx.rebindReason = reason
+	tx.rebindIP = bad
+
+	if reason == st.reason && now.Sub(st.reported) < window {
+		return nil
+	}
+	st.reason, st.reported = reason, now
+
+	return newEvent(m.Name(), "rebinding", tx.time).
+		Set("domain", name).
+		Set("client", tx.Client()).
+		Set("reason", reason).
+		Set("private", ipStrings(bad)).
+		Set("kind", privateKinds(bad)).
+		Set("public", ipStrings(st.pubIP)).
+		Set("ttl", minTTL(tx.msg.Answer)).
+		Set("window", r.cfg.window)
+}
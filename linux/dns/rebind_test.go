@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+//rebindTx 公共dns返回给内网客户端的应答 按地址类型生成A或者AAAA记录
+func rebindTx(name string, at int, ips ...string) *Tx {
+	tx := &Tx{
+		service: "dns",
+		addr:    &net.IPAddr{IP: net.ParseIP("8.8.8.8")},
+		daddr:   net.ParseIP("10.0.0.5"),
+		time:    time.Unix(1700000000+int64(at), 0),
+	}
+	tx.msg.SetQuestion(name, dns.TypeA)
+	tx.msg.Response = true
+
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip.To4() != nil {
+			tx.msg.Answer = append(tx.msg.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1}, A: ip})
+			continue
+		}
+		tx.msg.Answer = append(tx.msg.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 1}, AAAA: ip})
+	}
+	return tx
+}
+
+func TestPrivateKind(t *testing.T) {
+	for ip, want := range map[string]string{
+		"10.1.1.1":           "rfc1918",
+		"172.31.0.1":         "rfc1918",
+		"172.32.0.1":         "",
+		"127.0.0.1":          "loopback",
+		"100.64.1.1":         "cgnat",
+		"169.254.169.254":    "link_local",
+		"0.0.0.0":            "unspecified",
+		"fd00::1":            "ula",
+		"fe80::1":            "link_local",
+		"::ffff:192.168.1.1": "rfc1918",
+		"8.8.8.8":            "",
+		"2001:db8::1":        "",
+	} {
+		if got := privateKind(net.ParseIP(ip)); got != want {
+			t.Fatalf("%s got %q want %q", ip, got, want)
+		}
+	}
+
+	//只检查有公共后缀的域名 本地后缀和反向解析不算
+	for name, want := range map[string]bool{
+		"evil.com":              true,
+		"a.b.co.uk":             true,
+		"x.github.io":           true,
+		"printer.local":         false,
+		"nas.lan":               false,
+		"host.corp":             false,
+		"localhost":             false,
+		"1.0.0.10.in-addr.arpa": false,
+		"com":                   false,
+	} {
+		if got := publicName(name); got != want {
+			t.Fatalf("%s got %v want %v", name, got, want)
+		}
+	}
+}
+
+func TestRebindInspect(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	r := newRebind(&rebindConfig{window: 60, max: 10, zones: []string{"corp.example.com"}})
+
+	//内部区域解析到内网是正常的
+	tx := rebindTx("git.corp.example.com.", 0, "10.0.0.1")
+	if r.inspect(m, tx) != nil || tx.rebinding {
+		t.Fatal("internal zone flagged")
+	}
+
+	tx = rebindTx("good.org.", 0, "1.1.1.1", "2606:4700::1111")
+	if r.inspect(m, tx) != nil || tx.rebinding {
+		t.Fatal("public answer flagged")
+	}
+
+	//公网域名解析到内网
+	tx = rebindTx("evil.com.", 0, "192.168.1.1")
+	ev := r.inspect(m, tx)
+	if ev == nil || !tx.rebinding || tx.rebindReason != "private_answer" || tx.rebindIP[0].String() != "192.168.1.1" {
+		t.Fatalf("private got event %v reason %s", ev != nil, tx.rebindReason)
+	}
+
+	if v, _ := ev.Get("kind"); v.([]string)[0] != "rfc1918" {
+		t.Fatalf("kind got %v", v)
+	}
+
+	//窗口内又解析到公网 标记的是之前的内网地址
+	tx = rebindTx("evil.com.", 5, "1.2.3.4")
+	ev = r.inspect(m, tx)
+	if ev == nil || tx.rebindReason != "alternating" || tx.rebindIP[0].String() != "192.168.1.1" {
+		t.Fatalf("alternating got event %v reason %s", ev != nil, tx.rebindReason)
+	}
+
+	if v, _ := ev.Get("public"); v.([]string)[0] != "1.2.3.4" {
+		t.Fatalf("public got %v", v)
+	}
+
+	//同一个原因窗口内只输出一次事件 tx依然标记
+	tx = rebindTx("evil.com.", 6, "192.168.1.1")
+	if r.inspect(m, tx) != nil || tx.rebindReason != "alternating" {
+		t.Fatalf("repeated got reason %s", tx.rebindReason)
+	}
+
+	//窗口外只有公网地址
+	tx = rebindTx("evil.com.", 200, "1.2.3.4")
+	if r.inspect(m, tx) != nil || tx.rebinding {
+		t.Fatal("public after window flagged")
+	}
+
+	//同一个应答里同时有公网和内网地址
+	tx = rebindTx("mixed.net.", 0, "1.2.3.4", "::1")
+	ev = r.inspect(m, tx)
+	if ev == nil || tx.rebindReason != "alternating" {
+		t.Fatalf("mixed got event %v reason %s", ev != nil, tx.rebindReason)
+	}
+
+	if v, _ := ev.Get("kind"); len(v.([]string)) != 1 || v.([]string)[0] != "loopback" {
+		t.Fatalf("kind got %v", v)
+	}
+
+	//失败的应答不检查
+	tx = rebindTx("nx.com.", 0, "10.0.0.1")
+	tx.msg.Rcode = dns.RcodeNameError
+	if r.inspect(m, tx) != nil || tx.rebinding {
+		t.Fatal("nxdomain flagged")
+	}
+}
+
+func TestRebindMax(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	r := newRebind(&rebindConfig{window: 60, max: 2})
+
+	r.inspect(m, rebindTx("old.com.", 0, "1.2.3.4"))
+	r.inspect(m, rebindTx("new.com.", 100, "1.2.3.4"))
+
+	//满了先删除窗口外的域名
+	r.inspect(m, rebindTx("more.com.", 101, "1.2.3.4"))
+	if _, ok := r.names["old.com"]; ok || len(r.names) != 2 {
+		t.Fatalf("got %d names", len(r.names))
+	}
+
+	//都在窗口内就全部清空
+	r.inspect(m, rebindTx("last.com.", 102, "1.2.3.4"))
+	if _, ok := r.names["last.com"]; !ok || len(r.names) != 1 {
+		t.Fatalf("got %d names", len(r.names))
+	}
+}
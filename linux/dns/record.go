@@ -0,0 +1,104 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/rock-go/rock/lua"
+	"net"
+)
+
+//encoder RR2S 的输出接口 json.Encoder 和 lua table 共用同一套字段逻辑
+type encoder interface {
+	Tab(string)
+	Arr(string)
+	KV(string, interface{})
+	Join(string, []string)
+	End(string)
+}
+
+type tableEncoder struct {
+	L     *lua.LState
+	stack []*lua.LTable
+}
+
+func newTableEncoder(L *lua.LState) *tableEncoder {
+	return &tableEncoder{L: L, stack: []*lua.LTable{L.CreateTable(0, 0)}}
+}
+
+func (t *tableEncoder) top() *lua.LTable {
+	return t.stack[len(t.stack)-1]
+}
+
+func (t *tableEncoder) set(key string, val lua.LValue) {
+	if key == "" {
+		t.top().Append(val)
+		return
+	}
+	t.top().RawSetString(key, val)
+}
+
+func (t *tableEncoder) Tab(key string) {
+	tab := t.L.CreateTable(0, 8)
+	t.set(key, tab)
+	t.stack = append(t.stack, tab)
+}
+
+func (t *tableEncoder) Arr(key string) {
+	tab := t.L.CreateTable(4, 0)
+	t.set(key, tab)
+	t.stack = append(t.stack, tab)
+}
+
+func (t *tableEncoder) End(string) {
+	if len(t.stack) > 1 {
+		t.stack = t.stack[:len(t.stack)-1]
+	}
+}
+
+func (t *tableEncoder) KV(key string, val interface{}) {
+	t.set(key, toLValue(t.L, val))
+}
+
+func (t *tableEncoder) Join(key string, val []string) {
+	t.set(key, toLValue(t.L, val))
+}
+
+func (t *tableEncoder) Table() *lua.LTable {
+	return t.stack[0]
+}
+
+func toLValue(L *lua.LState, val interface{}) lua.LValue {
+	switch v := val.(type) {
+	case string:
+		return lua.S2L(v)
+	case []byte:
+		return lua.B2L(v)
+	case bool:
+		return lua.LBool(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case uint8:
+		return lua.LNumber(v)
+	case uint16:
+		return lua.LNumber(v)
+	case uint32:
+		return lua.LNumber(v)
+	case uint64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case net.IP:
+		return lua.S2L(v.String())
+	case []string:
+		tab := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			tab.Append(lua.S2L(item))
+		}
+		return tab
+	case nil:
+		return lua.LNil
+	default:
+		return lua.S2L(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+//replayInterval 循环回放时两遍之间的间隔
+const replayInterval = time.Second
+
+//replay 读取离线的pcap文件 和实时抓包走同一个处理流程 一遍没有读到报文时返回错误
+func (m *monitor) replay() error {
+	for {
+		last, err := m.replayFile(m.cfg.bind.Path())
+		if err == nil && last.IsZero() {
+			select {
+			case <-m.tom.Dying():
+				return nil
+			default:
+			}
+			err = fmt.Errorf("not found packet")
+		}
+
+		if err != nil {
+			xEnv.Errorf("%s replay %s fail %v", m.Name(), m.cfg.bind.Path(), err)
+			return err
+		}
+
+		//文件结束 把还在等待应答的query按超时输出
+		wait := m.cfg.correlateTimeout
+		if m.cfg.nod != nil && m.cfg.nod.wait > wait {
+			wait = m.cfg.nod.wait
+		}
+		m.tick(last.Add(time.Duration(wait) * time.Second))
+
+		if m.flux != nil {
+			for _, ev := range m.flux.report(m, last) {
+				m.dispatch(&job{ev: ev})
+			}
+		}
+
+		if m.sum != nil {
+			if ev := m.sum.flush(m, last); ev != nil {
+				m.dispatch(&job{ev: ev})
+			}
+		}
+
+		if !m.cfg.loop {
+			return nil
+		}
+
+		select {
+		case <-m.tom.Dying():
+			return nil
+		case <-time.After(replayInterval):
+		}
+	}
+}
+
+func (m *monitor) replayFile(path string) (time.Time, error) {
+	var last time.Time
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return last, err
+	}
+	defer fd.Close()
+
+	pr, err := newPcapReader(fd)
+	if err != nil {
+		return last, err
+	}
+
+	var first time.Time
+	begin := time.Now()
+
+	for {
+		select {
+		case <-m.tom.Dying():
+			return last, nil
+		default:
+		}
+
+		rec, err := pr.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return last, nil
+		}
+
+		if err != nil {
+			return last, err
+		}
+
+		if rec.ts.IsZero() {
+			rec.ts = time.Now()
+		}
+
+		if first.IsZero() {
+			first = rec.ts
+		}
+		m.pace(begin, rec.ts.Sub(first))
+
+		f, err := decodeLink(rec.link, rec.data)
+		if err != nil {
+			continue
+		}
+
+		f.ts = rec.ts
+		last = rec.ts
+		m.decode(f)
+		m.tick(rec.ts)
+	}
+}
+
+//pace 按照speed倍速回放 speed<=0 表示尽快回放
+func (m *monitor) pace(begin time.Time, offset time.Duration) {
+	if m.cfg.speed <= 0 {
+		return
+	}
+
+	delay := time.Until(begin.Add(time.Duration(float64(offset) / m.cfg.speed)))
+	if delay <= 0 {
+		return
+	}
+
+	select {
+	case <-m.tom.Dying():
+	case <-time.After(delay):
+	}
+}
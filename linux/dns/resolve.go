@@ -0,0 +1,269 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/lua"
+	"net"
+	"strings"
+	"time"
+)
+
+//resolveCache linux.dns.resolve 共用的缓存 按应答的ttl过期
+var resolveCache = newLru(4096)
+
+//resolveConfig linux.dns.resolve{name="example.com" , type="A" , server="udp://127.0.0.1:53"}
+type resolveConfig struct {
+	name    string
+	qtype   uint16
+	network string
+	server  string
+	timeout time.Duration
+	edns    bool
+	dnssec  bool
+	cache   bool
+}
+
+func newResolveConfig(L *lua.LState) *resolveConfig {
+	cfg := &resolveConfig{qtype: dns.TypeA, network: "udp", timeout: 2 * time.Second, edns: true, cache: true}
+
+	tab := L.CheckTable(1)
+	tab.Range(func(key string, val lua.LValue) {
+		switch key {
+		case "name":
+			cfg.name = val.String()
+		case "type":
+			t, ok := dns.StringToType[strings.ToUpper(val.String())]
+			if !ok {
+				L.RaiseError("resolve not support type %s", val.String())
+				return
+			}
+			cfg.qtype = t
+		case "server":
+			network, server, err := parseServer(val.String())
+			if err != nil {
+				L.RaiseError("%v", err)
+				return
+			}
+			cfg.network, cfg.server = network, server
+		case "timeout":
+			cfg.timeout = time.Duration(float64(checkNumber(L, key, val)) * float64(time.Second))
+		case "edns":
+			cfg.edns = lua.CheckBool(L, val)
+		case "dnssec":
+			cfg.dnssec = lua.CheckBool(L, val)
+		case "cache":
+			cfg.cache = lua.CheckBool(L, val)
+		default:
+			L.RaiseError("resolve config not found %s field", key)
+		}
+	})
+
+	if cfg.name == "" {
+		L.RaiseError("resolve name is empty")
+	}
+
+	if cfg.timeout <= 0 {
+		L.RaiseError("invalid resolve timeout")
+	}
+
+	if cfg.server == "" {
+		cfg.server = systemServer()
+	}
+
+	//dnssec 需要edns的DO位
+	if cfg.dnssec {
+		cfg.edns = true
+	}
+
+	return cfg
+}
+
+//parseServer udp://ip:port tcp://ip:port 或者 ip ip:port 默认udp 53端口
+func parseServer(v string) (string, string, error) {
+	network := "udp"
+	if i := strings.Index(v, "://"); i >= 0 {
+		network, v = v[:i], v[i+3:]
+	}
+
+	if network != "udp" && network != "tcp" {
+		return "", "", fmt.Errorf("resolve not support %s server", network)
+	}
+
+	if _, _, err := net.SplitHostPort(v); err != nil {
+		v = net.JoinHostPort(strings.Trim(v, "[]"), "53")
+	}
+
+	host, _, _ := net.SplitHostPort(v)
+	if net.ParseIP(host) == nil {
+		return "", "", fmt.Errorf("resolve server must be ip got %s", host)
+	}
+
+	return network, v, nil
+}
+
+//systemServer /etc/resolv.conf 中的第一个服务器
+func systemServer() string {
+	cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(cc.Servers) == 0 {
+		return "127.0.0.1:53"
+	}
+	return net.JoinHostPort(cc.Servers[0], cc.Port)
+}
+
+//qname 查询PTR时ip自动转换成反向解析的名称
+func (cfg *resolveConfig) qname() string {
+	if cfg.qtype == dns.TypePTR && net.ParseIP(cfg.name) != nil {
+		name, _ := dns.ReverseAddr(cfg.name)
+		return name
+	}
+	return dns.Fqdn(cfg.name)
+}
+
+func (cfg *resolveConfig) key() string {
+	return fmt.Sprintf("%s|%s|%s|%d|%v|%v", cfg.network, cfg.server, strings.ToLower(cfg.qname()), cfg.qtype, cfg.edns, cfg.dnssec)
+}
+
+type resolveEntry struct {
+	msg     *dns.Msg
+	network string
+	rtt     time.Duration
+	time    time.Time
+}
+
+//resolveResult 一次解析的结果 cached表示来自缓存 ttl已经减去缓存的时间
+type resolveResult struct {
+	msg     *dns.Msg
+	network string
+	server  string
+	rtt     time.Duration
+	cached  bool
+}
+
+//cacheTTL 有应答时取最小ttl 否定应答取SOA的ttl和minimum中较小的 其他不缓存
+func cacheTTL(msg *dns.Msg) time.Duration {
+	if msg.Truncated {
+		return 0
+	}
+
+	switch msg.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return 0
+	}
+
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		return time.Duration(minTTL(msg.Answer)) * time.Second
+	}
+
+	for _, r := range msg.Ns {
+		if soa, ok := r.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return 0
+}
+
+//age 缓存的应答减去已经过去的秒数
+func age(msg *dns.Msg, elapsed time.Duration) *dns.Msg {
+	msg = msg.Copy()
+	sec := uint32(elapsed / time.Second)
+	for _, rr := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, r := range rr {
+			if r.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if h := r.Header(); h.Ttl > sec {
+				h.Ttl -= sec
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+	return msg
+}
+
+//resolve udp被截断时换成tcp重新查询
+func resolve(cfg *resolveConfig) (*resolveResult, error) {
+	key := cfg.key()
+	if cfg.cache {
+		if v, ok := resolveCache.get(key); ok {
+			entry := v.(*resolveEntry)
+			return &resolveResult{msg: age(entry.msg, time.Since(entry.time)), network: entry.network,
+				server: cfg.server, rtt: entry.rtt, cached: true}, nil
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(cfg.qname(), cfg.qtype)
+	if cfg.edns {
+		req.SetEdns0(1232, cfg.dnssec)
+	}
+
+	network := cfg.network
+	c := &dns.Client{Net: network, Timeout: cfg.timeout}
+	msg, rtt, err := c.Exchange(req, cfg.server)
+	if err == nil && msg.Truncated && network == "udp" {
+		network = "tcp"
+		c.Net = network
+		msg, rtt, err = c.Exchange(req, cfg.server)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl := cacheTTL(msg); cfg.cache && ttl > 0 {
+		resolveCache.set(key, &resolveEntry{msg: msg, network: network, rtt: rtt, time: time.Now()}, ttl)
+	}
+
+	return &resolveResult{msg: msg, network: network, server: cfg.server, rtt: rtt}, nil
+}
+
+//table 记录的格式和tx.answer相同
+func (r *resolveResult) table(L *lua.LState) *lua.LTable {
+	tx := &Tx{msg: *r.msg}
+
+	tab := L.CreateTable(0, 14)
+	tab.RawSetString("name", lua.S2L(tx.Qname()))
+	if q, ok := tx.question(); ok {
+		tab.RawSetString("type", lua.S2L(dns.TypeToString[q.Qtype]))
+	}
+	tab.RawSetString("server", lua.S2L(r.server))
+	tab.RawSetString("proto", lua.S2L(r.network))
+	tab.RawSetString("rcode", lua.LNumber(r.msg.Rcode))
+	tab.RawSetString("rcode_text", lua.S2L(dns.RcodeToString[r.msg.Rcode]))
+	tab.RawSetString("authenticated", lua.LBool(r.msg.AuthenticatedData))
+	tab.RawSetString("truncated", lua.LBool(r.msg.Truncated))
+	tab.RawSetString("rtt", lua.LNumber(float64(r.rtt)/float64(time.Millisecond)))
+	tab.RawSetString("cached", lua.LBool(r.cached))
+	tab.RawSetString("answer", tx.rrL(L, r.msg.Answer))
+	tab.RawSetString("authority", tx.rrL(L, r.msg.Ns))
+	tab.RawSetString("additional", tx.rrL(L, r.msg.Extra))
+
+	ips := tx.AnswerIP()
+	ipt := L.CreateTable(len(ips), 0)
+	for _, ip := range ips {
+		ipt.Append(lua.S2L(ip.String()))
+	}
+	tab.RawSetString("ips", ipt)
+	return tab
+}
+
+//resolveL linux.dns.resolve{name , type , server , timeout , edns , dnssec , cache} 失败时返回nil和错误
+func resolveL(L *lua.LState) int {
+	r, err := resolve(newResolveConfig(L))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.S2L(err.Error()))
+		return 2
+	}
+
+	L.Push(r.table(L))
+	return 1
+}
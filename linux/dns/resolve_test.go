@@ -0,0 +1,264 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testResolver 127.0.0.1上同一个端口的udp和tcp服务 记录每个请求
+type testResolver struct {
+	addr string
+
+	mu  sync.Mutex
+	req []testRequest
+}
+
+type testRequest struct {
+	name string
+	tcp  bool
+	edns bool
+	do   bool
+}
+
+func (s *testResolver) requests() []testRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]testRequest(nil), s.req...)
+}
+
+func (s *testResolver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+
+	req := testRequest{name: q.Name, tcp: tcp}
+	if opt := r.IsEdns0(); opt != nil {
+		req.edns, req.do = true, opt.Do()
+	}
+
+	s.mu.Lock()
+	s.req = append(s.req, req)
+	s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	switch q.Name {
+	case "a.test.":
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+			A:   net.IPv4(192, 0, 2, 10),
+		})
+
+	case "big.test.":
+		//udp只回复TC=1 tcp回复完整的应答
+		if !tcp {
+			m.Truncated = true
+			break
+		}
+
+		for i := 0; i < 50; i++ {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, byte(i)),
+			})
+		}
+
+	default:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns.test.",
+			Mbox:   "hostmaster.test.",
+			Minttl: 30,
+		})
+	}
+
+	w.WriteMsg(m)
+}
+
+func newTestResolver(t *testing.T) *testResolver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	s := &testResolver{addr: pc.LocalAddr().String()}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	us := &dns.Server{PacketConn: pc, Handler: s, NotifyStartedFunc: wg.Done}
+	ts := &dns.Server{Listener: ln, Handler: s, NotifyStartedFunc: wg.Done}
+	go us.ActivateAndServe()
+	go ts.ActivateAndServe()
+	wg.Wait()
+
+	t.Cleanup(func() {
+		us.Shutdown()
+		ts.Shutdown()
+	})
+	return s
+}
+
+func (s *testResolver) config(name string) *resolveConfig {
+	return &resolveConfig{name: name, qtype: dns.TypeA, network: "udp", server: s.addr,
+		timeout: 2 * time.Second, edns: true, cache: true}
+}
+
+func TestParseServer(t *testing.T) {
+	for v, want := range map[string][2]string{
+		"192.0.2.1":          {"udp", "192.0.2.1:53"},
+		"tcp://192.0.2.1":    {"tcp", "192.0.2.1:53"},
+		"udp://192.0.2.1:54": {"udp", "192.0.2.1:54"},
+		"::1":                {"udp", "[::1]:53"},
+		"tcp://[::1]:5353":   {"tcp", "[::1]:5353"},
+	} {
+		network, server, err := parseServer(v)
+		if err != nil || network != want[0] || server != want[1] {
+			t.Fatalf("%s got %s %s %v", v, network, server, err)
+		}
+	}
+
+	for _, v := range []string{"https://192.0.2.1", "dns.example.com"} {
+		if _, _, err := parseServer(v); err == nil {
+			t.Fatalf("%s accepted", v)
+		}
+	}
+}
+
+func TestResolveUDP(t *testing.T) {
+	s := newTestResolver(t)
+
+	cfg := s.config("a.test")
+	cfg.cache = false
+	r, err := resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.cached || r.network != "udp" || r.server != s.addr || len(r.msg.Answer) != 1 {
+		t.Fatalf("got cached=%v network=%s server=%s answer=%d", r.cached, r.network, r.server, len(r.msg.Answer))
+	}
+
+	if a, ok := r.msg.Answer[0].(*dns.A); !ok || !a.A.Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("got answer %v", r.msg.Answer[0])
+	}
+
+	req := s.requests()
+	if len(req) != 1 || req[0].tcp || !req[0].edns || req[0].do {
+		t.Fatalf("got requests %+v", req)
+	}
+}
+
+func TestResolveTruncated(t *testing.T) {
+	s := newTestResolver(t)
+
+	cfg := s.config("big.test")
+	cfg.cache = false
+	r, err := resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.network != "tcp" || r.msg.Truncated || len(r.msg.Answer) != 50 {
+		t.Fatalf("got network=%s truncated=%v answer=%d", r.network, r.msg.Truncated, len(r.msg.Answer))
+	}
+
+	req := s.requests()
+	if len(req) != 2 || req[0].tcp || !req[1].tcp {
+		t.Fatalf("got requests %+v", req)
+	}
+}
+
+func TestResolveDnssec(t *testing.T) {
+	s := newTestResolver(t)
+
+	cfg := s.config("a.test")
+	cfg.dnssec, cfg.cache = true, false
+	if _, err := resolve(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = s.config("a.test")
+	cfg.edns, cfg.cache = false, false
+	if _, err := resolve(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.requests()
+	if len(req) != 2 || !req[0].edns || !req[0].do || req[1].edns || req[1].do {
+		t.Fatalf("got requests %+v", req)
+	}
+}
+
+func TestResolveCache(t *testing.T) {
+	s := newTestResolver(t)
+
+	cfg := s.config("a.test")
+	if _, err := resolve(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	//把缓存的时间提前30秒 命中时ttl减去30
+	v, ok := resolveCache.get(cfg.key())
+	if !ok {
+		t.Fatal("answer not cached")
+	}
+	v.(*resolveEntry).time = time.Now().Add(-30 * time.Second)
+
+	r, err := resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.cached || len(r.msg.Answer) != 1 || r.msg.Answer[0].Header().Ttl != 70 {
+		t.Fatalf("got cached=%v answer=%v", r.cached, r.msg.Answer)
+	}
+
+	//缓存里的应答不被修改
+	if ttl := v.(*resolveEntry).msg.Answer[0].Header().Ttl; ttl != 100 {
+		t.Fatalf("cached ttl changed to %d", ttl)
+	}
+
+	//edns不同的请求不共用缓存
+	plain := s.config("a.test")
+	plain.edns = false
+	if r, err = resolve(plain); err != nil || r.cached {
+		t.Fatalf("edns=false got cached=%v %v", r != nil && r.cached, err)
+	}
+
+	if n := len(s.requests()); n != 2 {
+		t.Fatalf("got %d requests", n)
+	}
+}
+
+func TestResolveNegativeCache(t *testing.T) {
+	s := newTestResolver(t)
+
+	cfg := s.config("nx.test")
+	r, err := resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//SOA的ttl是300 minimum是30 取较小的
+	if r.msg.Rcode != dns.RcodeNameError || cacheTTL(r.msg) != 30*time.Second {
+		t.Fatalf("got rcode %d ttl %v", r.msg.Rcode, cacheTTL(r.msg))
+	}
+
+	if r, err = resolve(cfg); err != nil || !r.cached || r.msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("nxdomain not cached %v", err)
+	}
+
+	if n := len(s.requests()); n != 1 {
+		t.Fatalf("got %d requests", n)
+	}
+}
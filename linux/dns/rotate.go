@@ -0,0 +1,262 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rock-go/rock/lua"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//rotateConfig 写入文件的切割和保留
+type rotateConfig struct {
+	path     string
+	size     int //单个文件大小 MB 0 不按大小切割
+	interval int //切割间隔 秒 0 不按时间切割
+	keep     int //保留的历史文件数量 0 不限制
+	age      int //历史文件保留天数 0 不限制
+}
+
+//set 解析切割相关的配置 不是切割的字段返回false
+func (rc *rotateConfig) set(L *lua.LState, key string, val lua.LValue) bool {
+	switch key {
+	case "path":
+		rc.path = val.String()
+	case "size":
+		rc.size = checkInt(L, key, val)
+	case "interval":
+		rc.interval = checkInt(L, key, val)
+	case "keep":
+		rc.keep = checkInt(L, key, val)
+	case "age":
+		rc.age = checkInt(L, key, val)
+	default:
+		return false
+	}
+	return true
+}
+
+func (rc *rotateConfig) valid() error {
+	if rc.path == "" {
+		return fmt.Errorf("not found path")
+	}
+
+	if rc.size < 0 || rc.interval < 0 || rc.keep < 0 || rc.age < 0 {
+		return fmt.Errorf("invalid rotate config")
+	}
+	return nil
+}
+
+//rotateFile 正在写的文件固定为path 切割时重命名成 name-20060102150405.ext
+//每个文件开头写header 关闭前写footer 保证切割后的文件可以单独打开
+type rotateFile struct {
+	cfg    rotateConfig
+	header []byte
+	footer []byte
+
+	fd     *os.File
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+func newRotateFile(cfg rotateConfig, header, footer []byte) *rotateFile {
+	return &rotateFile{cfg: cfg, header: header, footer: footer}
+}
+
+//open 上次遗留的文件先归档 不追加到旧文件后面
+func (f *rotateFile) open(now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(f.cfg.path), 0755); err != nil {
+		return err
+	}
+
+	if st, err := os.Stat(f.cfg.path); err == nil && st.Size() > 0 {
+		if err = f.archive(st.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	fd, err := os.OpenFile(f.cfg.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	f.fd = fd
+	f.w = bufio.NewWriterSize(fd, 64*1024)
+	f.size = 0
+	f.opened = now
+
+	if _, err = f.w.Write(f.header); err != nil {
+		return err
+	}
+	f.size = int64(len(f.header))
+
+	f.cleanup(now)
+	return nil
+}
+
+//empty 只有文件头
+func (f *rotateFile) empty() bool {
+	return f.size <= int64(len(f.header))
+}
+
+func (f *rotateFile) write(b []byte, now time.Time) error {
+	if f.fd == nil {
+		if err := f.open(now); err != nil {
+			return err
+		}
+	}
+
+	limit := int64(f.cfg.size) << 20
+	if limit > 0 && !f.empty() && f.size+int64(len(b)) > limit {
+		if err := f.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.w.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+//tick 刷新缓冲区 到时间后切割
+func (f *rotateFile) tick(now time.Time) error {
+	if f.fd == nil {
+		return nil
+	}
+
+	if f.cfg.interval > 0 && !f.empty() && now.Sub(f.opened) >= time.Duration(f.cfg.interval)*time.Second {
+		return f.rotate(now)
+	}
+	return f.w.Flush()
+}
+
+func (f *rotateFile) rotate(now time.Time) error {
+	opened := f.opened
+	if err := f.close(); err != nil {
+		return err
+	}
+
+	if err := f.archive(opened); err != nil {
+		return err
+	}
+	return f.open(now)
+}
+
+func (f *rotateFile) close() error {
+	if f.fd == nil {
+		return nil
+	}
+
+	f.w.Write(f.footer)
+	err := f.w.Flush()
+	if e := f.fd.Close(); err == nil {
+		err = e
+	}
+
+	f.fd = nil
+	f.w = nil
+	return err
+}
+
+func (f *rotateFile) pattern() (string, string) {
+	ext := filepath.Ext(f.cfg.path)
+	return strings.TrimSuffix(f.cfg.path, ext) + "-", ext
+}
+
+//archive 按文件开始的时间命名 同一秒内切割时加序号
+func (f *rotateFile) archive(ts time.Time) error {
+	prefix, ext := f.pattern()
+	name := prefix + ts.Format("20060102150405") + ext
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s%s.%d%s", prefix, ts.Format("20060102150405"), i, ext)
+	}
+
+	return os.Rename(f.cfg.path, name)
+}
+
+//archived 解析归档文件名中的开始时间和同一秒内的序号
+func (f *rotateFile) archived(name string) (time.Time, int, bool) {
+	prefix, ext := f.pattern()
+	v := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+
+	seq := 0
+	if i := strings.IndexByte(v, '.'); i >= 0 {
+		n, err := strconv.Atoi(v[i+1:])
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+		seq, v = n, v[:i]
+	}
+
+	ts, err := time.ParseInLocation("20060102150405", v, time.Local)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return ts, seq, true
+}
+
+type archiveFile struct {
+	name string
+	ts   time.Time
+	seq  int
+}
+
+//cleanup 删除超过数量和天数的历史文件 按文件名中的时间和序号排序
+func (f *rotateFile) cleanup(now time.Time) {
+	if f.cfg.keep <= 0 && f.cfg.age <= 0 {
+		return
+	}
+
+	prefix, ext := f.pattern()
+	names, err := filepath.Glob(prefix + "[0-9]*" + ext)
+	if err != nil {
+		return
+	}
+
+	var files []archiveFile
+	for _, name := range names {
+		if ts, seq, ok := f.archived(name); ok {
+			files = append(files, archiveFile{name: name, ts: ts, seq: seq})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].ts.Equal(files[j].ts) {
+			return files[i].ts.Before(files[j].ts)
+		}
+		return files[i].seq < files[j].seq
+	})
+
+	remove := 0
+	if f.cfg.keep > 0 && len(files) > f.cfg.keep {
+		remove = len(files) - f.cfg.keep
+	}
+
+	expire := now.Add(-time.Duration(f.cfg.age) * 24 * time.Hour)
+	for i, file := range files {
+		if i >= remove && !f.expired(file.name, expire) {
+			continue
+		}
+
+		if err := os.Remove(file.name); err != nil {
+			xEnv.Errorf("remove %s fail %v", file.name, err)
+		}
+	}
+}
+
+func (f *rotateFile) expired(name string, expire time.Time) bool {
+	if f.cfg.age <= 0 {
+		return false
+	}
+
+	st, err := os.Stat(name)
+	return err == nil && st.ModTime().Before(expire)
+}
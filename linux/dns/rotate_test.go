@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func rotateArchives(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "dns-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range files {
+		files[i] = filepath.Base(name)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func checkRotateFile(t *testing.T, name, want string) {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != want {
+		t.Fatalf("%s got %q want %q", filepath.Base(name), b, want)
+	}
+}
+
+func TestRotateSize(t *testing.T) {
+	dir := t.TempDir()
+	f := newRotateFile(rotateConfig{path: filepath.Join(dir, "dns.log"), size: 1}, []byte("H"), []byte("F"))
+	now := time.Date(2023, 11, 14, 22, 13, 20, 0, time.Local)
+
+	big := make([]byte, 700<<10)
+	for i := range big {
+		big[i] = 'x'
+	}
+
+	//第二次写入超过1MB 切割 同一秒内再次切割加序号
+	for i := 0; i < 3; i++ {
+		if err := f.write(big, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.close()
+
+	files := rotateArchives(t, dir)
+	if len(files) != 2 || files[0] != "dns-20231114221320.1.log" || files[1] != "dns-20231114221320.log" {
+		t.Fatalf("got archives %v", files)
+	}
+
+	want := "H" + string(big) + "F"
+	for _, name := range append(files, "dns.log") {
+		checkRotateFile(t, filepath.Join(dir, name), want)
+	}
+}
+
+func TestRotateInterval(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dns.log")
+	f := newRotateFile(rotateConfig{path: path, interval: 10}, []byte("H"), []byte("F"))
+	now := time.Date(2023, 11, 14, 22, 13, 20, 0, time.Local)
+
+	if err := f.open(now); err != nil {
+		t.Fatal(err)
+	}
+
+	f.write([]byte("a"), now.Add(5*time.Second))
+	f.tick(now.Add(8 * time.Second))
+	if files := rotateArchives(t, dir); len(files) != 0 {
+		t.Fatalf("rotated before interval %v", files)
+	}
+
+	//新文件从切割时开始计时 没有数据的文件不切割
+	f.tick(now.Add(10 * time.Second))
+	f.tick(now.Add(30 * time.Second))
+	f.write([]byte("b"), now.Add(31*time.Second))
+	f.close()
+
+	files := rotateArchives(t, dir)
+	if len(files) != 1 || files[0] != "dns-20231114221320.log" {
+		t.Fatalf("got archives %v", files)
+	}
+	checkRotateFile(t, filepath.Join(dir, files[0]), "HaF")
+	checkRotateFile(t, path, "HbF")
+}
+
+func TestRotateKeep(t *testing.T) {
+	dir := t.TempDir()
+	f := newRotateFile(rotateConfig{path: filepath.Join(dir, "dns.log"), keep: 3}, nil, nil)
+
+	//同一秒内的序号文件按文件名排序会排在不带序号的文件前面
+	for _, name := range []string{
+		"dns-20231114221319.log",
+		"dns-20231114221320.log",
+		"dns-20231114221320.1.log",
+		"dns-20231114221320.2.log",
+		"dns-20231114221321.log",
+		"dns-1x.log",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.cleanup(time.Now())
+	files := rotateArchives(t, dir)
+	want := []string{"dns-1x.log", "dns-20231114221320.1.log", "dns-20231114221320.2.log", "dns-20231114221321.log"}
+	if len(files) != len(want) {
+		t.Fatalf("got archives %v", files)
+	}
+
+	for i := range want {
+		if files[i] != want[i] {
+			t.Fatalf("got archives %v", files)
+		}
+	}
+}
+
+func TestRotateAge(t *testing.T) {
+	dir := t.TempDir()
+	f := newRotateFile(rotateConfig{path: filepath.Join(dir, "dns.log"), age: 1}, nil, nil)
+	now := time.Now()
+
+	for name, mtime := range map[string]time.Time{
+		"dns-20231114221319.log":   now.Add(-48 * time.Hour),
+		"dns-20231114221320.log":   now.Add(-25 * time.Hour),
+		"dns-20231114221320.1.log": now.Add(-time.Hour),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.cleanup(now)
+	if files := rotateArchives(t, dir); len(files) != 1 || files[0] != "dns-20231114221320.1.log" {
+		t.Fatalf("got archives %v", files)
+	}
+}
@@ -0,0 +1,20 @@
+package dns
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+//bucketShards pdns和nod按key的hash分成多个bucket key 落盘时只写有变化的分片
+const bucketShards = 256
+
+func shardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % bucketShards)
+}
+
+//shardKey 分片在bucket中的key 如 dns.0a
+func shardKey(prefix string, i int) string {
+	return fmt.Sprintf("%s.%02x", prefix, i)
+}
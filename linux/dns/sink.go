@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rock-go/rock/auxlib"
+	"github.com/rock-go/rock/lua"
+	"gopkg.in/tomb.v2"
+	"sync/atomic"
+	"time"
+)
+
+//txWriter 直接接收tx的写入器 需要原始的dns报文 不经过pipe的转换
+type txWriter interface {
+	WriteTx(*Tx) error
+}
+
+//checkTxWriter pcap_writer dnstap_writer 返回写入器 其他的值交给pipe处理
+func checkTxWriter(L *lua.LState, val lua.LValue) txWriter {
+	switch val.Type() {
+	case lua.LTNil, lua.LTFunction, lua.LTString, lua.LTTable:
+		return nil
+	}
+
+	w, _ := auxlib.CheckWriter(val, L).(txWriter)
+	return w
+}
+
+//errOutputDown socket 断开等待重连 数据直接丢弃
+var errOutputDown = errors.New("output down")
+
+//output 写入器的目的地 文件或者socket 只在写入协程中调用
+type output interface {
+	write([]byte, time.Time) error
+	tick(time.Time) error
+	close() error
+}
+
+type sinkStats struct {
+	written uint64
+	dropped uint64
+	failed  uint64
+}
+
+func (s *sinkStats) table(L *lua.LState) *lua.LTable {
+	tab := L.CreateTable(0, 3)
+	tab.RawSetString("written", lua.LNumber(atomic.LoadUint64(&s.written)))
+	tab.RawSetString("dropped", lua.LNumber(atomic.LoadUint64(&s.dropped)))
+	tab.RawSetString("failed", lua.LNumber(atomic.LoadUint64(&s.failed)))
+	return tab
+}
+
+//sink 编码在处理协程中完成 写入在单独的协程中 队列满时丢弃 不阻塞dns处理
+type sink struct {
+	name    string
+	queue   chan []byte
+	tom     *tomb.Tomb
+	running int32
+	stats   sinkStats
+}
+
+func newSink(size int) *sink {
+	return &sink{queue: make(chan []byte, size)}
+}
+
+func (s *sink) push(b []byte) error {
+	if atomic.LoadInt32(&s.running) == 0 {
+		atomic.AddUint64(&s.stats.dropped, 1)
+		return fmt.Errorf("%s not running", s.name)
+	}
+
+	select {
+	case s.queue <- b:
+	default:
+		atomic.AddUint64(&s.stats.dropped, 1)
+	}
+	return nil
+}
+
+func (s *sink) start(name string, out output) {
+	s.name = name
+	s.tom = new(tomb.Tomb)
+	atomic.StoreInt32(&s.running, 1)
+	s.tom.Go(func() error {
+		s.run(out)
+		return nil
+	})
+}
+
+func (s *sink) stop() {
+	if s.tom == nil {
+		return
+	}
+
+	atomic.StoreInt32(&s.running, 0)
+	s.tom.Kill(fmt.Errorf("close"))
+	s.tom.Wait()
+	s.tom = nil
+}
+
+func (s *sink) write(out output, b []byte) {
+	err := out.write(b, time.Now())
+	if err == errOutputDown {
+		atomic.AddUint64(&s.stats.dropped, 1)
+		return
+	}
+
+	if err != nil {
+		atomic.AddUint64(&s.stats.failed, 1)
+		xEnv.Errorf("%s write fail %v", s.name, err)
+		return
+	}
+	atomic.AddUint64(&s.stats.written, 1)
+}
+
+func (s *sink) drain(out output) {
+	for {
+		select {
+		case b := <-s.queue:
+			s.write(out, b)
+		default:
+			return
+		}
+	}
+}
+
+//run 每秒刷新一次 退出前把队列中剩余的数据写完
+func (s *sink) run(out output) {
+	tk := time.NewTicker(time.Second)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-s.tom.Dying():
+			s.drain(out)
+			if err := out.close(); err != nil {
+				xEnv.Errorf("%s close fail %v", s.name, err)
+			}
+			return
+
+		case b := <-s.queue:
+			s.write(out, b)
+
+		case now := <-tk.C:
+			if err := out.tick(now); err != nil {
+				xEnv.Errorf("%s flush fail %v", s.name, err)
+			}
+		}
+	}
+}
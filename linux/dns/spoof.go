@@ -0,0 +1,409 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/lua"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//spoofConfig 伪造应答检测 需要同时看到query和response afpacket pcap dnstap 模式下有效
+type spoofConfig struct {
+	wait    int //query 等待应答的时间 秒 应答后继续保留wait秒 用来发现不同的应答
+	window  int //猜测dns_id的统计窗口 秒
+	guesses int //窗口内同一个客户端同一个注册域名 dns_id不匹配的应答数量
+	max     int //跟踪的query上限
+}
+
+func newSpoofConfig(L *lua.LState, val lua.LValue) *spoofConfig {
+	cfg := &spoofConfig{wait: 10, window: 10, guesses: 10, max: 65536}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "wait":
+				cfg.wait = checkInt(L, key, v)
+			case "window":
+				cfg.window = checkInt(L, key, v)
+			case "guesses":
+				cfg.guesses = checkInt(L, key, v)
+			case "max":
+				cfg.max = checkInt(L, key, v)
+			default:
+				L.RaiseError("spoof config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("spoof must be bool or table , got %s", val.Type().String())
+	}
+
+	return cfg
+}
+
+func (cfg *spoofConfig) valid() error {
+	if cfg.wait <= 0 || cfg.window <= 0 || cfg.guesses <= 0 || cfg.max <= 0 {
+		return fmt.Errorf("invalid spoof config")
+	}
+	return nil
+}
+
+//spoofQuery 一个发出的query 和第一个应答的内容
+type spoofQuery struct {
+	key      string
+	name     string
+	server   string
+	sport    uint16
+	time     time.Time
+	answered time.Time
+	rcode    int
+	answers  []string
+	reported bool
+}
+
+//spoofBurst 同一个客户端同一个注册域名 dns_id不匹配的应答
+type spoofBurst struct {
+	begin   time.Time
+	count   int
+	ids     []uint16
+	servers map[string]struct{}
+}
+
+//spoof tombs 记录超时删除或者表满没有记录的query 之后到达的应答不告警
+//tombs也满了时记录saturated 之后wait秒内不告警unasked_name和unknown_txid
+type spoof struct {
+	mu        sync.Mutex
+	cfg       *spoofConfig
+	query     map[string]*spoofQuery
+	byName    map[string]map[uint16]*spoofQuery
+	clients   map[string]time.Time
+	bursts    map[string]*spoofBurst
+	tombs     map[string]map[uint16]time.Time
+	tombN     int
+	saturated time.Time
+	sweep     time.Time
+}
+
+func newSpoof(cfg *spoofConfig) *spoof {
+	return &spoof{
+		cfg:     cfg,
+		query:   make(map[string]*spoofQuery),
+		byName:  make(map[string]map[uint16]*spoofQuery),
+		clients: make(map[string]time.Time),
+		bursts:  make(map[string]*spoofBurst),
+		tombs:   make(map[string]map[uint16]time.Time),
+	}
+}
+
+//spoofKey 客户端 端口 和 qname 确定一个等待应答的socket
+func spoofKey(client string, cport uint16, name string) string {
+	return client + "|" + strconv.Itoa(int(cport)) + "|" + name
+}
+
+//answerSet 应答的rcode和排序后的记录 不包含ttl 用来比较两个应答是否相同
+func answerSet(tx *Tx) []string {
+	set := make([]string, 0, len(tx.msg.Answer))
+	for _, r := range tx.msg.Answer {
+		set = append(set, dns.TypeToString[r.Header().Rrtype]+" "+rdata(r))
+	}
+	sort.Strings(set)
+	return set
+}
+
+func sameAnswer(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//tomb 记录不再跟踪的query
+func (s *spoof) tomb(key string, id uint16, now time.Time) {
+	ids, ok := s.tombs[key]
+	if !ok || ids[id].IsZero() {
+		if s.tombN >= s.cfg.max {
+			s.saturated = now
+			return
+		}
+
+		if !ok {
+			ids = make(map[uint16]time.Time)
+			s.tombs[key] = ids
+		}
+		s.tombN++
+	}
+	ids[id] = now
+}
+
+//buried 应答对应的query不再跟踪 id不匹配时只要这个socket有过不跟踪的query也算
+func (s *spoof) buried(key string, id uint16, anyID bool, now time.Time) bool {
+	if !s.saturated.IsZero() && now.Sub(s.saturated) <= time.Duration(s.cfg.wait)*time.Second {
+		return true
+	}
+
+	ids, ok := s.tombs[key]
+	if !ok {
+		return false
+	}
+
+	_, ok = ids[id]
+	return ok || anyID
+}
+
+//add 记录query 表满时返回false 记录到tombs
+func (s *spoof) add(tx *Tx) bool {
+	q, ok := tx.question()
+	if !ok {
+		return true
+	}
+
+	client := tx.Client()
+	name := normalize(q.Name)
+	key := spoofKey(client, tx.src, name)
+
+	if len(s.query) >= s.cfg.max || len(s.clients) >= s.cfg.max {
+		if _, ok := s.clients[client]; ok {
+			s.clients[client] = tx.time
+		}
+		s.tomb(key, tx.msg.Id, tx.time)
+		return false
+	}
+	s.clients[client] = tx.time
+
+	ids, ok := s.byName[key]
+	if !ok {
+		ids = make(map[uint16]*spoofQuery)
+		s.byName[key] = ids
+	}
+
+	//raw socket 下目的地址未知 不比较服务端
+	var server string
+	if tx.daddr != nil {
+		server = tx.daddr.String()
+	}
+
+	sq := &spoofQuery{key: key, name: name, server: server, sport: tx.dst, time: tx.time}
+	ids[tx.msg.Id] = sq
+	s.query[key+"|"+strconv.Itoa(int(tx.msg.Id))] = sq
+	return true
+}
+
+func (s *spoof) remove(id uint16, sq *spoofQuery) {
+	delete(s.query, sq.key+"|"+strconv.Itoa(int(id)))
+	if ids, ok := s.byName[sq.key]; ok {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(s.byName, sq.key)
+		}
+	}
+}
+
+//expire 每秒最多清理一次 超时的query 应答后超过wait秒的query 窗口外的客户端和猜测记录
+//删除的query记录到tombs 再保留wait秒
+func (s *spoof) expire(now time.Time) {
+	if now.Sub(s.sweep) < time.Second {
+		return
+	}
+	s.sweep = now
+
+	wait := time.Duration(s.cfg.wait) * time.Second
+	for _, ids := range s.byName {
+		for id, sq := range ids {
+			last := sq.time
+			if !sq.answered.IsZero() {
+				last = sq.answered
+			}
+
+			if now.Sub(last) > wait {
+				s.remove(id, sq)
+				s.tomb(sq.key, id, now)
+			}
+		}
+	}
+
+	for key, ids := range s.tombs {
+		for id, t := range ids {
+			if now.Sub(t) > wait {
+				delete(ids, id)
+				s.tombN--
+			}
+		}
+
+		if len(ids) == 0 {
+			delete(s.tombs, key)
+		}
+	}
+
+	for client, t := range s.clients {
+		if now.Sub(t) > wait {
+			delete(s.clients, client)
+		}
+	}
+
+	window := time.Duration(s.cfg.window) * time.Second
+	for key, b := range s.bursts {
+		if now.Sub(b.begin) > window {
+			delete(s.bursts, key)
+		}
+	}
+}
+
+func (s *spoof) event(m *monitor, tx *Tx, reason, name string) *Event {
+	return newEvent(m.Name(), "spoof", tx.time).
+		Set("reason", reason).
+		Set("client", tx.Client()).
+		Set("client_port", tx.dst).
+		Set("server", tx.Remote()).
+		Set("server_port", tx.src).
+		Set("qname", name).
+		Set("dns_id", tx.msg.Id).
+		Set("rcode", dns.RcodeToString[tx.msg.Rcode]).
+		Set("answer", answerSet(tx))
+}
+
+func expectIDs(ids map[uint16]*spoofQuery) []string {
+	ss := make([]string, 0, len(ids))
+	for id := range ids {
+		ss = append(ss, strconv.Itoa(int(id)))
+	}
+	sort.Strings(ss)
+	return ss
+}
+
+//burst 异常应答按 原因+客户端+注册域名 计数 Kaminsky攻击会使用随机的子域名
+//窗口内第一次出现时告警 之后只计数 dns_id不匹配的数量达到guesses时再告警一次
+func (s *spoof) burst(reason string, tx *Tx, name string) *spoofBurst {
+	key := reason + "|" + tx.Client() + "|" + parentDomain(name)
+	b, ok := s.bursts[key]
+	if !ok || tx.time.Sub(b.begin) > time.Duration(s.cfg.window)*time.Second {
+		if !ok && len(s.bursts) >= s.cfg.max {
+			return nil
+		}
+		b = &spoofBurst{begin: tx.time, servers: make(map[string]struct{})}
+		s.bursts[key] = b
+	}
+
+	b.count++
+	b.servers[tx.Remote()] = struct{}{}
+	if len(b.ids) < 10 {
+		b.ids = append(b.ids, tx.msg.Id)
+	}
+	return b
+}
+
+func (s *spoof) guessing(m *monitor, tx *Tx, name string, b *spoofBurst) *Event {
+	ids := make([]string, len(b.ids))
+	for i, id := range b.ids {
+		ids[i] = strconv.Itoa(int(id))
+	}
+
+	return s.event(m, tx, "txid_guessing", name).
+		Set("domain", parentDomain(name)).
+		Set("count", b.count).
+		Set("sample_id", ids).
+		Set("servers", sortedKeys(b.servers)).
+		Set("window", s.cfg.window)
+}
+
+//inspect query 记录下来 response 按 客户端 端口 qname dns_id 查找对应的query
+//只在能看到双向流量的输入上启用 见config.validCommon
+func (s *spoof) inspect(m *monitor, tx *Tx) []*Event {
+	client := tx.Client()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(tx.time)
+
+	if !tx.msg.Response {
+		if !s.add(tx) {
+			atomic.AddUint64(&m.stats.spoofSkipped, 1)
+		}
+		return nil
+	}
+
+	q, ok := tx.question()
+	if !ok {
+		return nil
+	}
+	name := normalize(q.Name)
+
+	//没有看到过这个客户端的query 可能只抓到了单向的流量
+	if _, ok := s.clients[client]; !ok {
+		return nil
+	}
+
+	key := spoofKey(client, tx.dst, name)
+	ids, ok := s.byName[key]
+	if !ok {
+		if s.buried(key, tx.msg.Id, true, tx.time) {
+			return nil
+		}
+
+		if b := s.burst("unasked_name", tx, name); b != nil && b.count == 1 {
+			return []*Event{s.event(m, tx, "unasked_name", name)}
+		}
+		return nil
+	}
+
+	sq, ok := ids[tx.msg.Id]
+	if !ok {
+		if s.buried(key, tx.msg.Id, false, tx.time) {
+			return nil
+		}
+
+		b := s.burst("unknown_txid", tx, name)
+		if b == nil {
+			return nil
+		}
+
+		var evs []*Event
+		if b.count == 1 {
+			evs = append(evs, s.event(m, tx, "unknown_txid", name).Set("expect_id", expectIDs(ids)))
+		}
+
+		if b.count == s.cfg.guesses {
+			evs = append(evs, s.guessing(m, tx, name, b))
+		}
+		return evs
+	}
+
+	var evs []*Event
+	if (sq.server != "" && tx.Remote() != sq.server) || tx.src != sq.sport {
+		evs = append(evs, s.event(m, tx, "wrong_server", name).
+			Set("expect_server", sq.server).
+			Set("expect_port", sq.sport))
+	}
+
+	answers := answerSet(tx)
+	if sq.answered.IsZero() {
+		sq.answered, sq.rcode, sq.answers = tx.time, tx.msg.Rcode, answers
+		return evs
+	}
+
+	if sq.reported || (sq.rcode == tx.msg.Rcode && sameAnswer(sq.answers, answers)) {
+		return evs
+	}
+
+	sq.reported = true
+	return append(evs, s.event(m, tx, "conflicting", name).
+		Set("previous_rcode", dns.RcodeToString[sq.rcode]).
+		Set("previous", sq.answers).
+		Set("delay_ms", float64(tx.time.Sub(sq.answered))/float64(time.Millisecond)))
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const spoofClient = "10.0.0.5"
+
+func spoofQ(name string, id, cport uint16, at int) *Tx {
+	var msg dns.Msg
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.Id = id
+	return &Tx{msg: msg, addr: &net.IPAddr{IP: net.ParseIP(spoofClient)}, daddr: net.ParseIP("8.8.8.8"), proto: protoUDP, src: cport, dst: 53, time: time.Unix(1700000000+int64(at), 0)}
+}
+
+func spoofR(name string, id, cport uint16, at int, server, ip string) *Tx {
+	var msg dns.Msg
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.Id = id
+	msg.Response = true
+	msg.Answer = append(msg.Answer, &dns.A{Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(ip)})
+	return &Tx{msg: msg, addr: &net.IPAddr{IP: net.ParseIP(server)}, daddr: net.ParseIP(spoofClient), proto: protoUDP, src: 53, dst: cport, time: time.Unix(1700000000+int64(at), 0)}
+}
+
+func spoofReasons(evs []*Event) string {
+	var rs []string
+	for _, ev := range evs {
+		v, _ := ev.Get("reason")
+		rs = append(rs, v.(string))
+	}
+	return strings.Join(rs, ",")
+}
+
+func checkSpoof(t *testing.T, evs []*Event, want string) {
+	t.Helper()
+	if got := spoofReasons(evs); got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestSpoofConfig(t *testing.T) {
+	cfg := &config{spoof: &spoofConfig{wait: 10, window: 10, guesses: 10, max: 10}}
+	if err := cfg.validCommon(); err == nil || !strings.Contains(err.Error(), "spoof") {
+		t.Fatalf("raw socket got %v", err)
+	}
+
+	cfg.dnstap = true
+	if err := cfg.validCommon(); err != nil && strings.Contains(err.Error(), "spoof") {
+		t.Fatalf("dnstap got %v", err)
+	}
+}
+
+func TestSpoofForged(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	s := newSpoof(&spoofConfig{wait: 10, window: 10, guesses: 3, max: 100})
+
+	//没有看到过query的客户端不检测
+	checkSpoof(t, s.inspect(m, spoofR("a.com", 1, 4000, 0, "8.8.8.8", "1.1.1.1")), "")
+
+	//真实应答之后到达的不同应答
+	checkSpoof(t, s.inspect(m, spoofQ("a.com", 1, 4000, 0)), "")
+	checkSpoof(t, s.inspect(m, spoofR("a.com", 1, 4000, 0, "8.8.8.8", "1.1.1.1")), "")
+	checkSpoof(t, s.inspect(m, spoofR("a.com", 1, 4000, 1, "8.8.8.8", "1.1.1.1")), "")
+	checkSpoof(t, s.inspect(m, spoofR("a.com", 1, 4000, 1, "8.8.8.8", "6.6.6.6")), "conflicting")
+	checkSpoof(t, s.inspect(m, spoofR("a.com", 1, 4000, 1, "8.8.8.8", "7.7.7.7")), "")
+
+	//id正确 服务端地址或者端口不对
+	checkSpoof(t, s.inspect(m, spoofQ("b.com", 2, 4001, 1)), "")
+	checkSpoof(t, s.inspect(m, spoofR("b.com", 2, 4001, 1, "9.9.9.9", "1.1.1.1")), "wrong_server")
+
+	forged := spoofR("c.com", 3, 4002, 1, "8.8.8.8", "1.1.1.1")
+	forged.src = 5353
+	checkSpoof(t, s.inspect(m, spoofQ("c.com", 3, 4002, 1)), "")
+	checkSpoof(t, s.inspect(m, forged), "wrong_server")
+
+	//id不对
+	checkSpoof(t, s.inspect(m, spoofQ("d.com", 4, 4003, 1)), "")
+	evs := s.inspect(m, spoofR("d.com", 44, 4003, 1, "8.8.8.8", "6.6.6.6"))
+	checkSpoof(t, evs, "unknown_txid")
+	if v, _ := evs[0].Get("expect_id"); strings.Join(v.([]string), ",") != "4" {
+		t.Fatalf("expect_id got %v", v)
+	}
+
+	//没有发出过的名字 同一个窗口内只告警一次
+	checkSpoof(t, s.inspect(m, spoofR("x.evil.com", 9, 4004, 1, "8.8.8.8", "1.1.1.1")), "unasked_name")
+	checkSpoof(t, s.inspect(m, spoofR("y.evil.com", 9, 4004, 1, "8.8.8.8", "1.1.1.1")), "")
+}
+
+//TestSpoofGuessing Kaminsky攻击 随机子域名和错误的dns_id
+func TestSpoofGuessing(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	s := newSpoof(&spoofConfig{wait: 10, window: 10, guesses: 3, max: 100})
+
+	for i, want := range []string{"unknown_txid", "", "txid_guessing", "", ""} {
+		name := string(rune('a'+i)) + ".victim.com"
+		s.inspect(m, spoofQ(name, 100, 5000, 2))
+		checkSpoof(t, s.inspect(m, spoofR(name, uint16(200+i), 5000, 2, "8.8.8.8", "6.6.6.6")), want)
+	}
+
+	//等待时间过后query 客户端 和计数都清理掉
+	checkSpoof(t, s.inspect(m, spoofR("a.com", 1, 4000, 30, "8.8.8.8", "1.1.1.1")), "")
+	if len(s.query) != 0 || len(s.clients) != 0 || len(s.bursts) != 0 {
+		t.Fatalf("got query %d clients %d bursts %d", len(s.query), len(s.clients), len(s.bursts))
+	}
+}
+
+//TestSpoofTomb 超时删除和表满没有记录的query 之后到达的应答不告警
+func TestSpoofTomb(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	s := newSpoof(&spoofConfig{wait: 10, window: 10, guesses: 3, max: 2})
+
+	s.inspect(m, spoofQ("late.com", 1, 4000, 0))
+	s.inspect(m, spoofQ("other.com", 2, 4001, 1))
+	s.inspect(m, spoofQ("x.com", 3, 4002, 12))
+	checkSpoof(t, s.inspect(m, spoofR("late.com", 1, 4000, 13, "8.8.8.8", "1.1.1.1")), "")
+
+	s.inspect(m, spoofQ("y.com", 4, 4003, 13))
+	s.inspect(m, spoofQ("z.com", 5, 4004, 13))
+	if m.stats.spoofSkipped == 0 {
+		t.Fatal("skipped query not counted")
+	}
+	checkSpoof(t, s.inspect(m, spoofR("z.com", 5, 4004, 14, "8.8.8.8", "1.1.1.1")), "")
+}
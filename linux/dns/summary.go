@@ -0,0 +1,339 @@
+package dns
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/lua"
+	"sort"
+	"sync"
+	"time"
+)
+
+//summaryConfig 每interval秒输出一次汇总 top统计使用space-saving算法 内存只和capacity有关
+type summaryConfig struct {
+	interval int    //输出间隔 秒
+	top      int    //每个排行输出的数量
+	capacity int    //每个排行跟踪的计数器数量 越大越准确
+	forward  string //tx的输出 all全部 suspicious只输出可疑的 none不输出
+	allow    bool   //suspicious时命中白名单的tx也输出
+}
+
+func newSummaryConfig(L *lua.LState, val lua.LValue) *summaryConfig {
+	cfg := &summaryConfig{interval: 60, top: 20, capacity: 1000, forward: "all"}
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "interval":
+				cfg.interval = checkInt(L, key, v)
+			case "top":
+				cfg.top = checkInt(L, key, v)
+			case "capacity":
+				cfg.capacity = checkInt(L, key, v)
+			case "forward":
+				cfg.forward = v.String()
+			case "allow":
+				cfg.allow = lua.CheckBool(L, v)
+			default:
+				L.RaiseError("summary config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("summary must be bool or table , got %s", val.Type().String())
+	}
+
+	return cfg
+}
+
+func (cfg *summaryConfig) valid() error {
+	if cfg.interval <= 0 || cfg.top <= 0 || cfg.capacity < cfg.top {
+		return fmt.Errorf("invalid summary config")
+	}
+
+	switch cfg.forward {
+	case "all", "suspicious", "none":
+		return nil
+	default:
+		return fmt.Errorf("invalid summary forward %s", cfg.forward)
+	}
+}
+
+//ssItem count是估计值 err是被替换时继承的计数 真实值在 count-err 和 count 之间
+type ssItem struct {
+	key   string
+	count uint64
+	err   uint64
+	index int
+}
+
+//ssHeap 按count的最小堆 堆顶是被替换的计数器
+type ssHeap []*ssItem
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ssHeap) Push(x interface{}) {
+	item := x.(*ssItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+//spaceSaving Metwally的space-saving算法 capacity个计数器 满了替换最小的
+type spaceSaving struct {
+	capacity int
+	items    map[string]*ssItem
+	heap     ssHeap
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, items: make(map[string]*ssItem, capacity)}
+}
+
+func (s *spaceSaving) add(key string) {
+	if item, ok := s.items[key]; ok {
+		item.count++
+		heap.Fix(&s.heap, item.index)
+		return
+	}
+
+	if len(s.heap) < s.capacity {
+		item := &ssItem{key: key, count: 1}
+		s.items[key] = item
+		heap.Push(&s.heap, item)
+		return
+	}
+
+	min := s.heap[0]
+	delete(s.items, min.key)
+	min.key = key
+	min.err = min.count
+	min.count++
+	s.items[key] = min
+	heap.Fix(&s.heap, 0)
+}
+
+//top 按count倒序的前n个
+func (s *spaceSaving) top(n int, field string) []map[string]interface{} {
+	items := make([]*ssItem, len(s.heap))
+	copy(items, s.heap)
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].count != items[j].count {
+			return items[i].count > items[j].count
+		}
+		return items[i].key < items[j].key
+	})
+
+	if len(items) > n {
+		items = items[:n]
+	}
+
+	rows := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		rows[i] = map[string]interface{}{
+			field:   item.key,
+			"count": item.count,
+			"error": item.err,
+		}
+	}
+	return rows
+}
+
+//histogram 按数量倒序
+func histogram(m map[string]uint64, field string) []map[string]interface{} {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	rows := make([]map[string]interface{}, len(keys))
+	for i, k := range keys {
+		rows[i] = map[string]interface{}{field: k, "count": m[k]}
+	}
+	return rows
+}
+
+type summary struct {
+	mu        sync.Mutex
+	cfg       *summaryConfig
+	begin     time.Time
+	packets   uint64
+	queries   uint64
+	responses uint64
+	bytes     uint64
+	qtype     map[string]uint64
+	rcode     map[string]uint64
+	service   map[string]uint64
+	qnames    *spaceSaving
+	clients   *spaceSaving
+	nxdomain  *spaceSaving
+}
+
+func newSummary(cfg *summaryConfig) *summary {
+	s := &summary{cfg: cfg}
+	s.reset(time.Time{})
+	return s
+}
+
+func (s *summary) reset(now time.Time) {
+	s.begin = now
+	s.packets, s.queries, s.responses, s.bytes = 0, 0, 0, 0
+	s.qtype = make(map[string]uint64)
+	s.rcode = make(map[string]uint64)
+	s.service = make(map[string]uint64)
+	s.qnames = newSpaceSaving(s.cfg.capacity)
+	s.clients = newSpaceSaving(s.cfg.capacity)
+	s.nxdomain = newSpaceSaving(s.cfg.capacity)
+}
+
+//observe qname和客户端按query统计 nxdomain按应答统计
+func (s *summary) observe(tx *Tx) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.begin.IsZero() {
+		s.begin = tx.time
+	}
+
+	s.packets++
+	s.bytes += uint64(tx.size)
+	s.service[tx.service]++
+
+	name := normalize(tx.Qname())
+	if q, ok := tx.question(); ok {
+		s.qtype[dns.TypeToString[q.Qtype]]++
+	}
+
+	if !tx.msg.Response {
+		s.queries++
+		if name != "" {
+			s.qnames.add(name)
+		}
+
+		if client := tx.Client(); client != "" {
+			s.clients.add(client)
+		}
+		return
+	}
+
+	s.responses++
+	s.rcode[dns.RcodeToString[tx.msg.Rcode]]++
+	if tx.msg.Rcode == dns.RcodeNameError && name != "" {
+		s.nxdomain.add(name)
+	}
+}
+
+//report 每interval秒输出一次 没有流量时也输出
+func (s *summary) report(m *monitor, now time.Time) *Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.begin.IsZero() {
+		s.begin = now
+		return nil
+	}
+
+	if now.Sub(s.begin) < time.Duration(s.cfg.interval)*time.Second {
+		return nil
+	}
+
+	return s.collect(m, now)
+}
+
+//flush 立即输出 离线回放结束时调用
+func (s *summary) flush(m *monitor, now time.Time) *Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.packets == 0 {
+		return nil
+	}
+	return s.collect(m, now)
+}
+
+func (s *summary) collect(m *monitor, now time.Time) *Event {
+	ev := newEvent(m.Name(), "summary", now).
+		Set("begin", s.begin.Unix()).
+		Set("end", now.Unix()).
+		Set("interval", s.cfg.interval).
+		Set("packets", s.packets).
+		Set("queries", s.queries).
+		Set("responses", s.responses).
+		Set("bytes", s.bytes).
+		Set("qtype", histogram(s.qtype, "qtype")).
+		Set("rcode", histogram(s.rcode, "rcode")).
+		Set("service", histogram(s.service, "service")).
+		Set("top_qname", s.qnames.top(s.cfg.top, "qname")).
+		Set("top_client", s.clients.top(s.cfg.top, "client")).
+		Set("top_nxdomain", s.nxdomain.top(s.cfg.top, "qname"))
+
+	s.reset(now)
+	return ev
+}
+
+//suspicious 命中黑名单 产生过检测事件 rebinding 仿冒品牌 隧道打分或者dga打分超过阈值的tx
+//命中白名单的只在配置了allow时算
+func (m *monitor) suspicious(tx *Tx) bool {
+	if len(tx.allow) > 0 && m.sum.cfg.allow {
+		return true
+	}
+
+	if len(tx.deny) > 0 || tx.alerted || tx.rebinding || tx.homographOf != "" || tx.typosquatOf != "" {
+		return true
+	}
+
+	if m.tun != nil && tx.tunnelScore >= m.tun.cfg.score {
+		return true
+	}
+
+	if m.dga != nil && tx.msg.Response && tx.msg.Rcode == dns.RcodeNameError {
+		score, _ := tx.dga()
+		return score >= m.dga.cfg.score
+	}
+
+	return false
+}
+
+//forward 开启汇总后按forward过滤输出的tx 事件不受影响
+func (m *monitor) forward(tx *Tx) bool {
+	if m.sum == nil {
+		return true
+	}
+
+	switch m.sum.cfg.forward {
+	case "none":
+		return false
+	case "suspicious":
+		return m.suspicious(tx)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,157 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//TestSpaceSavingBound 真实值在count-error和count之间 error不超过总数/capacity 超过总数/capacity的key一定在表中
+func TestSpaceSavingBound(t *testing.T) {
+	const capacity, total = 50, 100000
+
+	s := newSpaceSaving(capacity)
+	exact := make(map[string]uint64)
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.2, 1, 5000)
+
+	for i := 0; i < total; i++ {
+		key := "q" + strconv.FormatUint(zipf.Uint64(), 10)
+		exact[key]++
+		s.add(key)
+	}
+
+	if len(s.items) != capacity || len(s.heap) != capacity {
+		t.Fatalf("got %d items %d heap", len(s.items), len(s.heap))
+	}
+
+	bound := uint64(total / capacity)
+	for key, item := range s.items {
+		n := exact[key]
+		if item.count < n || item.count-item.err > n || item.err > bound {
+			t.Fatalf("%s got count %d error %d exact %d", key, item.count, item.err, n)
+		}
+	}
+
+	for key, n := range exact {
+		if _, ok := s.items[key]; n > bound && !ok {
+			t.Fatalf("%s exact %d not tracked", key, n)
+		}
+	}
+
+	rows := s.top(3, "qname")
+	for i, want := range []string{"q0", "q1", "q2"} {
+		if rows[i]["qname"] != want {
+			t.Fatalf("top %d got %v want %s", i, rows[i]["qname"], want)
+		}
+	}
+}
+
+func TestSummaryReport(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	s := newSummary(&summaryConfig{interval: 60, top: 3, capacity: 10, forward: "all"})
+
+	//第一次调用只记录开始时间
+	if ev := s.report(m, pfEpoch); ev != nil {
+		t.Fatal("report before begin")
+	}
+
+	for i := 0; i < 30; i++ {
+		q := pfQ("10.0.0.5", "h"+strconv.Itoa(i%3)+".example.com", float64(i))
+		q.size = 40
+		s.observe(q)
+
+		r := pfR("10.0.0.5", "bad.example.com", float64(i), dns.RcodeNameError)
+		r.size = 60
+		s.observe(r)
+	}
+
+	if ev := s.report(m, pfEpoch.Add(59*time.Second)); ev != nil {
+		t.Fatal("report before interval")
+	}
+
+	ev := s.report(m, pfEpoch.Add(60*time.Second))
+	if ev == nil {
+		t.Fatal("no report after interval")
+	}
+
+	for k, want := range map[string]interface{}{
+		"begin":     pfEpoch.Unix(),
+		"end":       pfEpoch.Unix() + 60,
+		"packets":   uint64(60),
+		"queries":   uint64(30),
+		"responses": uint64(30),
+		"bytes":     uint64(3000),
+	} {
+		if v, _ := ev.Get(k); v != want {
+			t.Fatalf("%s got %v want %v", k, v, want)
+		}
+	}
+
+	if v, _ := ev.Get("top_nxdomain"); v.([]map[string]interface{})[0]["count"] != uint64(30) {
+		t.Fatalf("top_nxdomain got %v", v)
+	}
+
+	if v, _ := ev.Get("top_client"); len(v.([]map[string]interface{})) != 1 {
+		t.Fatalf("top_client got %v", v)
+	}
+
+	//下一个周期从上次输出时开始 没有流量也输出
+	if ev = s.report(m, pfEpoch.Add(119*time.Second)); ev != nil {
+		t.Fatal("report before next interval")
+	}
+
+	ev = s.report(m, pfEpoch.Add(120*time.Second))
+	if ev == nil {
+		t.Fatal("no report for idle interval")
+	}
+
+	if v, _ := ev.Get("begin"); v != pfEpoch.Unix()+60 {
+		t.Fatalf("begin got %v", v)
+	}
+
+	if v, _ := ev.Get("packets"); v != uint64(0) {
+		t.Fatalf("packets got %v", v)
+	}
+
+	if ev = s.flush(m, pfEpoch.Add(121*time.Second)); ev != nil {
+		t.Fatal("flush without packets")
+	}
+}
+
+func TestSummaryForward(t *testing.T) {
+	cfg := &summaryConfig{interval: 60, top: 3, capacity: 10, forward: "suspicious"}
+	m := &monitor{cfg: &config{name: "dns"}, sum: newSummary(cfg)}
+
+	plain := pfQ("10.0.0.5", "a.com", 0)
+	denied := pfQ("10.0.0.5", "evil.com", 0)
+	denied.deny = []listMatch{{list: "ioc", rule: "evil.com"}}
+	allowed := pfQ("10.0.0.5", "corp.com", 0)
+	allowed.allow = []listMatch{{list: "corp", rule: "corp.com"}}
+	rebind := pfQ("10.0.0.5", "r.com", 0)
+	rebind.rebinding = true
+
+	for tx, want := range map[*Tx]bool{plain: false, denied: true, allowed: false, rebind: true} {
+		if m.forward(tx) != want {
+			t.Fatalf("%s forward want %v", tx.Qname(), want)
+		}
+	}
+
+	//白名单只在显式配置时输出
+	cfg.allow = true
+	if !m.forward(allowed) || m.forward(plain) {
+		t.Fatal("allow not forwarded")
+	}
+
+	cfg.forward = "none"
+	if m.forward(denied) {
+		t.Fatal("none forwarded")
+	}
+
+	m.sum = nil
+	if !m.forward(plain) {
+		t.Fatal("forward without summary")
+	}
+}
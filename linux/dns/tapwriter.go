@@ -0,0 +1,426 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/rock-go/rock/auxlib"
+	"github.com/rock-go/rock/lua"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+var tapWriterTypeof = reflect.TypeOf((*tapWriter)(nil)).String()
+
+//tapRole 没有dnstap来源信息时 按角色生成消息类型 response 是 query+1
+var tapRole = map[string]uint64{
+	"auth":      1,
+	"resolver":  3,
+	"client":    5,
+	"forwarder": 7,
+	"stub":      9,
+	"tool":      11,
+}
+
+//tapWriterConfig path 写入Frame Streams文件 remote 发送给dnstap的接收端
+type tapWriterConfig struct {
+	name     string
+	rotate   rotateConfig
+	remote   auxlib.URL
+	identity string
+	version  string
+	role     string
+	queue    int
+}
+
+func newTapWriterConfig(L *lua.LState) *tapWriterConfig {
+	cfg := &tapWriterConfig{version: "rock-beat", role: "client", queue: 4096}
+	cfg.identity, _ = os.Hostname()
+
+	tab := L.CheckTable(1)
+	tab.Range(func(key string, val lua.LValue) {
+		if cfg.rotate.set(L, key, val) {
+			return
+		}
+
+		switch key {
+		case "name":
+			cfg.name = val.String()
+		case "remote":
+			cfg.remote = auxlib.CheckURL(val, L)
+		case "identity":
+			cfg.identity = val.String()
+		case "version":
+			cfg.version = val.String()
+		case "role":
+			cfg.role = val.String()
+		case "queue":
+			cfg.queue = checkInt(L, key, val)
+		default:
+			L.RaiseError("dnstap_writer config not found %s field", key)
+		}
+	})
+
+	return cfg
+}
+
+func (cfg *tapWriterConfig) valid() error {
+	if _, ok := tapRole[cfg.role]; !ok {
+		return fmt.Errorf("invalid dnstap_writer role %s", cfg.role)
+	}
+
+	if cfg.queue <= 0 {
+		return fmt.Errorf("invalid dnstap_writer queue")
+	}
+
+	if cfg.remote.IsNil() {
+		return cfg.rotate.valid()
+	}
+
+	if cfg.rotate.path != "" {
+		return fmt.Errorf("dnstap_writer path and remote only one")
+	}
+
+	switch cfg.remote.Scheme() {
+	case "unix":
+		if cfg.remote.Path() == "" {
+			return fmt.Errorf("not found dnstap_writer unix socket path")
+		}
+	case "tcp":
+		if cfg.remote.Port() == 0 {
+			return fmt.Errorf("not found dnstap_writer remote port")
+		}
+	default:
+		return fmt.Errorf("dnstap_writer not support %s", cfg.remote.Scheme())
+	}
+	return nil
+}
+
+//tapWriter 把每个tx编码成dnstap消息
+type tapWriter struct {
+	lua.Super
+	cfg  *tapWriterConfig
+	sink *sink
+}
+
+func newTapWriter(cfg *tapWriterConfig) *tapWriter {
+	w := &tapWriter{cfg: cfg, sink: newSink(cfg.queue)}
+	w.V(tapWriterTypeof, lua.INIT)
+	return w
+}
+
+func (w *tapWriter) Name() string {
+	return w.cfg.name
+}
+
+func (w *tapWriter) Type() string {
+	return tapWriterTypeof
+}
+
+func (w *tapWriter) Start() error {
+	if e := w.cfg.valid(); e != nil {
+		return e
+	}
+
+	var out output
+	if w.cfg.remote.IsNil() {
+		var start, stop bytes.Buffer
+		fstrmWrite(&start, fstrmStart, dnstapContentType)
+		fstrmWrite(&stop, fstrmStop)
+
+		f := newRotateFile(w.cfg.rotate, start.Bytes(), stop.Bytes())
+		if e := f.open(time.Now()); e != nil {
+			return e
+		}
+		out = f
+	} else {
+		out = newTapConn(w.cfg.remote)
+	}
+
+	w.sink.start(w.Name(), out)
+	return nil
+}
+
+func (w *tapWriter) Close() error {
+	w.sink.stop()
+	return nil
+}
+
+//Write 只接收tx
+func (w *tapWriter) Write(b []byte) (int, error) {
+	return 0, fmt.Errorf("%s only accept dns tx", w.Name())
+}
+
+func (w *tapWriter) WriteTx(tx *Tx) error {
+	if len(tx.wire) == 0 {
+		return nil
+	}
+
+	pb, err := w.encode(tx)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4, 4+len(pb))
+	binary.BigEndian.PutUint32(frame, uint32(len(pb)))
+	return w.sink.push(append(frame, pb...))
+}
+
+func (w *tapWriter) statsL(L *lua.LState) int {
+	L.Push(w.sink.stats.table(L))
+	return 1
+}
+
+func (w *tapWriter) Index(L *lua.LState, key string) lua.LValue {
+	switch key {
+	case "stats":
+		return L.NewFunction(w.statsL)
+	}
+	return lua.LNil
+}
+
+//kind dnstap输入的tx保留原来的消息类型
+func (w *tapWriter) kind(tx *Tx) uint64 {
+	if tx.tap != nil {
+		for k, name := range dnstapType {
+			if name == tx.tap.kind {
+				return k
+			}
+		}
+	}
+
+	k := tapRole[w.cfg.role]
+	if tx.msg.Response {
+		k++
+	}
+	return k
+}
+
+//encode dnstap.Dnstap type=MESSAGE query的地址是客户端 response的地址是服务端
+func (w *tapWriter) encode(tx *Tx) ([]byte, error) {
+	identity, version := w.cfg.identity, w.cfg.version
+	if tx.tap != nil {
+		identity, version = tx.tap.identity, tx.tap.version
+	}
+
+	addr, ok := tx.addr.(*net.IPAddr)
+	if !ok {
+		return nil, errTxAddr
+	}
+
+	src := addr.IP
+	dst := tx.daddr
+
+	family := uint64(2)
+	if v4 := src.To4(); v4 != nil {
+		family, src = 1, v4
+		dst = dst.To4()
+	}
+
+	protocol := uint64(1)
+	if tx.proto == protoTCP {
+		protocol = 2
+	}
+
+	var m pbWriter
+	m.varint(1, w.kind(tx))
+	m.varint(2, family)
+	m.varint(3, protocol)
+
+	sec, nsec := uint64(tx.time.Unix()), uint32(tx.time.Nanosecond())
+	if tx.msg.Response {
+		if dst != nil {
+			m.bytes(4, dst)
+		}
+		m.bytes(5, src)
+		m.varint(6, uint64(tx.dst))
+		m.varint(7, uint64(tx.src))
+		m.varint(12, sec)
+		m.fixed32(13, nsec)
+		m.bytes(14, tx.wire)
+	} else {
+		m.bytes(4, src)
+		if dst != nil {
+			m.bytes(5, dst)
+		}
+		m.varint(6, uint64(tx.src))
+		m.varint(7, uint64(tx.dst))
+		m.varint(8, sec)
+		m.fixed32(9, nsec)
+		m.bytes(10, tx.wire)
+	}
+
+	var d pbWriter
+	d.bytes(1, []byte(identity))
+	d.bytes(2, []byte(version))
+	d.bytes(14, m.buf)
+	d.varint(15, 1)
+	return d.buf, nil
+}
+
+//pbWriter 只实现dnstap需要的protobuf编码
+type pbWriter struct {
+	buf []byte
+}
+
+func (w *pbWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf = append(w.buf, b[:n]...)
+}
+
+func (w *pbWriter) varint(field, v uint64) {
+	w.uvarint(field << 3)
+	w.uvarint(v)
+}
+
+func (w *pbWriter) bytes(field uint64, b []byte) {
+	w.uvarint(field<<3 | 2)
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *pbWriter) fixed32(field uint64, v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	w.uvarint(field<<3 | 5)
+	w.buf = append(w.buf, b[:]...)
+}
+
+//tapConn Frame Streams 双向模式的发送端 READY -> ACCEPT -> START 断开后等待重连
+type tapConn struct {
+	network string
+	addr    string
+	conn    net.Conn
+	w       *bufio.Writer
+	retry   time.Time
+}
+
+func newTapConn(remote auxlib.URL) *tapConn {
+	if remote.Scheme() == "unix" {
+		return &tapConn{network: "unix", addr: remote.Path()}
+	}
+	return &tapConn{network: "tcp", addr: net.JoinHostPort(remote.Hostname(), strconv.Itoa(remote.Port()))}
+}
+
+func (c *tapConn) dial(now time.Time) error {
+	conn, err := net.DialTimeout(c.network, c.addr, 3*time.Second)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(now.Add(3 * time.Second))
+	if err = c.handshake(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.conn = conn
+	c.w = bufio.NewWriterSize(conn, 64*1024)
+	return nil
+}
+
+func (c *tapConn) handshake(conn net.Conn) error {
+	if err := fstrmWrite(conn, fstrmReady, dnstapContentType); err != nil {
+		return err
+	}
+
+	var esc [4]byte
+	if _, err := io.ReadFull(conn, esc[:]); err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint32(esc[:]) != 0 {
+		return fmt.Errorf("fstrm expect accept frame")
+	}
+
+	typ, types, err := fstrmControl(conn)
+	if err != nil {
+		return err
+	}
+
+	if typ != fstrmAccept || !hasContentType(types) {
+		return fmt.Errorf("fstrm %s not accept %s", c.addr, dnstapContentType)
+	}
+
+	return fstrmWrite(conn, fstrmStart, dnstapContentType)
+}
+
+func (c *tapConn) reset(now time.Time) {
+	c.conn.Close()
+	c.conn = nil
+	c.w = nil
+	c.retry = now.Add(5 * time.Second)
+}
+
+func (c *tapConn) write(b []byte, now time.Time) error {
+	if c.conn == nil {
+		if now.Before(c.retry) {
+			return errOutputDown
+		}
+
+		if err := c.dial(now); err != nil {
+			c.retry = now.Add(5 * time.Second)
+			return err
+		}
+	}
+
+	c.conn.SetWriteDeadline(now.Add(3 * time.Second))
+	if _, err := c.w.Write(b); err != nil {
+		c.reset(now)
+		return err
+	}
+	return nil
+}
+
+func (c *tapConn) tick(now time.Time) error {
+	if c.conn == nil {
+		return nil
+	}
+
+	c.conn.SetWriteDeadline(now.Add(3 * time.Second))
+	if err := c.w.Flush(); err != nil {
+		c.reset(now)
+		return err
+	}
+	return nil
+}
+
+//close 发送STOP 等待接收端回复FINISH
+func (c *tapConn) close() error {
+	if c.conn == nil {
+		return nil
+	}
+
+	defer func() {
+		c.conn.Close()
+		c.conn = nil
+		c.w = nil
+	}()
+
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	if err := fstrmWrite(c.conn, fstrmStop); err != nil {
+		return err
+	}
+
+	var esc [4]byte
+	if _, err := io.ReadFull(c.conn, esc[:]); err != nil {
+		return err
+	}
+
+	typ, _, err := fstrmControl(c.conn)
+	if err == nil && typ != fstrmFinish {
+		err = fmt.Errorf("fstrm expect finish frame got %d", typ)
+	}
+	return err
+}
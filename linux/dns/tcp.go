@@ -0,0 +1,198 @@
+package dns
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpRst = 0x04
+
+	tcpStreamMax     = 4096
+	tcpStreamIdle    = 30 * time.Second
+	tcpStreamBufSize = 65535 + 2
+)
+
+type tcpHeader struct {
+	Source      uint16
+	Destination uint16
+	Seq         uint32
+	Flags       uint8
+	Payload     []byte
+}
+
+func newTCPHeader(b []byte) *tcpHeader {
+	if len(b) < 20 {
+		return nil
+	}
+
+	offset := int(b[12]>>4) * 4
+	if offset < 20 || offset > len(b) {
+		return nil
+	}
+
+	return &tcpHeader{
+		Source:      binary.BigEndian.Uint16(b[0:2]),
+		Destination: binary.BigEndian.Uint16(b[2:4]),
+		Seq:         binary.BigEndian.Uint32(b[4:8]),
+		Flags:       b[13],
+		Payload:     b[offset:],
+	}
+}
+
+//一条tcp流 remote:source -> destination
+type streamKey struct {
+	remote string
+	src    uint16
+	dst    uint16
+}
+
+//sync 从SYN开始跟踪的流才知道长度前缀的位置 中途看到的流和丢包后的流都不同步
+type stream struct {
+	next uint32
+	sync bool
+	buf  []byte
+	last time.Time
+}
+
+//reset 丢包或者缓冲溢出后无法找到下一个长度前缀 丢弃数据直到下一个SYN
+func (s *stream) reset() {
+	s.sync = false
+	s.buf = nil
+}
+
+//对齐数据 返回需要追加的部分 重传的数据直接丢弃
+func (s *stream) align(seq uint32, data []byte) []byte {
+	diff := int32(seq - s.next)
+	switch {
+	case diff == 0:
+		return data
+
+	case diff > 0:
+		//中间有丢包 无法还原
+		s.reset()
+		return nil
+
+	default:
+		overlap := int(-diff)
+		if overlap >= len(data) {
+			return nil
+		}
+		return data[overlap:]
+	}
+}
+
+//拆分 2字节长度前缀的dns报文
+func (s *stream) split() [][]byte {
+	var msgs [][]byte
+	for {
+		if len(s.buf) < 2 {
+			break
+		}
+
+		size := int(binary.BigEndian.Uint16(s.buf[0:2]))
+		if len(s.buf) < size+2 {
+			break
+		}
+
+		msg := make([]byte, size)
+		copy(msg, s.buf[2:size+2])
+		msgs = append(msgs, msg)
+		s.buf = s.buf[size+2:]
+	}
+
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+
+	return msgs
+}
+
+//push 追加对齐后的数据 返回完整的dns报文
+func (s *stream) push(seq uint32, payload []byte) [][]byte {
+	data := s.align(seq, payload)
+	if len(data) == 0 {
+		return nil
+	}
+	s.next = seq + uint32(len(payload))
+
+	//拆分后剩下的不完整报文不超过tcpStreamBufSize 再追加一个分片也不会超过两倍
+	if len(s.buf)+len(data) > 2*tcpStreamBufSize {
+		s.reset()
+		return nil
+	}
+
+	s.buf = append(s.buf, data...)
+	return s.split()
+}
+
+type assembler struct {
+	mu      sync.Mutex
+	streams map[streamKey]*stream
+	sweep   time.Time
+}
+
+func newAssembler() *assembler {
+	return &assembler{streams: make(map[streamKey]*stream)}
+}
+
+func (a *assembler) expire(now time.Time) {
+	if now.Sub(a.sweep) < tcpStreamIdle {
+		return
+	}
+	a.sweep = now
+
+	for key, s := range a.streams {
+		if now.Sub(s.last) > tcpStreamIdle {
+			delete(a.streams, key)
+		}
+	}
+}
+
+//feed 追加一个tcp分片 返回当前已经完整的dns报文
+func (a *assembler) feed(remote string, tcp *tcpHeader, now time.Time) [][]byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.expire(now)
+
+	key := streamKey{remote: remote, src: tcp.Source, dst: tcp.Destination}
+	s, ok := a.streams[key]
+
+	if tcp.Flags&tcpRst != 0 {
+		delete(a.streams, key)
+		return nil
+	}
+
+	if !ok {
+		if len(a.streams) >= tcpStreamMax {
+			return nil
+		}
+		s = &stream{}
+		a.streams[key] = s
+	}
+	s.last = now
+
+	seq := tcp.Seq
+	if tcp.Flags&tcpSyn != 0 {
+		s.sync = true
+		s.next = seq + 1
+		s.buf = nil
+		seq++
+	}
+
+	//没有从SYN开始跟踪的流不知道报文边界 直接丢弃
+	var msgs [][]byte
+	if s.sync {
+		msgs = s.push(seq, tcp.Payload)
+	}
+
+	if tcp.Flags&tcpFin != 0 {
+		delete(a.streams, key)
+	}
+
+	return msgs
+}
@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+const tcpTestRemote = "192.0.2.1"
+
+func tcpSeg(seq uint32, flags uint8, payload []byte) *tcpHeader {
+	return &tcpHeader{Source: 40000, Destination: 53, Seq: seq, Flags: flags, Payload: payload}
+}
+
+//tcpFrame 带2字节长度前缀的报文 内容是size个b
+func tcpFrame(size int, b byte) []byte {
+	frame := make([]byte, size+2)
+	binary.BigEndian.PutUint16(frame, uint16(size))
+	for i := 2; i < len(frame); i++ {
+		frame[i] = b
+	}
+	return frame
+}
+
+//tcpOpen 新建一条从SYN开始的流 第一个数据分片的seq是101
+func tcpOpen(t *testing.T) (*assembler, time.Time) {
+	a := newAssembler()
+	now := time.Now()
+	if msgs := a.feed(tcpTestRemote, tcpSeg(100, tcpSyn, nil), now); len(msgs) != 0 {
+		t.Fatalf("syn got %d messages", len(msgs))
+	}
+	return a, now
+}
+
+func checkMsgs(t *testing.T, got [][]byte, want ...[]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		if !bytes.Equal(got[i], want[i][2:]) {
+			t.Fatalf("message %d got %d bytes want %d", i, len(got[i]), len(want[i])-2)
+		}
+	}
+}
+
+func TestAssemblerPipelined(t *testing.T) {
+	a, now := tcpOpen(t)
+	f1, f2, f3 := tcpFrame(30, 1), tcpFrame(40, 2), tcpFrame(50, 3)
+
+	data := append(append(append([]byte(nil), f1...), f2...), f3...)
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, 0, data), now), f1, f2, f3)
+}
+
+func TestAssemblerSplit(t *testing.T) {
+	a, now := tcpOpen(t)
+	f1, f2 := tcpFrame(30, 1), tcpFrame(40, 2)
+	data := append(append([]byte(nil), f1...), f2...)
+
+	//长度前缀也被拆开
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, 0, data[:1]), now))
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(102, 0, data[1:20]), now))
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(120, 0, data[19:40]), now), f1)
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(141, 0, data[40:]), now), f2)
+}
+
+func TestAssemblerLargeMessage(t *testing.T) {
+	a, now := tcpOpen(t)
+	f1, f2 := tcpFrame(65535, 1), tcpFrame(100, 2)
+
+	//缓冲中是一个接近上限的不完整报文 下一个分片带着它的结尾和下一个报文
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, 0, f1[:65000]), now))
+	rest := append(append([]byte(nil), f1[65000:]...), f2...)
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101+65000, 0, rest), now), f1, f2)
+}
+
+func TestAssemblerRetransmit(t *testing.T) {
+	a, now := tcpOpen(t)
+	f1, f2 := tcpFrame(30, 1), tcpFrame(40, 2)
+	data := append(append([]byte(nil), f1...), f2...)
+
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, 0, data[:20]), now))
+
+	//完全重传的分片丢弃
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, 0, data[:20]), now))
+
+	//和已有数据重叠的分片只追加新的部分
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(111, 0, data[10:50]), now), f1)
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, 0, data), now), f2)
+}
+
+func TestAssemblerGap(t *testing.T) {
+	a, now := tcpOpen(t)
+	f1, f2 := tcpFrame(30, 1), tcpFrame(40, 2)
+
+	//丢失了f1的前10个字节 之后的数据都丢弃
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(111, 0, f1[10:]), now))
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101+uint32(len(f1)), 0, f2), now))
+
+	//新的SYN重新同步
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(5000, tcpSyn, nil), now))
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(5001, 0, f2), now), f2)
+}
+
+func TestAssemblerMidStream(t *testing.T) {
+	a := newAssembler()
+	now := time.Now()
+	f1 := tcpFrame(30, 1)
+
+	//没有SYN的流不知道长度前缀的位置
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, 0, f1), now))
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101+uint32(len(f1)), 0, f1), now))
+}
+
+func TestAssemblerClose(t *testing.T) {
+	a, now := tcpOpen(t)
+	f1 := tcpFrame(30, 1)
+
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, 0, f1[:10]), now))
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(111, tcpRst, f1[10:]), now))
+	if len(a.streams) != 0 {
+		t.Fatal("stream not removed after rst")
+	}
+
+	//rst之后的数据当作没有SYN的流
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, 0, f1), now))
+
+	a, now = tcpOpen(t)
+	checkMsgs(t, a.feed(tcpTestRemote, tcpSeg(101, tcpFin, f1), now), f1)
+	if len(a.streams) != 0 {
+		t.Fatal("stream not removed after fin")
+	}
+}
+
+func TestAssemblerExpire(t *testing.T) {
+	a, now := tcpOpen(t)
+	a.feed(tcpTestRemote, tcpSeg(101, 0, tcpFrame(30, 1)[:10]), now)
+
+	a.feed("192.0.2.2", tcpSeg(1, tcpSyn, nil), now.Add(2*tcpStreamIdle))
+	if len(a.streams) != 1 {
+		t.Fatalf("got %d streams after idle", len(a.streams))
+	}
+}
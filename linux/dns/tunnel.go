@@ -0,0 +1,316 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/lua"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+//tunnelConfig dns隧道检测的阈值 按注册域名在窗口内统计
+type tunnelConfig struct {
+	window  int     //统计窗口 秒
+	unique  int     //子域名去重数量
+	bytes   int     //报文字节数
+	txt     int     //TXT NULL CNAME 应答数量
+	score   float64 //单个query的高分阈值
+	scored  int     //高分query数量
+	domains int     //同时跟踪的域名上限
+}
+
+func defaultTunnelConfig() *tunnelConfig {
+	return &tunnelConfig{
+		window:  60,
+		unique:  300,
+		bytes:   1 << 20,
+		txt:     200,
+		score:   0.7,
+		scored:  50,
+		domains: 100000,
+	}
+}
+
+func newTunnelConfig(L *lua.LState, val lua.LValue) *tunnelConfig {
+	cfg := defaultTunnelConfig()
+
+	switch val.Type() {
+	case lua.LTBool:
+		if !lua.CheckBool(L, val) {
+			return nil
+		}
+
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "window":
+				cfg.window = checkInt(L, key, v)
+			case "unique":
+				cfg.unique = checkInt(L, key, v)
+			case "bytes":
+				cfg.bytes = checkInt(L, key, v)
+			case "txt":
+				cfg.txt = checkInt(L, key, v)
+			case "score":
+				cfg.score = float64(checkNumber(L, key, v))
+			case "scored":
+				cfg.scored = checkInt(L, key, v)
+			case "domains":
+				cfg.domains = checkInt(L, key, v)
+			default:
+				L.RaiseError("tunnel config not found %s field", key)
+			}
+		})
+
+	default:
+		L.RaiseError("tunnel must be bool or table , got %s", val.Type().String())
+	}
+
+	return cfg
+}
+
+//tunnelScore 单个query的特征打分 0-1 name保留报文中的大小写
+func tunnelScore(name string, qtype uint16) float64 {
+	parent := parentDomain(name)
+	sub := subdomain(name, parent)
+	if sub == "" {
+		return 0
+	}
+
+	//subdomain只转小写和去掉末尾的点 长度不变 取回原始大小写
+	raw := name[:len(sub)]
+
+	var maxLabel, label, digit, hex, b32, b64, upper, lower, symbol, total int
+	var freq [256]int
+
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c == '.' {
+			label = 0
+			continue
+		}
+
+		label++
+		if label > maxLabel {
+			maxLabel = label
+		}
+
+		total++
+		freq[sub[i]]++
+
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper++
+			c += 'a' - 'A'
+		case c >= 'a' && c <= 'z':
+			lower++
+		}
+
+		switch {
+		case c >= '0' && c <= '9':
+			digit++
+			hex++
+			b64++
+			if c >= '2' && c <= '7' {
+				b32++
+			}
+		case c >= 'a' && c <= 'f':
+			hex++
+			b32++
+			b64++
+		case c >= 'g' && c <= 'z':
+			b32++
+			b64++
+		case c == '+', c == '/', c == '=', c == '_':
+			b64++
+			symbol++
+		}
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	var entropy float64
+	for _, n := range freq {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+
+	ratio := func(n int) float64 { return float64(n) / float64(total) }
+
+	//短的子域名看不出编码特征
+	encoded := 0.0
+	if total >= 16 {
+		switch {
+		case ratio(hex) == 1:
+			encoded = 1
+		case ratio(b32) == 1 && ratio(digit) > 0.1:
+			encoded = 0.8
+		case ratio(b64) == 1 && ratio(digit) > 0.1 && (symbol > 0 || mixedCase(upper, lower, name[len(raw):])):
+			encoded = 0.6
+		}
+	}
+
+	score := 0.25*clamp(float64(total)/100) +
+		0.25*clamp((entropy-2.5)/2) +
+		0.2*clamp(float64(maxLabel)/63) +
+		0.2*encoded +
+		0.1*clamp(ratio(digit)*2)
+
+	switch qtype {
+	case dns.TypeTXT, dns.TypeNULL:
+		score += 0.1
+	}
+
+	return clamp(score)
+}
+
+//mixedCase 子域名大小写混合才按base64算 只有小写字母和数字的普通主机名不算
+//dns 0x20 会随机改变整个名称的大小写 注册域名部分也是混合大小写时不算
+func mixedCase(upper, lower int, parent string) bool {
+	if upper == 0 || lower == 0 {
+		return false
+	}
+	return parent == strings.ToLower(parent) || parent == strings.ToUpper(parent)
+}
+
+func clamp(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+type tunnelStat struct {
+	subs     map[string]struct{}
+	queries  int
+	txt      int
+	bytes    int
+	scored   int
+	maxScore float64
+	alerted  bool
+}
+
+//tunnel 固定窗口内按注册域名统计 超过阈值输出告警
+type tunnel struct {
+	mu     sync.Mutex
+	cfg    *tunnelConfig
+	begin  time.Time
+	domain map[string]*tunnelStat
+}
+
+func (cfg *tunnelConfig) valid() error {
+	if cfg.window <= 0 || cfg.unique <= 0 || cfg.bytes <= 0 || cfg.txt <= 0 || cfg.scored <= 0 || cfg.domains <= 0 {
+		return fmt.Errorf("invalid tunnel config")
+	}
+
+	if cfg.score <= 0 || cfg.score > 1 {
+		return fmt.Errorf("invalid tunnel score %v must in (0,1]", cfg.score)
+	}
+
+	return nil
+}
+
+func newTunnel(cfg *tunnelConfig) *tunnel {
+	return &tunnel{cfg: cfg, domain: make(map[string]*tunnelStat)}
+}
+
+func (t *tunnel) inspect(m *monitor, tx *Tx) *Event {
+	name := tx.Qname()
+	if name == "" {
+		return nil
+	}
+
+	q, _ := tx.question()
+	tx.tunnelScore = tunnelScore(name, q.Qtype)
+
+	parent := parentDomain(name)
+	if parent == "" {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tx.time.Sub(t.begin) >= time.Duration(t.cfg.window)*time.Second {
+		t.begin = tx.time
+		t.domain = make(map[string]*tunnelStat)
+	}
+
+	st, ok := t.domain[parent]
+	if !ok {
+		if len(t.domain) >= t.cfg.domains {
+			return nil
+		}
+		st = &tunnelStat{subs: make(map[string]struct{})}
+		t.domain[parent] = st
+	}
+
+	if !tx.msg.Response {
+		st.queries++
+	}
+
+	st.bytes += tx.msg.Len()
+	if len(st.subs) <= t.cfg.unique {
+		st.subs[subdomain(name, parent)] = struct{}{}
+	}
+
+	if tx.tunnelScore >= t.cfg.score {
+		st.scored++
+	}
+
+	if tx.tunnelScore > st.maxScore {
+		st.maxScore = tx.tunnelScore
+	}
+
+	for _, r := range tx.msg.Answer {
+		switch r.Header().Rrtype {
+		case dns.TypeTXT, dns.TypeNULL, dns.TypeCNAME:
+			st.txt++
+		}
+	}
+
+	if st.alerted {
+		return nil
+	}
+
+	var reason []string
+	if len(st.subs) >= t.cfg.unique {
+		reason = append(reason, "unique_subdomain")
+	}
+	if st.bytes >= t.cfg.bytes {
+		reason = append(reason, "bytes")
+	}
+	if st.txt >= t.cfg.txt {
+		reason = append(reason, "txt_answer")
+	}
+	if st.scored >= t.cfg.scored {
+		reason = append(reason, "score")
+	}
+
+	if len(reason) == 0 {
+		return nil
+	}
+
+	st.alerted = true
+	return newEvent(m.Name(), "tunnel", tx.time).
+		Set("domain", parent).
+		Set("remote", tx.Remote()).
+		Set("reason", reason).
+		Set("unique_subdomain", len(st.subs)).
+		Set("queries", st.queries).
+		Set("txt_answer", st.txt).
+		Set("bytes", st.bytes).
+		Set("scored", st.scored).
+		Set("max_score", st.maxScore).
+		Set("window", t.cfg.window)
+}
@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func tunnelTx(name string, qtype uint16, at int) *Tx {
+	tx := &Tx{addr: &net.IPAddr{IP: net.ParseIP("10.0.0.5")}, daddr: net.ParseIP("192.0.2.53"), time: time.Unix(1700000000+int64(at), 0)}
+	tx.msg.SetQuestion(dns.Fqdn(name), qtype)
+	return tx
+}
+
+func TestTunnelScore(t *testing.T) {
+	hex := "4a6f686e20446f652069732061207370792e.abcdefabcdef0123456789.evil.com."
+	if s := tunnelScore(hex, dns.TypeA); s < defaultTunnelConfig().score {
+		t.Fatalf("hex encoded got %.3f", s)
+	}
+
+	if a, txt := tunnelScore(hex, dns.TypeA), tunnelScore(hex, dns.TypeTXT); txt-a < 0.099 {
+		t.Fatalf("txt got %.3f a %.3f", txt, a)
+	}
+
+	//普通的主机名 包括带数字和连字符的
+	for _, name := range []string{
+		"www.google.com.",
+		"mail.example.co.uk.",
+		"webserver01prod02.example.com.",
+		"cdn-edge-03.static.example.com.",
+	} {
+		if s := tunnelScore(name, dns.TypeA); s >= 0.3 {
+			t.Fatalf("%s got %.3f", name, s)
+		}
+	}
+
+	//没有子域名
+	for _, name := range []string{"example.com.", "com.", "."} {
+		if s := tunnelScore(name, dns.TypeTXT); s != 0 {
+			t.Fatalf("%s got %.3f", name, s)
+		}
+	}
+}
+
+//TestTunnelBase64 base64只在大小写混合或者带base64符号时按编码算
+func TestTunnelBase64(t *testing.T) {
+	mixed := tunnelScore("aGVsbG8gd29ybGQ1MjM0NTY3.example.com.", dns.TypeA)
+	lower := tunnelScore("agvsbg8gd29ybgq1mjm0nty3.example.com.", dns.TypeA)
+	symbol := tunnelScore("agvs+g8gd29y/gq1mjm0nty3.example.com.", dns.TypeA)
+
+	//dns 0x20 把整个名称随机大小写 不能算base64
+	x20 := tunnelScore("aGVsbG8gd29ybGQ1MjM0NTY3.eXaMpLe.com.", dns.TypeA)
+
+	if mixed-lower < 0.1 || symbol-lower < 0.1 || mixed-x20 < 0.1 {
+		t.Fatalf("got mixed %.3f symbol %.3f lower %.3f x20 %.3f", mixed, symbol, lower, x20)
+	}
+
+	//太短的子域名看不出编码
+	short := tunnelScore("aGVsbG8gd29y.example.com.", dns.TypeA)
+	shortLower := tunnelScore("agvsbg8gd29y.example.com.", dns.TypeA)
+	if short != shortLower {
+		t.Fatalf("short got %.3f lower %.3f", short, shortLower)
+	}
+}
+
+func TestTunnelInspect(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	cfg := defaultTunnelConfig()
+	cfg.unique, cfg.window, cfg.domains = 5, 60, 2
+	tun := newTunnel(cfg)
+
+	var alerts int
+	for i := 0; i < 10; i++ {
+		if ev := tun.inspect(m, tunnelTx("s"+strconv.Itoa(i)+".t.example.com", dns.TypeA, i)); ev != nil {
+			alerts++
+			if i != 4 {
+				t.Fatalf("alert at query %d", i)
+			}
+
+			if v, _ := ev.Get("domain"); v != "example.com" {
+				t.Fatalf("domain got %v", v)
+			}
+
+			if v, _ := ev.Get("reason"); len(v.([]string)) != 1 || v.([]string)[0] != "unique_subdomain" {
+				t.Fatalf("reason got %v", v)
+			}
+		}
+	}
+
+	if alerts != 1 {
+		t.Fatalf("got %d alerts in one window", alerts)
+	}
+
+	//同一个子域名不重复计数
+	for i := 0; i < 10; i++ {
+		if ev := tun.inspect(m, tunnelTx("same.example.org", dns.TypeA, 20)); ev != nil {
+			t.Fatal("repeated subdomain alerted")
+		}
+	}
+
+	//超过域名上限的不统计
+	tun.inspect(m, tunnelTx("a.example.net", dns.TypeA, 21))
+	if len(tun.domain) != 2 {
+		t.Fatalf("got %d domains", len(tun.domain))
+	}
+
+	//新窗口重新计数
+	for i := 0; i < 5; i++ {
+		ev := tun.inspect(m, tunnelTx("n"+strconv.Itoa(i)+".example.com", dns.TypeA, 60+i))
+		if (ev != nil) != (i == 4) {
+			t.Fatalf("new window query %d alert %v", i, ev != nil)
+		}
+	}
+}
+
+func TestTunnelTxt(t *testing.T) {
+	m := &monitor{cfg: &config{name: "dns"}}
+	cfg := defaultTunnelConfig()
+	cfg.txt = 3
+	tun := newTunnel(cfg)
+
+	for i := 0; i < 3; i++ {
+		tx := tunnelTx("c.example.com", dns.TypeTXT, i)
+		tx.msg.Response = true
+		tx.msg.Answer = append(tx.msg.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: "c.example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"data"}})
+
+		ev := tun.inspect(m, tx)
+		if (ev != nil) != (i == 2) {
+			t.Fatalf("txt answer %d alert %v", i, ev != nil)
+		}
+		if ev == nil {
+			continue
+		}
+
+		if v, _ := ev.Get("txt_answer"); v != 3 {
+			t.Fatalf("txt_answer got %v", v)
+		}
+
+		if v, _ := ev.Get("queries"); v != 0 {
+			t.Fatalf("queries got %v", v)
+		}
+	}
+}
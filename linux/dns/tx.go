@@ -9,18 +9,73 @@ import (
 	"github.com/rock-go/rock/node"
 	"github.com/rock-go/rock/region"
 	"net"
+	"strings"
+	"time"
 )
 
 type Tx struct {
-	code   string
-	name   string
-	host   string
-	src    uint16
-	dst    uint16
-	addr   net.Addr
-	msg    dns.Msg
-	buf    *buffer.Byte
+	code  string
+	name  string
+	host  string
+	src   uint16
+	dst   uint16
+	addr  net.Addr
+	daddr net.IP
+	proto uint8
+	time  time.Time
+
+	//dns mdns llmnr nbns
+	service string
+
+	//dnstap 输入时的来源信息
+	tap *tapInfo
+
+	msg dns.Msg
+	buf *buffer.Byte
+
+	//原始的dns报文 只有配置了写入器时保留
+	wire []byte
+	size int
+
+	//抓包输入时完整的ip报文 dnstap和套接字输入为空
+	pkt []byte
+
 	region *region.Info
+
+	geo       *ipInfo
+	answerGeo []ipGeo
+	proc      *procInfo
+
+	paired  bool
+	timeout bool
+	rtt     time.Duration
+
+	//检测模块的打分
+	tunnelScore float64
+
+	//dga打分在第一次使用时计算
+	dgaDone   bool
+	dgaScore  float64
+	dgaReason []string
+
+	//命中的名单
+	deny  []listMatch
+	allow []listMatch
+
+	//公网域名解析到内网地址
+	rebinding    bool
+	rebindReason string
+	rebindIP     []net.IP
+
+	//国际化域名在第一次使用时解码
+	idnDone     bool
+	idnUnicode  string
+	idnMixed    bool
+	homographOf string
+	typosquatOf string
+
+	//检测模块针对这条tx产生过事件
+	alerted bool
 }
 
 func (tx *Tx) ToLValue() lua.LValue {
@@ -31,7 +86,26 @@ func (tx *Tx) Remote() string {
 	return tx.addr.(*net.IPAddr).IP.String()
 }
 
-func (tx *Tx) QS2S(enc *json.Encoder, qq []dns.Question) {
+//Client query 的来源地址 response 的目的地址 未知时为空
+func (tx *Tx) Client() string {
+	if !tx.msg.Response {
+		return tx.Remote()
+	}
+
+	if tx.daddr != nil {
+		return tx.daddr.String()
+	}
+	return ""
+}
+
+func (tx *Tx) Proto() string {
+	if tx.proto == protoTCP {
+		return "tcp"
+	}
+	return "udp"
+}
+
+func (tx *Tx) QS2S(enc encoder, qq []dns.Question) {
 	n := len(qq)
 	if n == 0 {
 		return
@@ -47,8 +121,10 @@ func (tx *Tx) QS2S(enc *json.Encoder, qq []dns.Question) {
 	}
 }
 
-func (tx *Tx) RR2S(enc *json.Encoder, r dns.RR) {
+func (tx *Tx) RR2S(enc encoder, r dns.RR) {
 	switch v := r.(type) {
+	case *dns.OPT:
+		tx.OPT2S(enc, v)
 	case *dns.A:
 		enc.KV("A", v.A.String())
 	case *dns.AAAA:
@@ -382,7 +458,7 @@ func (tx *Tx) RR2S(enc *json.Encoder, r dns.RR) {
 
 }
 
-func (tx *Tx) RS2S(enc *json.Encoder, rr []dns.RR) {
+func (tx *Tx) RS2S(enc encoder, rr []dns.RR) {
 	n := len(rr)
 	if n == 0 {
 		return
@@ -402,6 +478,31 @@ func (tx *Tx) RS2S(enc *json.Encoder, rr []dns.RR) {
 	}
 }
 
+func (tx *Tx) LM2S(enc encoder, lm []listMatch) {
+	for _, item := range lm {
+		enc.Tab("")
+		item.encode(enc)
+		enc.End("},")
+	}
+}
+
+//Tags 命中名单的标签 去重
+func (tx *Tx) Tags() []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, lm := range [][]listMatch{tx.deny, tx.allow} {
+		for _, item := range lm {
+			for _, tag := range item.tags {
+				if !seen[tag] {
+					seen[tag] = true
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+	return tags
+}
+
 func (tx *Tx) String() string {
 	enc := json.NewEncoder()
 
@@ -411,6 +512,37 @@ func (tx *Tx) String() string {
 	enc.KV("remote", tx.Remote())
 	enc.KV("region", tx.region.Byte())
 	enc.KV("host", tx.host)
+	enc.KV("proto", tx.Proto())
+	enc.KV("service", tx.service)
+
+	if tx.tap != nil {
+		enc.KV("identity", tx.tap.identity)
+		enc.KV("dnstap_type", tx.tap.kind)
+	}
+
+	if tx.proc != nil {
+		enc.KV("pid", tx.proc.Pid)
+		enc.KV("uid", tx.proc.Uid)
+		enc.KV("exe", tx.proc.Exe)
+		enc.KV("cmdline", tx.proc.Cmdline)
+		enc.KV("cgroup", tx.proc.Cgroup)
+		enc.KV("container_id", tx.proc.Container)
+	}
+
+	if tx.geo != nil {
+		enc.Tab("geo")
+		tx.geo.encode(enc)
+		enc.End("},")
+	}
+
+	enc.Arr("answer_geo")
+	for _, item := range tx.answerGeo {
+		enc.Tab("")
+		enc.KV("ip", item.ip.String())
+		item.info.encode(enc)
+		enc.End("},")
+	}
+	enc.End("],")
 
 	enc.KV("dns_id", tx.msg.Id)
 	enc.KV("response", tx.msg.Response)
@@ -424,6 +556,42 @@ func (tx *Tx) String() string {
 	enc.KV("disable", tx.msg.CheckingDisabled)
 	enc.KV("r_code", tx.msg.Rcode)
 	enc.KV("compress", tx.msg.Compress)
+	enc.KV("time", tx.time.Format(time.RFC3339Nano))
+	enc.KV("paired", tx.paired)
+	enc.KV("rtt_ms", float64(tx.rtt)/float64(time.Millisecond))
+	enc.KV("timeout", tx.timeout)
+	enc.KV("tunnel_score", tx.tunnelScore)
+	//没有开启dga检测时不计算打分
+	if tx.dgaDone {
+		enc.KV("dga_score", tx.dgaScore)
+		enc.KV("dga_reason", strings.Join(tx.dgaReason, ","))
+	}
+
+	enc.KV("rebinding", tx.rebinding)
+	enc.KV("rebinding_reason", tx.rebindReason)
+	enc.Join("rebinding_ip", ipStrings(tx.rebindIP))
+
+	//没有开启homograph检测时不解码
+	if tx.idnDone {
+		enc.KV("idn_unicode", tx.idnUnicode)
+		enc.KV("idn_mixed", tx.idnMixed)
+	}
+	enc.KV("homograph_of", tx.homographOf)
+	enc.KV("typosquat_of", tx.typosquatOf)
+
+	ecs, scope := tx.ecs()
+	enc.KV("ecs", ecs)
+	enc.KV("ecs_scope", scope)
+	enc.KV("ede_code", tx.edeCode())
+	enc.KV("ede_text", tx.edeText())
+
+	enc.Arr("deny")
+	tx.LM2S(enc, tx.deny)
+	enc.End("],")
+
+	enc.Arr("allow")
+	tx.LM2S(enc, tx.allow)
+	enc.End("],")
 
 	enc.Arr("question")
 	tx.QS2S(enc, tx.msg.Question)
@@ -446,6 +614,327 @@ func (tx *Tx) String() string {
 	return auxlib.B2S(enc.Bytes())
 }
 
+func (tx *Tx) question() (dns.Question, bool) {
+	if len(tx.msg.Question) == 0 {
+		return dns.Question{}, false
+	}
+	return tx.msg.Question[0], true
+}
+
+//Qname nbns 的名称还原成NetBIOS名称
+func (tx *Tx) Qname() string {
+	q, ok := tx.question()
+	if !ok {
+		return ""
+	}
+
+	if tx.service == "nbns" {
+		if name, _, ok := nbnsName(q.Name); ok {
+			return name
+		}
+	}
+	return q.Name
+}
+
+//AnswerIP 应答中的A和AAAA地址
+func (tx *Tx) AnswerIP() []net.IP {
+	var ips []net.IP
+	for _, r := range tx.msg.Answer {
+		switch v := r.(type) {
+		case *dns.A:
+			ips = append(ips, v.A)
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA)
+		default:
+			if tx.service == "nbns" {
+				ips = append(ips, nbnsAddrs(r)...)
+			}
+		}
+	}
+	return ips
+}
+
+func (tx *Tx) dga() (float64, []string) {
+	if !tx.dgaDone {
+		tx.dgaDone = true
+		tx.dgaScore, tx.dgaReason = dgaScore(tx.Qname())
+	}
+	return tx.dgaScore, tx.dgaReason
+}
+
+//idn qname的unicode形式和是否混用文字 不是国际化域名时为空
+func (tx *Tx) idn() (string, bool) {
+	if !tx.idnDone {
+		tx.idnDone = true
+		tx.idnUnicode, tx.idnMixed = decodeIDN(tx.Qname())
+	}
+	return tx.idnUnicode, tx.idnMixed
+}
+
+func (tx *Tx) HasAnswer(typ string) bool {
+	t, ok := dns.StringToType[strings.ToUpper(typ)]
+	if !ok {
+		return false
+	}
+
+	for _, r := range tx.msg.Answer {
+		if r.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
+
+//QnameSuffix 取qname的后n个label
+func (tx *Tx) QnameSuffix(n int) string {
+	name := strings.TrimSuffix(tx.Qname(), ".")
+	if n <= 0 || name == "" {
+		return ""
+	}
+
+	labels := dns.SplitDomainName(name)
+	if len(labels) <= n {
+		return name
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+func (tx *Tx) rrL(L *lua.LState, rr []dns.RR) lua.LValue {
+	enc := newTableEncoder(L)
+	tx.RS2S(enc, rr)
+	return enc.Table()
+}
+
+func (tx *Tx) lmL(L *lua.LState, lm []listMatch) lua.LValue {
+	tab := L.CreateTable(len(lm), 0)
+	for _, item := range lm {
+		enc := newTableEncoder(L)
+		item.encode(enc)
+		tab.Append(enc.Table())
+	}
+	return tab
+}
+
+func (tx *Tx) answerIPsL(L *lua.LState) int {
+	ips := tx.AnswerIP()
+	tab := L.CreateTable(len(ips), 0)
+	for _, ip := range ips {
+		tab.Append(lua.S2L(ip.String()))
+	}
+	L.Push(tab)
+	return 1
+}
+
+func (tx *Tx) hasAnswerL(L *lua.LState) int {
+	L.Push(lua.LBool(tx.HasAnswer(L.CheckString(1))))
+	return 1
+}
+
+func (tx *Tx) qnameSuffixL(L *lua.LState) int {
+	L.Push(lua.S2L(tx.QnameSuffix(L.CheckInt(1))))
+	return 1
+}
+
+func (tx *Tx) tapL(key string) lua.LValue {
+	if tx.tap == nil {
+		return lua.LNil
+	}
+
+	switch key {
+	case "identity":
+		return lua.S2L(tx.tap.identity)
+	case "dnstap_type":
+		return lua.S2L(tx.tap.kind)
+	case "dnstap_version":
+		return lua.S2L(tx.tap.version)
+	}
+	return lua.LNil
+}
+
+func (tx *Tx) regionL(key string) lua.LValue {
+	if tx.region == nil {
+		return lua.LNil
+	}
+
+	switch key {
+	case "country":
+		return lua.B2L(tx.region.Country)
+	case "province":
+		return lua.B2L(tx.region.Province)
+	case "city":
+		return lua.B2L(tx.region.City)
+	case "isp":
+		return lua.B2L(tx.region.ISP)
+	default:
+		return lua.B2L(tx.region.Byte())
+	}
+}
+
+func (tx *Tx) procL(key string) lua.LValue {
+	if tx.proc == nil {
+		return lua.LNil
+	}
+
+	switch key {
+	case "pid":
+		return lua.LNumber(tx.proc.Pid)
+	case "uid":
+		return lua.LNumber(tx.proc.Uid)
+	case "exe":
+		return lua.S2L(tx.proc.Exe)
+	case "cmdline":
+		return lua.S2L(tx.proc.Cmdline)
+	case "cgroup":
+		return lua.S2L(tx.proc.Cgroup)
+	default:
+		return lua.S2L(tx.proc.Container)
+	}
+}
+
 func (tx *Tx) Index(L *lua.LState, key string) lua.LValue {
+	switch key {
+	case "name":
+		return lua.S2L(tx.name)
+	case "host":
+		return lua.S2L(tx.host)
+	case "remote":
+		return lua.S2L(tx.Remote())
+	case "sport":
+		return lua.LNumber(tx.src)
+	case "dport":
+		return lua.LNumber(tx.dst)
+	case "time":
+		return lua.LNumber(tx.time.Unix())
+	case "proto":
+		return lua.S2L(tx.Proto())
+	case "service":
+		return lua.S2L(tx.service)
+	case "identity", "dnstap_type", "dnstap_version":
+		return tx.tapL(key)
+
+	case "dns_id":
+		return lua.LNumber(tx.msg.Id)
+	case "response":
+		return lua.LBool(tx.msg.Response)
+	case "op_code":
+		return lua.LNumber(tx.msg.Opcode)
+	case "truncated":
+		return lua.LBool(tx.msg.Truncated)
+	case "rcode":
+		return lua.LNumber(tx.msg.Rcode)
+	case "rcode_text":
+		return lua.S2L(dns.RcodeToString[tx.msg.Rcode])
+
+	case "qname":
+		return lua.S2L(tx.Qname())
+	case "qtype":
+		q, ok := tx.question()
+		if !ok {
+			return lua.LNil
+		}
+		return lua.S2L(dns.TypeToString[q.Qtype])
+	case "qclass":
+		q, ok := tx.question()
+		if !ok {
+			return lua.LNil
+		}
+		return lua.S2L(dns.ClassToString[q.Qclass])
+
+	case "answers":
+		return tx.rrL(L, tx.msg.Answer)
+	case "ns":
+		return tx.rrL(L, tx.msg.Ns)
+	case "extra":
+		return tx.rrL(L, tx.msg.Extra)
+
+	case "region", "country", "province", "city", "isp":
+		return tx.regionL(key)
+
+	case "pid", "uid", "exe", "cmdline", "cgroup", "container_id":
+		return tx.procL(key)
+
+	case "geo":
+		return tx.geo.table(L)
+	case "answer_geo":
+		tab := L.CreateTable(len(tx.answerGeo), 0)
+		for _, item := range tx.answerGeo {
+			enc := newTableEncoder(L)
+			enc.KV("ip", item.ip.String())
+			item.info.encode(enc)
+			tab.Append(enc.Table())
+		}
+		return tab
+
+	case "ecs":
+		ecs, _ := tx.ecs()
+		return lua.S2L(ecs)
+	case "ecs_scope":
+		_, scope := tx.ecs()
+		return lua.LNumber(scope)
+	case "ede_code":
+		return lua.LNumber(tx.edeCode())
+	case "ede_text":
+		return lua.S2L(tx.edeText())
+	case "edns":
+		opt := tx.msg.IsEdns0()
+		if opt == nil {
+			return lua.LNil
+		}
+		enc := newTableEncoder(L)
+		tx.OPT2S(enc, opt)
+		return enc.Table()
+
+	case "deny":
+		return tx.lmL(L, tx.deny)
+	case "allow":
+		return tx.lmL(L, tx.allow)
+	case "denied":
+		return lua.LBool(len(tx.deny) > 0)
+	case "allowed":
+		return lua.LBool(len(tx.allow) > 0)
+	case "tags":
+		return toLValue(L, tx.Tags())
+
+	case "paired":
+		return lua.LBool(tx.paired)
+	case "timeout":
+		return lua.LBool(tx.timeout)
+	case "rtt_ms":
+		return lua.LNumber(float64(tx.rtt) / float64(time.Millisecond))
+	case "tunnel_score":
+		return lua.LNumber(tx.tunnelScore)
+	case "dga_score":
+		score, _ := tx.dga()
+		return lua.LNumber(score)
+	case "dga_reason":
+		_, reason := tx.dga()
+		return toLValue(L, reason)
+
+	case "rebinding":
+		return lua.LBool(tx.rebinding)
+	case "rebinding_reason":
+		return lua.S2L(tx.rebindReason)
+	case "rebinding_ip":
+		return toLValue(L, ipStrings(tx.rebindIP))
+
+	case "idn_unicode":
+		unicode, _ := tx.idn()
+		return lua.S2L(unicode)
+	case "idn_mixed":
+		_, mixed := tx.idn()
+		return lua.LBool(mixed)
+	case "homograph_of":
+		return lua.S2L(tx.homographOf)
+	case "typosquat_of":
+		return lua.S2L(tx.typosquatOf)
+
+	case "answer_ips":
+		return L.NewFunction(tx.answerIPsL)
+	case "has_answer":
+		return L.NewFunction(tx.hasAnswerL)
+	case "qname_suffix":
+		return L.NewFunction(tx.qnameSuffixL)
+	}
+
 	return lua.LNil
 }
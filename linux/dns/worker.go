@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"github.com/rock-go/rock/lua"
+	"github.com/rock-go/rock/packet"
+	"sync/atomic"
+)
+
+//job 读取协程交给处理协程的任务 数据已经拷贝 和读取缓冲区无关
+type job struct {
+	f   frame
+	src uint16
+	dst uint16
+	udp *packet.UDPHeader
+	raw []byte
+	pkt []byte
+	tap *tapInfo
+
+	//超时等已经生成好的tx和事件 直接输出
+	tx *Tx
+	ev *Event
+}
+
+type worker struct {
+	co    *lua.LState
+	queue chan *job
+}
+
+type stats struct {
+	received     uint64
+	parsed       uint64
+	parseFailed  uint64
+	queueDropped uint64
+	pipeFailed   uint64
+	sinkFailed   uint64
+	events       uint64
+	spoofSkipped uint64
+	nodEvicted   uint64
+}
+
+func (s *stats) table(L *lua.LState) *lua.LTable {
+	tab := L.CreateTable(0, 9)
+	tab.RawSetString("received", lua.LNumber(atomic.LoadUint64(&s.received)))
+	tab.RawSetString("parsed", lua.LNumber(atomic.LoadUint64(&s.parsed)))
+	tab.RawSetString("parse_failed", lua.LNumber(atomic.LoadUint64(&s.parseFailed)))
+	tab.RawSetString("queue_dropped", lua.LNumber(atomic.LoadUint64(&s.queueDropped)))
+	tab.RawSetString("pipe_failed", lua.LNumber(atomic.LoadUint64(&s.pipeFailed)))
+	tab.RawSetString("sink_failed", lua.LNumber(atomic.LoadUint64(&s.sinkFailed)))
+	tab.RawSetString("events", lua.LNumber(atomic.LoadUint64(&s.events)))
+	tab.RawSetString("spoof_skipped", lua.LNumber(atomic.LoadUint64(&s.spoofSkipped)))
+	tab.RawSetString("nod_evicted", lua.LNumber(atomic.LoadUint64(&s.nodEvicted)))
+	return tab
+}
+
+func (m *monitor) newWorkers() {
+	m.workers = make([]*worker, m.cfg.worker)
+	for i := 0; i < m.cfg.worker; i++ {
+		m.workers[i] = &worker{
+			co:    xEnv.Clone(m.cfg.co),
+			queue: make(chan *job, m.cfg.queue),
+		}
+	}
+}
+
+func (m *monitor) freeWorkers() {
+	for _, w := range m.workers {
+		xEnv.Free(w.co)
+	}
+	m.workers = nil
+}
+
+//dispatch 按照端口对称的hash分配 同一个会话的query和response在同一个协程里处理
+func (m *monitor) dispatch(j *job) {
+	var w *worker
+	switch {
+	case j.ev != nil:
+		w = m.workers[0]
+	case j.tx != nil:
+		w = m.workers[int(j.tx.src^j.tx.dst)%len(m.workers)]
+	default:
+		w = m.workers[int(j.src^j.dst)%len(m.workers)]
+	}
+
+	//离线回放不丢包
+	if m.block {
+		select {
+		case w.queue <- j:
+		case <-m.tom.Dying():
+		}
+		return
+	}
+
+	select {
+	case w.queue <- j:
+	default:
+		atomic.AddUint64(&m.stats.queueDropped, 1)
+	}
+}
+
+func (m *monitor) work(w *worker) {
+	host := m.cfg.bind.Hostname()
+	code := w.co.CodeVM()
+
+	for {
+		select {
+		case <-m.tom.Dying():
+			return
+
+		case j := <-w.queue:
+			if j.ev != nil {
+				m.emit(w.co, j.ev)
+				continue
+			}
+
+			if j.tx != nil {
+				m.pipe(w.co, j.tx)
+				continue
+			}
+
+			var msg dns.Msg
+			var err error
+			wire := j.raw
+			if j.udp != nil {
+				msg, err = packet.Dns(j.udp)
+				wire = j.udp.Payload
+			} else {
+				err = msg.Unpack(j.raw)
+			}
+
+			if err != nil {
+				atomic.AddUint64(&m.stats.parseFailed, 1)
+				xEnv.Infof("%s tx parse dns fail %v", m.Name(), err)
+				continue
+			}
+
+			atomic.AddUint64(&m.stats.parsed, 1)
+			tx := m.newTx(code, host, &j.f, j.src, j.dst, msg)
+			tx.tap = j.tap
+			tx.size = len(wire)
+			if len(m.cfg.sink) > 0 {
+				tx.wire = wire
+				tx.pkt = j.pkt
+			}
+			m.handle(w.co, tx)
+		}
+	}
+}